@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/18F/hmacauth"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// redacted replaces secrets in the configuration served by
+// -admin-config-path.
+const redacted = "REDACTED"
+
+// adminConfig is the body served by -admin-config-path.
+type adminConfig struct {
+	Mode    string         `json:"mode"`
+	Hash    string         `json:"hash"`
+	Options *HmacProxyOpts `json:"options"`
+}
+
+type adminConfigHandler struct {
+	path     string
+	networks []*net.IPNet
+	auth     hmacauth.HmacAuth
+	body     []byte
+	handler  http.Handler
+}
+
+// parseNetworks parses addresses, each an IP address or a CIDR network.
+func parseNetworks(addresses []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(addresses))
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil && ip.To4() != nil {
+			address += "/32"
+		} else if ip != nil {
+			address += "/128"
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// redactURL replaces the password in rawURL, if any.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// redactOpts returns a copy of opts, and of its per-host and per-directory
+// options, whose secrets and URL passwords are replaced by redacted.
+func redactOpts(opts *HmacProxyOpts) *HmacProxyOpts {
+	c := *opts
+	c.LogOutput = nil
+	c.EventOutput = nil
+	if c.Secret != "" {
+		c.Secret = redacted
+	}
+	if c.PreviousSecret != "" {
+		c.PreviousSecret = redacted
+	}
+	if c.HealthSecret != "" {
+		c.HealthSecret = redacted
+	}
+	c.Upstream = HmacProxyURL{Raw: redactURL(opts.Upstream.Raw)}
+	c.DelegateAuthURL = redactURL(opts.DelegateAuthURL)
+	c.AuditWebhookURL = redactURL(opts.AuditWebhookURL)
+	c.Hosts = redactAllOpts(opts.Hosts)
+	c.DirAuths = redactAllOpts(opts.DirAuths)
+	return &c
+}
+
+// redactAllOpts applies redactOpts to each of all.
+func redactAllOpts(
+	all map[string]*HmacProxyOpts) map[string]*HmacProxyOpts {
+	if all == nil {
+		return nil
+	}
+	result := make(map[string]*HmacProxyOpts, len(all))
+	for key, opts := range all {
+		result[key] = redactOpts(opts)
+	}
+	return result
+}
+
+// configHash returns the hex SHA-256 hash of the redacted configuration, so
+// that the configurations of several instances may be compared. Instances
+// with different secrets, but otherwise identical options, share a hash.
+func configHash(opts *HmacProxyOpts) string {
+	body, err := json.Marshal(redactOpts(opts))
+	if err != nil {
+		panic("failed to encode configuration: " + err.Error())
+	}
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+// newAdminConfigHandler returns a http.Handler that answers signed GET
+// requests for opts.AdminConfigPath from opts.AdminAllowedIPs with the
+// redacted configuration, passing all other requests through to handler.
+func newAdminConfigHandler(opts *HmacProxyOpts,
+	handler http.Handler) http.Handler {
+	networks, err := parseNetworks(opts.AdminAllowedIPs)
+	if err != nil {
+		panic("invalid admin-allowed-ips: " + err.Error())
+	}
+	body, err := json.Marshal(adminConfig{modeNames[opts.Mode],
+		configHash(opts), redactOpts(opts)})
+	if err != nil {
+		panic("failed to encode configuration: " + err.Error())
+	}
+	auth := wrapAuth(opts, newDynamicHeadersAuth(opts,
+		canonicalizationStrategies[defaultSigVersion]))
+	return adminConfigHandler{opts.AdminConfigPath, networks, auth, body,
+		handler}
+}
+
+// allowedAddr reports whether remoteAddr is in one of networks.
+func allowedAddr(networks []*net.IPNet, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h adminConfigHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	if r.URL.Path != h.path {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	if !allowedAddr(h.networks, r.RemoteAddr) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, r, "method not allowed: "+r.Method,
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if result, _, _ := h.auth.AuthenticateRequest(
+		r); result != hmacauth.ResultMatch {
+		writeError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(h.body)
+}
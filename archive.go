@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// archiveFormat is the value of the "archive" query parameter that requests a
+// gzipped tarball of a directory under -file-root.
+const archiveFormat = "tar.gz"
+
+type archiveHandler struct {
+	root    string
+	handler http.Handler
+}
+
+func (h archiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	format, ok := r.URL.Query()["archive"]
+	if !ok {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	if len(format) != 1 || format[0] != archiveFormat {
+		writeError(w, r, "unsupported archive format",
+			http.StatusBadRequest)
+		return
+	}
+
+	// Cleaning the path after rooting it ensures that ".." elements can't
+	// escape the file root, as in http.Dir.
+	name := path.Clean("/" + r.URL.Path)
+	dir := filepath.Join(h.root, filepath.FromSlash(name))
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	base := path.Base(name)
+	if base == "/" {
+		base = "root"
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="`+base+".tar.gz\"")
+	if r.Method == "HEAD" {
+		return
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	err := writeArchive(archive, dir)
+	if err == nil {
+		err = archive.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		// The status has already been sent, so all that's left is to
+		// truncate the response.
+		log.Printf("archive of %s failed: %s", name, err)
+	}
+}
+
+// writeArchive adds the directories and regular files under dir to archive,
+// named relative to dir. Symbolic links and other special files are skipped,
+// so that the archive can't include files outside of dir.
+func writeArchive(archive *tar.Writer, dir string) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if file == dir || !(info.IsDir() || info.Mode().IsRegular()) {
+			return nil
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(archive, f)
+		return err
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("HmacProxy directory archives", func() {
+	var (
+		fileRoot string
+		server   *httptest.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		fileRoot, err = ioutil.TempDir("", "hmacproxy-test")
+		Expect(err).NotTo(HaveOccurred())
+		nested := filepath.Join(fileRoot, "dir", "nested")
+		Expect(os.MkdirAll(nested, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(fileRoot, "dir", "a.txt"),
+			[]byte("a"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(nested, "b.txt"),
+			[]byte("b"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(fileRoot, "outside.txt"),
+			[]byte("outside"), 0644)).To(Succeed())
+
+		flags := flag.NewFlagSet(
+			"HmacProxy directory archives", flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-no-default-headers",
+			"-auth",
+			"-file-root=" + fileRoot,
+			"-allow-archive",
+		})
+		server = httptest.NewServer(handler)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(fileRoot)
+	})
+
+	get := func(path string) *http.Response {
+		request, err := http.NewRequest("GET", server.URL+path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+			"Test-Signature", nil).SignRequest(request)
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		return response
+	}
+
+	It("should stream a tarball of the directory", func() {
+		response := get("/dir/?archive=tar.gz")
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Header.Get("Content-Type")).To(
+			Equal("application/gzip"))
+
+		gz, err := gzip.NewReader(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		archive := tar.NewReader(gz)
+		files := make(map[string]string)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).NotTo(HaveOccurred())
+			contents, err := ioutil.ReadAll(archive)
+			Expect(err).NotTo(HaveOccurred())
+			files[header.Name] = string(contents)
+		}
+		Expect(files).To(Equal(map[string]string{
+			"a.txt":        "a",
+			"nested/":      "",
+			"nested/b.txt": "b",
+		}))
+	})
+
+	It("should reject unsupported formats", func() {
+		response := get("/dir/?archive=zip")
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should not archive files", func() {
+		response := get("/outside.txt?archive=tar.gz")
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("should require authentication", func() {
+		response, err := http.Get(server.URL + "/dir/?archive=tar.gz")
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+})
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/18F/hmacauth"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// auditQueueSize is the number of audit events that may await
+	// delivery before new events are dropped.
+	auditQueueSize = 1000
+
+	// auditAttempts is the number of times delivery of an audit event is
+	// attempted before it is dropped.
+	auditAttempts = 3
+
+	// auditRetryDelay is the delay before the first retry of an audit
+	// event, doubling for each subsequent retry.
+	auditRetryDelay = 500 * time.Millisecond
+)
+
+// auditEvent is the JSON body POSTed to -audit-webhook-url for each
+// authentication result.
+type auditEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Result    string    `json:"result"`
+}
+
+// auditor delivers audit events to a webhook from a background goroutine,
+// so that request handling never waits for the webhook.
+type auditor struct {
+	url        string
+	client     *http.Client
+	events     chan auditEvent
+	retryDelay time.Duration
+}
+
+// newAuditor returns an auditor delivering events to opts.AuditWebhookURL,
+// or nil if there is no -audit-webhook-url.
+func newAuditor(opts *HmacProxyOpts) *auditor {
+	if opts.AuditWebhookURL == "" {
+		return nil
+	}
+	a := &auditor{
+		url:        opts.AuditWebhookURL,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		events:     make(chan auditEvent, auditQueueSize),
+		retryDelay: auditRetryDelay,
+	}
+	go a.run()
+	return a
+}
+
+// record queues event for delivery, dropping it if the queue is full.
+func (a *auditor) record(event auditEvent) {
+	select {
+	case a.events <- event:
+	default:
+		log.Printf("audit event dropped: queue full")
+	}
+}
+
+func (a *auditor) run() {
+	for event := range a.events {
+		a.deliver(event)
+	}
+}
+
+// deliver POSTs event to the webhook, retrying failed attempts.
+func (a *auditor) deliver(event auditEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("audit event dropped: %s", err)
+		return
+	}
+	delay := a.retryDelay
+	for attempt := 1; ; attempt++ {
+		if err = a.post(body); err == nil {
+			return
+		} else if attempt == auditAttempts {
+			log.Printf("audit event dropped: %s", err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (a *auditor) post(body []byte) error {
+	response, err := a.client.Post(
+		a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return &auditError{response.StatusCode}
+	}
+	return nil
+}
+
+// auditError reports that the webhook rejected an audit event.
+type auditError struct {
+	status int
+}
+
+func (e *auditError) Error() string {
+	return "audit webhook responded " + strconv.Itoa(e.status)
+}
+
+// auditAuth records an audit event for each request that fails
+// authentication, and, if successes is set, each request that passes.
+type auditAuth struct {
+	hmacauth.HmacAuth
+	auditor   *auditor
+	successes bool
+}
+
+// wrapAudit applies the -audit-webhook-url options specified in opts to auth.
+func wrapAudit(opts *HmacProxyOpts, audit *auditor,
+	auth hmacauth.HmacAuth) hmacauth.HmacAuth {
+	if audit == nil {
+		return auth
+	}
+	return auditAuth{auth, audit, opts.AuditSuccesses}
+}
+
+func (a auditAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	result, headerSignature, computedSignature =
+		a.HmacAuth.AuthenticateRequest(r)
+	if result != hmacauth.ResultMatch || a.successes {
+		a.auditor.record(auditEvent{
+			Timestamp: time.Now().UTC(),
+			Remote:    remoteHost(r),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Result:    authResultNames[result],
+		})
+	}
+	return
+}
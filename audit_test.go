@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("HmacProxy audit webhook", func() {
+	var (
+		opts     *HmacProxyOpts
+		flags    *flag.FlagSet
+		events   chan auditEvent
+		receiver *httptest.Server
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet(
+			"HmacProxy audit webhook", flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+		events = make(chan auditEvent, 10)
+		receiver = httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				var event auditEvent
+				err := json.NewDecoder(r.Body).Decode(&event)
+				Expect(err).NotTo(HaveOccurred())
+				events <- event
+			}))
+	})
+
+	AfterEach(func() {
+		receiver.Close()
+	})
+
+	It("should post an event for each authentication failure", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-audit-webhook-url=" + receiver.URL,
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		response, err := http.Get(server.URL + "/foo")
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		var event auditEvent
+		Eventually(events).Should(Receive(&event))
+		Expect(event.Remote).To(Equal("127.0.0.1"))
+		Expect(event.Method).To(Equal("GET"))
+		Expect(event.Path).To(Equal("/foo"))
+		Expect(event.Result).To(Equal("no-signature"))
+		Expect(event.Timestamp).To(BeTemporally("~", time.Now(),
+			time.Minute))
+	})
+
+	It("should retry failed deliveries", func() {
+		var attempts int32
+		flaky := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) == 1 {
+					w.WriteHeader(http.StatusBadGateway)
+				}
+			}))
+		defer flaky.Close()
+		opts.AuditWebhookURL = flaky.URL
+		audit := newAuditor(opts)
+		audit.retryDelay = time.Millisecond
+		audit.record(auditEvent{Result: "mismatch"})
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&attempts)
+		}).Should(Equal(int32(2)))
+	})
+})
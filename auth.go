@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/18F/hmacauth"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// wrapAuth applies the signature-format and body canonicalization options specified in opts to auth.
+func wrapAuth(opts *HmacProxyOpts, auth hmacauth.HmacAuth) hmacauth.HmacAuth {
+	if opts.BodyNewline != BodyNewlinePreserve {
+		auth = bodyNewlineAuth{auth, opts.SignHeader, opts.BodyNewline}
+	}
+	if opts.MultipartCanonical {
+		auth = multipartAuth{auth, opts.SignHeader}
+	}
+	if opts.MinBodySignBytes != 0 {
+		auth = minBodyAuth{auth, opts.SignHeader, opts.MinBodySignBytes}
+	}
+	if opts.QueryDupPolicy == QueryDupPolicySort {
+		auth = queryAuth{auth, opts.SignHeader,
+			sortDuplicateQueryValues}
+	}
+	if opts.SortQueryParams {
+		auth = queryAuth{auth, opts.SignHeader, sortQueryParams}
+	}
+	if opts.SignaturePrefixAlgo {
+		auth = prefixAlgoAuth{auth, opts.SignHeader}
+	}
+	return auth
+}
+
+// copyRequest returns a shallow copy of r with its own copy of r.Header, so
+// that the headers of the copy may be modified before signing or
+// authenticating it. hmacauth replaces the Body of requests it signs or
+// authenticates, so callers must copy the Body of the copy back to r
+// afterwards.
+func copyRequest(r *http.Request) *http.Request {
+	c := *r
+	c.Header = make(http.Header, len(r.Header))
+	for name, values := range r.Header {
+		c.Header[name] = append([]string(nil), values...)
+	}
+	return &c
+}
+
+// prefixAlgoAuth formats signatures as "<algorithm>=<hex digest>", as used by
+// many webhook providers, instead of the hmacauth format of "<algorithm>
+// <base64 digest>".
+type prefixAlgoAuth struct {
+	hmacauth.HmacAuth
+	header string
+}
+
+func (a prefixAlgoAuth) Sign(r *http.Request) string {
+	return toPrefixAlgo(a.HmacAuth.Sign(r))
+}
+
+func (a prefixAlgoAuth) SignRequest(r *http.Request) {
+	r.Header.Set(a.header, a.Sign(r))
+}
+
+func (a prefixAlgoAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	headerSignature = r.Header.Get(a.header)
+	c := copyRequest(r)
+	c.Header.Set(a.header, fromPrefixAlgo(headerSignature))
+	result, _, computedSignature = a.HmacAuth.AuthenticateRequest(c)
+	r.Body = c.Body
+	computedSignature = toPrefixAlgo(computedSignature)
+	return
+}
+
+// toPrefixAlgo converts a signature from the hmacauth format to the
+// "<algorithm>=<hex digest>" format. Signatures that cannot be converted are
+// returned unchanged.
+func toPrefixAlgo(signature string) string {
+	components := strings.Split(signature, " ")
+	if len(components) != 2 {
+		return signature
+	}
+	digest, err := base64.StdEncoding.DecodeString(components[1])
+	if err != nil {
+		return signature
+	}
+	return components[0] + "=" + hex.EncodeToString(digest)
+}
+
+// fromPrefixAlgo converts a signature from the "<algorithm>=<hex digest>"
+// format to the hmacauth format. Signatures that cannot be converted are
+// returned unchanged, so that hmacauth may report why they're invalid.
+func fromPrefixAlgo(signature string) string {
+	i := strings.Index(signature, "=")
+	if i <= 0 || strings.Contains(signature, " ") {
+		return signature
+	}
+	digest, err := hex.DecodeString(signature[i+1:])
+	if err != nil {
+		return signature
+	}
+	return signature[:i] + " " + base64.StdEncoding.EncodeToString(digest)
+}
+
+// bodyNewlineAuth computes signatures over a copy of the request body with
+// its line endings converted to "\n" or "\r\n", so that clients and servers
+// that convert line endings differently still agree. The request body itself
+// is passed through unchanged.
+type bodyNewlineAuth struct {
+	hmacauth.HmacAuth
+	header  string
+	newline string
+}
+
+// normalized returns a copy of r whose body has normalized line endings.
+func (a bodyNewlineAuth) normalized(r *http.Request) *http.Request {
+	body := readRequestBody(r)
+	c := copyRequest(r)
+	if body == nil {
+		return c
+	}
+	body = bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+	if a.newline == BodyNewlineCRLF {
+		body = bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1)
+	}
+	c.Body = ioutil.NopCloser(bytes.NewReader(body))
+	c.ContentLength = int64(len(body))
+	return c
+}
+
+func (a bodyNewlineAuth) Sign(r *http.Request) string {
+	return a.HmacAuth.Sign(a.normalized(r))
+}
+
+func (a bodyNewlineAuth) SignRequest(r *http.Request) {
+	r.Header.Set(a.header, a.Sign(r))
+}
+
+func (a bodyNewlineAuth) StringToSign(r *http.Request) string {
+	return a.HmacAuth.StringToSign(a.normalized(r))
+}
+
+func (a bodyNewlineAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	return a.HmacAuth.AuthenticateRequest(a.normalized(r))
+}
+
+// minBodyAuth signs and authenticates requests whose bodies are shorter than
+// min bytes as if their bodies were empty, so that such bodies need not be
+// read and hashed. Such bodies are unauthenticated: they may be changed
+// without invalidating the signature. The request body itself is passed
+// through unchanged.
+type minBodyAuth struct {
+	hmacauth.HmacAuth
+	header string
+	min    int64
+}
+
+// withoutShortBody returns a copy of r with an empty body if r's body is
+// shorter than a.min, or r itself otherwise.
+func (a minBodyAuth) withoutShortBody(r *http.Request) *http.Request {
+	if r.ContentLength < 0 || r.ContentLength >= a.min {
+		return r
+	}
+	c := copyRequest(r)
+	c.Body = nil
+	c.ContentLength = 0
+	return c
+}
+
+func (a minBodyAuth) Sign(r *http.Request) string {
+	return a.HmacAuth.Sign(a.withoutShortBody(r))
+}
+
+func (a minBodyAuth) SignRequest(r *http.Request) {
+	r.Header.Set(a.header, a.Sign(r))
+}
+
+func (a minBodyAuth) StringToSign(r *http.Request) string {
+	return a.HmacAuth.StringToSign(a.withoutShortBody(r))
+}
+
+func (a minBodyAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	return a.HmacAuth.AuthenticateRequest(a.withoutShortBody(r))
+}
+
+// queryAuth computes signatures over a copy of the request URL with its query
+// string canonicalized, so that clients may send the parameters in any order
+// the canonicalization allows. The request URL itself is passed through
+// unchanged.
+type queryAuth struct {
+	hmacauth.HmacAuth
+	header    string
+	canonical func(params []string)
+}
+
+// sortQueryParams canonicalizes query parameters for -sort-query-params.
+func sortQueryParams(params []string) {
+	sort.Strings(params)
+}
+
+// sortDuplicateQueryValues canonicalizes query parameters for
+// -query-dup-policy=sort. Each key keeps its positions, but the values of
+// repeated keys are sorted across them, so "a=2&b=1&a=1" becomes
+// "a=1&b=1&a=2".
+func sortDuplicateQueryValues(params []string) {
+	positions := make(map[string][]int)
+	var keys []string
+	for i, param := range params {
+		key := strings.SplitN(param, "=", 2)[0]
+		if _, ok := positions[key]; !ok {
+			keys = append(keys, key)
+		}
+		positions[key] = append(positions[key], i)
+	}
+	for _, key := range keys {
+		indices := positions[key]
+		if len(indices) < 2 {
+			continue
+		}
+		values := make([]string, len(indices))
+		for i, index := range indices {
+			values[i] = params[index]
+		}
+		sort.Strings(values)
+		for i, index := range indices {
+			params[index] = values[i]
+		}
+	}
+}
+
+// canonicalized returns a copy of r whose query parameters are canonicalized.
+func (a queryAuth) canonicalized(r *http.Request) *http.Request {
+	c := copyRequest(r)
+	if r.URL.RawQuery == "" {
+		return c
+	}
+	u := *r.URL
+	params := strings.Split(u.RawQuery, "&")
+	a.canonical(params)
+	u.RawQuery = strings.Join(params, "&")
+	c.URL = &u
+	return c
+}
+
+func (a queryAuth) Sign(r *http.Request) string {
+	c := a.canonicalized(r)
+	signature := a.HmacAuth.Sign(c)
+	r.Body = c.Body
+	return signature
+}
+
+func (a queryAuth) SignRequest(r *http.Request) {
+	r.Header.Set(a.header, a.Sign(r))
+}
+
+func (a queryAuth) StringToSign(r *http.Request) string {
+	return a.HmacAuth.StringToSign(a.canonicalized(r))
+}
+
+func (a queryAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	c := a.canonicalized(r)
+	result, headerSignature, computedSignature =
+		a.HmacAuth.AuthenticateRequest(c)
+	r.Body = c.Body
+	return
+}
+
+// signMethodsAuth only signs and authenticates requests using the methods
+// listed in -sign-methods. Requests using other methods are left unsigned,
+// and pass authentication without a signature.
+type signMethodsAuth struct {
+	hmacauth.HmacAuth
+	methods map[string]bool
+}
+
+// wrapSignMethods applies the -sign-methods option specified in opts to auth.
+func wrapSignMethods(opts *HmacProxyOpts,
+	auth hmacauth.HmacAuth) hmacauth.HmacAuth {
+	if len(opts.SignMethods) == 0 {
+		return auth
+	}
+	methods := make(map[string]bool)
+	for _, method := range opts.SignMethods {
+		methods[method] = true
+	}
+	return signMethodsAuth{auth, methods}
+}
+
+func (a signMethodsAuth) SignRequest(r *http.Request) {
+	if a.methods[r.Method] {
+		a.HmacAuth.SignRequest(r)
+	}
+}
+
+func (a signMethodsAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	if !a.methods[r.Method] {
+		result = hmacauth.ResultMatch
+		return
+	}
+	return a.HmacAuth.AuthenticateRequest(r)
+}
+
+// signExemptAuth leaves requests for paths beginning with one of the
+// -sign-exempt-prefix prefixes unsigned. It only applies to signing, since
+// -sign-exempt-prefix may not be combined with -auth.
+type signExemptAuth struct {
+	hmacauth.HmacAuth
+	prefixes []string
+}
+
+// wrapSignExempt applies the -sign-exempt-prefix option specified in opts to
+// auth.
+func wrapSignExempt(opts *HmacProxyOpts,
+	auth hmacauth.HmacAuth) hmacauth.HmacAuth {
+	if len(opts.SignExemptPrefixes) == 0 {
+		return auth
+	}
+	return signExemptAuth{auth, opts.SignExemptPrefixes}
+}
+
+func (a signExemptAuth) SignRequest(r *http.Request) {
+	for _, prefix := range a.prefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return
+		}
+	}
+	a.HmacAuth.SignRequest(r)
+}
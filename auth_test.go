@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// signatureServer responds with the value of the Test-Signature header.
+type signatureServer struct{}
+
+func (s signatureServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte(r.Header.Get("Test-Signature")))
+}
+
+var _ = Describe("HmacProxy signature formats", func() {
+	var (
+		localOpts, upstreamOpts   *HmacProxyOpts
+		localFlags, upstreamFlags *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		localFlags = flag.NewFlagSet(
+			"HmacProxy signature formats (local)",
+			flag.ContinueOnError)
+		localOpts = RegisterCommandLineOptions(localFlags)
+		upstreamFlags = flag.NewFlagSet(
+			"HmacProxy signature formats (upstream)",
+			flag.ContinueOnError)
+		upstreamOpts = RegisterCommandLineOptions(upstreamFlags)
+	})
+
+	Context("with -signature-prefix-algo", func() {
+		It("should sign requests as <digest>=<hex>", func() {
+			upstream := httptest.NewServer(signatureServer{})
+			defer upstream.Close()
+			handler, _ := newHandler(localFlags, localOpts, []string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-digest=sha256",
+				"-signature-prefix-algo",
+				"-upstream=" + upstream.URL,
+			})
+			local := httptest.NewServer(handler)
+			defer local.Close()
+
+			response, err := http.Get(local.URL + "/")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(response)).To(
+				MatchRegexp("^sha256=[0-9a-f]{64}$"))
+		})
+
+		It("should authenticate <digest>=<hex> signatures", func() {
+			handler, _ := newHandler(upstreamFlags, upstreamOpts,
+				[]string{
+					"-secret=foobar",
+					"-sign-header=Test-Signature",
+					"-signature-prefix-algo",
+					"-auth",
+				})
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+			handler, _ = newHandler(localFlags, localOpts, []string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-digest=sha256",
+				"-signature-prefix-algo",
+				"-upstream=" + upstream.URL,
+			})
+			local := httptest.NewServer(handler)
+			defer local.Close()
+
+			response, err := http.Get(local.URL + "/")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusAccepted))
+		})
+
+		It("should reject a mismatched <digest>=<hex> signature", func() {
+			handler, _ := newHandler(upstreamFlags, upstreamOpts,
+				[]string{
+					"-secret=bazquux",
+					"-sign-header=Test-Signature",
+					"-signature-prefix-algo",
+					"-auth",
+				})
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+			handler, _ = newHandler(localFlags, localOpts, []string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-digest=sha256",
+				"-signature-prefix-algo",
+				"-upstream=" + upstream.URL,
+			})
+			local := httptest.NewServer(handler)
+			defer local.Close()
+
+			response, err := http.Get(local.URL + "/")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("with -body-newline", func() {
+		// sendCRLF sends a body with CRLF line endings, signed as if
+		// it had LF line endings, to a proxy configured by argv.
+		sendCRLF := func(argv []string) int {
+			handler, _ := newHandler(upstreamFlags, upstreamOpts,
+				append([]string{
+					"-secret=foobar",
+					"-sign-header=Test-Signature",
+					"-no-default-headers",
+					"-auth",
+				}, argv...))
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+
+			request, err := http.NewRequest("POST", upstream.URL+"/",
+				strings.NewReader("line one\nline two\n"))
+			Expect(err).NotTo(HaveOccurred())
+			hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+				"Test-Signature", nil).SignRequest(request)
+			crlf := "line one\r\nline two\r\n"
+			request.Body = ioutil.NopCloser(strings.NewReader(crlf))
+			request.ContentLength = int64(len(crlf))
+
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return response.StatusCode
+		}
+
+		It("should authenticate a CRLF body signed as LF", func() {
+			Expect(sendCRLF([]string{"-body-newline=lf"})).To(
+				Equal(http.StatusAccepted))
+		})
+
+		It("should preserve line endings by default", func() {
+			Expect(sendCRLF(nil)).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("with -min-body-sign-bytes", func() {
+		// send sends body, signed as if it were empty, to a proxy
+		// configured with -min-body-sign-bytes=8.
+		send := func(body string) int {
+			handler, _ := newHandler(upstreamFlags, upstreamOpts,
+				[]string{
+					"-secret=foobar",
+					"-sign-header=Test-Signature",
+					"-no-default-headers",
+					"-auth",
+					"-min-body-sign-bytes=8",
+				})
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+
+			request, err := http.NewRequest("POST", upstream.URL+"/",
+				nil)
+			Expect(err).NotTo(HaveOccurred())
+			hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+				"Test-Signature", nil).SignRequest(request)
+			request.Body = ioutil.NopCloser(strings.NewReader(body))
+			request.ContentLength = int64(len(body))
+
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return response.StatusCode
+		}
+
+		It("should authenticate an empty body", func() {
+			Expect(send("")).To(Equal(http.StatusAccepted))
+		})
+
+		It("should authenticate a body below the threshold", func() {
+			Expect(send("short")).To(Equal(http.StatusAccepted))
+		})
+
+		It("should accept a tampered body below the threshold", func() {
+			handler, _ := newHandler(upstreamFlags, upstreamOpts,
+				[]string{
+					"-secret=foobar",
+					"-sign-header=Test-Signature",
+					"-no-default-headers",
+					"-auth",
+					"-min-body-sign-bytes=8",
+				})
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+
+			request, err := http.NewRequest("POST", upstream.URL+"/",
+				strings.NewReader("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			minBodyAuth{hmacauth.NewHmacAuth(crypto.SHA1,
+				[]byte("foobar"), "Test-Signature", nil),
+				"Test-Signature", 8}.SignRequest(request)
+			request.Body = ioutil.NopCloser(
+				strings.NewReader("pong"))
+
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusAccepted))
+		})
+
+		It("should sign bodies at the threshold", func() {
+			Expect(send("long body")).To(
+				Equal(http.StatusUnauthorized))
+		})
+
+		It("should agree with a signing proxy", func() {
+			handler, _ := newHandler(upstreamFlags, upstreamOpts,
+				[]string{
+					"-secret=foobar",
+					"-sign-header=Test-Signature",
+					"-auth",
+					"-min-body-sign-bytes=8",
+				})
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+			handler, _ = newHandler(localFlags, localOpts, []string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+				"-min-body-sign-bytes=8",
+			})
+			local := httptest.NewServer(handler)
+			defer local.Close()
+
+			for _, body := range []string{"", "short", "long body"} {
+				response, err := http.Post(local.URL+"/",
+					"text/plain", strings.NewReader(body))
+				Expect(err).NotTo(HaveOccurred())
+				response.Body.Close()
+				Expect(response.StatusCode).To(
+					Equal(http.StatusAccepted))
+			}
+		})
+	})
+
+	Context("with -sort-query-params", func() {
+		// send sends a request for /?b=2&a=1&a=0, signed as if its
+		// query string were a=0&a=1&b=2, to a proxy configured by argv.
+		send := func(argv ...string) int {
+			handler, _ := newHandler(upstreamFlags, upstreamOpts,
+				append([]string{
+					"-secret=foobar",
+					"-sign-header=Test-Signature",
+					"-no-default-headers",
+					"-auth",
+				}, argv...))
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+
+			request, err := http.NewRequest("GET",
+				upstream.URL+"/?a=0&a=1&b=2", nil)
+			Expect(err).NotTo(HaveOccurred())
+			hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+				"Test-Signature", nil).SignRequest(request)
+			request.URL.RawQuery = "b=2&a=1&a=0"
+
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return response.StatusCode
+		}
+
+		It("should authenticate reordered query parameters", func() {
+			Expect(send("-sort-query-params")).To(
+				Equal(http.StatusAccepted))
+		})
+
+		It("should preserve the order by default", func() {
+			Expect(send()).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("with -query-dup-policy", func() {
+		// send sends a request for /?a=2&b=3&a=1, signed as if its
+		// query string were a=1&b=3&a=2, to a proxy configured by argv.
+		send := func(argv ...string) int {
+			handler, _ := newHandler(upstreamFlags, upstreamOpts,
+				append([]string{
+					"-secret=foobar",
+					"-sign-header=Test-Signature",
+					"-no-default-headers",
+					"-auth",
+				}, argv...))
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+
+			request, err := http.NewRequest("GET",
+				upstream.URL+"/?a=1&b=3&a=2", nil)
+			Expect(err).NotTo(HaveOccurred())
+			hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+				"Test-Signature", nil).SignRequest(request)
+			request.URL.RawQuery = "a=2&b=3&a=1"
+
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return response.StatusCode
+		}
+
+		It("should authenticate reordered repeated values", func() {
+			Expect(send("-query-dup-policy=sort")).To(
+				Equal(http.StatusAccepted))
+		})
+
+		It("should preserve the order of values by default", func() {
+			Expect(send()).To(Equal(http.StatusUnauthorized))
+			Expect(send("-query-dup-policy=preserve")).To(
+				Equal(http.StatusUnauthorized))
+		})
+
+		It("should sign reordered repeated values alike", func() {
+			auth := queryAuth{hmacauth.NewHmacAuth(crypto.SHA1,
+				[]byte("foobar"), "Test-Signature", nil),
+				"Test-Signature", sortDuplicateQueryValues}
+			sign := func(query string) string {
+				request, err := http.NewRequest("GET",
+					"http://localhost/?"+query, nil)
+				Expect(err).NotTo(HaveOccurred())
+				return auth.Sign(request)
+			}
+			Expect(sign("a=2&b=3&a=1")).To(
+				Equal(sign("a=1&b=3&a=2")))
+			Expect(sign("a=2&b=3&a=1")).NotTo(
+				Equal(sign("b=3&a=1&a=2")))
+		})
+	})
+
+	Context("with differently cased signature headers", func() {
+		It("should authenticate regardless of case", func() {
+			handler, _ := newHandler(upstreamFlags, upstreamOpts,
+				[]string{
+					"-secret=foobar",
+					"-sign-header=TEST-SIGNATURE",
+					"-no-default-headers",
+					"-auth",
+				})
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+
+			request, err := http.NewRequest("GET", upstream.URL+"/",
+				nil)
+			Expect(err).NotTo(HaveOccurred())
+			signature := hmacauth.NewHmacAuth(crypto.SHA1,
+				[]byte("foobar"), "Test-Signature", nil).Sign(request)
+			// Assigning to the map directly sends the header name
+			// with exactly this case.
+			request.Header["test-signature"] = []string{signature}
+
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusAccepted))
+		})
+	})
+
+	Context("with -multipart-canonical", func() {
+		// form returns a multipart/form-data body containing a field
+		// and a file, in the given order, and its content type.
+		form := func(fileFirst bool) (string, string) {
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			Expect(writer.SetBoundary("boundary")).To(Succeed())
+			field := func() {
+				Expect(writer.WriteField("comment",
+					"quarterly figures")).To(Succeed())
+			}
+			if !fileFirst {
+				field()
+			}
+			file, err := writer.CreateFormFile("upload", "report.csv")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.Write([]byte("a,b\n1,2\n"))
+			Expect(err).NotTo(HaveOccurred())
+			if fileFirst {
+				field()
+			}
+			Expect(writer.Close()).To(Succeed())
+			return body.String(), writer.FormDataContentType()
+		}
+
+		// send sends the form with its file first, signed as if its
+		// field came first, to a proxy configured by argv.
+		send := func(argv ...string) int {
+			handler, _ := newHandler(upstreamFlags, upstreamOpts,
+				append([]string{
+					"-secret=foobar",
+					"-sign-header=Test-Signature",
+					"-headers=Content-Type",
+					"-auth",
+				}, argv...))
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+
+			signed, contentType := form(false)
+			request, err := http.NewRequest("POST", upstream.URL+"/",
+				strings.NewReader(signed))
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Content-Type", contentType)
+			multipartAuth{hmacauth.NewHmacAuth(crypto.SHA1,
+				[]byte("foobar"), "Test-Signature",
+				[]string{"Content-Type"}),
+				"Test-Signature"}.SignRequest(request)
+
+			reordered, _ := form(true)
+			request.Body = ioutil.NopCloser(
+				strings.NewReader(reordered))
+			request.ContentLength = int64(len(reordered))
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return response.StatusCode
+		}
+
+		It("should authenticate reordered parts", func() {
+			Expect(send("-multipart-canonical")).To(
+				Equal(http.StatusAccepted))
+		})
+
+		It("should sign the exact body by default", func() {
+			Expect(send()).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should describe each part canonically", func() {
+			body, contentType := form(true)
+			_, params, err := mime.ParseMediaType(contentType)
+			Expect(err).NotTo(HaveOccurred())
+			canonical, err := canonicalMultipart([]byte(body),
+				params["boundary"])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(canonical)).To(Equal(
+				"comment=quarterly+figures&upload=report.csv;" +
+					"sha256=492d5ea496056f1a6a6592241032fab7" +
+					"64c321596317930b4fa0e1e8bc3b7470"))
+		})
+	})
+
+	Context("with -sign-methods", func() {
+		It("should only authenticate the listed methods", func() {
+			proxied := httptest.NewServer(proxiedServer{})
+			defer proxied.Close()
+			handler, _ := newHandler(upstreamFlags, upstreamOpts,
+				[]string{
+					"-secret=foobar",
+					"-sign-header=Test-Signature",
+					"-auth",
+					"-upstream=" + proxied.URL,
+					"-sign-methods=post,PUT,DELETE",
+				})
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			response, err := http.Get(server.URL + "/")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(response)).To(Equal("Success!"))
+
+			response, err = http.Post(server.URL+"/", "text/plain",
+				strings.NewReader("body"))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("with -sign-exempt-prefix", func() {
+		It("should leave exempt paths unsigned", func() {
+			upstream := httptest.NewServer(signatureServer{})
+			defer upstream.Close()
+			handler, _ := newHandler(localFlags, localOpts, []string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+				"-sign-exempt-prefix=/healthz,/metrics/",
+			})
+			local := httptest.NewServer(handler)
+			defer local.Close()
+
+			signature := func(path string) string {
+				response, err := http.Get(local.URL + path)
+				Expect(err).NotTo(HaveOccurred())
+				defer response.Body.Close()
+				Expect(response.StatusCode).To(
+					Equal(http.StatusOK))
+				return readBody(response)
+			}
+			Expect(signature("/healthz")).To(BeEmpty())
+			Expect(signature("/metrics/requests")).To(BeEmpty())
+			Expect(signature("/metrics")).NotTo(BeEmpty())
+			Expect(signature("/")).To(HavePrefix("sha1 "))
+		})
+	})
+})
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/18F/hmacauth"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// batchEnvelope is the body of a -batch-mode request: a list of payloads,
+// each signed separately, such as events collected from several senders.
+type batchEnvelope struct {
+	Items []batchItem `json:"items"`
+}
+
+// batchItem is a single payload of a batchEnvelope. Signature has the same
+// "<digest> <base64>" format as the signature header, but is computed over
+// Payload exactly as it appears in the envelope.
+type batchItem struct {
+	Signature string          `json:"signature"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// batchHandler authenticates each item of a batchEnvelope before proxying
+// the batch. If filter is false, it rejects the whole batch when any item
+// fails authentication. Otherwise it proxies only the items that pass,
+// rejecting the batch only if none do.
+type batchHandler struct {
+	key     []byte
+	digest  crypto.Hash
+	filter  bool
+	handler http.Handler
+}
+
+// newBatchHandler returns the http.Handler and its description for
+// -batch-mode.
+func newBatchHandler(opts *HmacProxyOpts) (
+	handler http.Handler, description string) {
+	description = "proxying batches of authenticated items to: " +
+		opts.Upstream.Raw
+	handler = batchHandler{[]byte(opts.Secret), opts.Digest.ID,
+		opts.BatchMode == BatchModeFilter,
+		newTransformHandler(opts, newUpstreamProxy(opts, nil))}
+	return
+}
+
+// valid reports whether item carries a valid signature made with h.digest.
+func (h batchHandler) valid(item batchItem) bool {
+	components := strings.Split(item.Signature, " ")
+	if len(components) != 2 {
+		return false
+	}
+	digest, err := hmacauth.DigestNameToCryptoHash(components[0])
+	if err != nil || digest != h.digest {
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(components[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(h.digest.New, h.key)
+	_, _ = mac.Write(item.Payload)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+func (h batchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var batch batchEnvelope
+	if err := json.Unmarshal(readRequestBody(r), &batch); err != nil ||
+		len(batch.Items) == 0 {
+		writeError(w, r, "invalid batch", http.StatusBadRequest)
+		return
+	}
+
+	valid := make([]batchItem, 0, len(batch.Items))
+	for i, item := range batch.Items {
+		if h.valid(item) {
+			valid = append(valid, item)
+		} else if !h.filter {
+			writeError(w, r, "unauthorized batch item: "+
+				strconv.Itoa(i), http.StatusUnauthorized)
+			return
+		}
+	}
+	if len(valid) == 0 {
+		writeError(w, r, "no authorized batch items",
+			http.StatusUnauthorized)
+		return
+	}
+
+	if len(valid) != len(batch.Items) {
+		body, err := json.Marshal(batchEnvelope{valid})
+		if err != nil {
+			panic("failed to encode batch: " + err.Error())
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Del("Transfer-Encoding")
+		r.TransferEncoding = nil
+	}
+	h.handler.ServeHTTP(w, r)
+}
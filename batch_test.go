@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"flag"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// bodyServer responds with the body of each request.
+type bodyServer struct{}
+
+func (s bodyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	_, _ = w.Write(body)
+}
+
+var _ = Describe("HmacProxy batch mode", func() {
+	var (
+		opts  *HmacProxyOpts
+		flags *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet("HmacProxy batch mode",
+			flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+	})
+
+	// item returns a batch item containing payload, signed with secret.
+	item := func(secret, payload string) string {
+		mac := hmac.New(sha1.New, []byte(secret))
+		_, _ = mac.Write([]byte(payload))
+		return `{"signature":"sha1 ` +
+			base64.StdEncoding.EncodeToString(mac.Sum(nil)) +
+			`","payload":` + payload + `}`
+	}
+
+	valid := item("foobar", `{"id":1}`)
+	invalid := item("badsecret", `{"id":2}`)
+
+	// send posts a batch of items to a proxy using mode, returning the
+	// response status and the body received by the upstream server.
+	send := func(mode string, items ...string) (int, string) {
+		upstream := httptest.NewServer(bodyServer{})
+		defer upstream.Close()
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-auth",
+			"-upstream=" + upstream.URL,
+			"-batch-mode=" + mode,
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		response, err := http.Post(server.URL+"/", "application/json",
+			strings.NewReader(`{"items":[`+
+				strings.Join(items, ",")+`]}`))
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		return response.StatusCode, readBody(response)
+	}
+
+	It("should proxy batches of valid items unchanged", func() {
+		for _, mode := range []string{"reject", "filter"} {
+			status, body := send(mode, valid, valid)
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(Equal(
+				`{"items":[` + valid + `,` + valid + `]}`))
+		}
+	})
+
+	It("should reject batches with an invalid item", func() {
+		status, body := send("reject", valid, invalid)
+		Expect(status).To(Equal(http.StatusUnauthorized))
+		Expect(body).To(Equal("unauthorized batch item: 1\n"))
+	})
+
+	It("should filter out invalid items", func() {
+		status, body := send("filter", valid, invalid)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(MatchJSON(`{"items":[` + valid + `]}`))
+	})
+
+	It("should reject batches with no valid items", func() {
+		status, _ := send("filter", invalid)
+		Expect(status).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject malformed batches", func() {
+		status, _ := send("filter", "not json")
+		Expect(status).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should reject options that don't apply to batch items", func() {
+		err := flags.Parse([]string{
+			"-secret=foobar",
+			"-auth",
+			"-upstream=http://localhost/",
+			"-batch-mode=reject",
+			"-previous-secret=oldsecret",
+			"-nonce-path=/nonce",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		err = opts.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("batch-mode cannot " +
+			"be combined with -previous-secret"))
+		Expect(err.Error()).To(ContainSubstring("batch-mode cannot " +
+			"be combined with -nonce-path"))
+	})
+})
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// capabilitiesPath is the path at which -expose-capabilities describes the
+// signatures the proxy produces or accepts.
+const capabilitiesPath = "/.hmacproxy/capabilities"
+
+// capabilities describes the signing configuration of the proxy, so that
+// client developers may configure their clients to match.
+type capabilities struct {
+	Digests           []string `json:"digests"`
+	SignHeader        string   `json:"sign_header"`
+	Headers           []string `json:"headers"`
+	SignatureFormat   string   `json:"signature_format"`
+	SigVersionHeader  string   `json:"sig_version_header"`
+	SigVersions       []string `json:"sig_versions"`
+	DefaultSigVersion string   `json:"default_sig_version"`
+}
+
+type capabilitiesHandler struct {
+	body    []byte
+	handler http.Handler
+}
+
+// newCapabilitiesHandler returns a http.Handler that answers requests for
+// capabilitiesPath without authentication, passing all other requests through
+// to handler.
+func newCapabilitiesHandler(opts *HmacProxyOpts,
+	handler http.Handler) http.Handler {
+	c := capabilities{
+		Digests:           supportedDigests(opts),
+		SignHeader:        opts.SignHeader,
+		Headers:           append([]string{}, opts.Headers...),
+		SignatureFormat:   "<digest> <base64>",
+		SigVersionHeader:  sigVersionHeader,
+		DefaultSigVersion: defaultSigVersion,
+	}
+	if opts.SignaturePrefixAlgo {
+		c.SignatureFormat = "<digest>=<hex>"
+	}
+	if opts.WebhookPreset != "" {
+		c.SignatureFormat = opts.WebhookPreset
+		c.SigVersionHeader = ""
+		c.DefaultSigVersion = ""
+	} else {
+		for version := range canonicalizationStrategies {
+			c.SigVersions = append(c.SigVersions, version)
+		}
+		sort.Strings(c.SigVersions)
+	}
+	body, err := json.Marshal(c)
+	if err != nil {
+		panic("failed to encode capabilities: " + err.Error())
+	}
+	return capabilitiesHandler{body, handler}
+}
+
+func (h capabilitiesHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	if r.URL.Path != capabilitiesPath {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(h.body)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("HmacProxy capabilities", func() {
+	var (
+		opts  *HmacProxyOpts
+		flags *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet(
+			"HmacProxy capabilities", flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+	})
+
+	It("should describe the signing configuration", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-digest=sha256",
+			"-headers=Content-Type,Gap-Auth",
+			"-auth",
+			"-expose-capabilities",
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		response, err := http.Get(server.URL + capabilitiesPath)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Header.Get("Content-Type")).To(
+			Equal("application/json"))
+
+		var c capabilities
+		Expect(json.NewDecoder(response.Body).Decode(&c)).To(Succeed())
+		Expect(c).To(Equal(capabilities{
+			Digests:           []string{"sha256"},
+			SignHeader:        "Test-Signature",
+			Headers:           []string{"Content-Type", "Gap-Auth"},
+			SignatureFormat:   "<digest> <base64>",
+			SigVersionHeader:  "X-Sig-Version",
+			SigVersions:       []string{"v1"},
+			DefaultSigVersion: "v1",
+		}))
+	})
+
+	It("should not expose capabilities by default", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		response, err := http.Get(server.URL + capabilitiesPath)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+})
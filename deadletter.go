@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+)
+
+// deadLetterBodyKey is the request context key under which
+// deadLetterHandler stores the request body, since the reverse proxy
+// consumes the body before the upstream request can fail.
+type deadLetterBodyKey struct{}
+
+type deadLetterHandler struct {
+	handler http.Handler
+}
+
+func (h deadLetterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(
+		r.Context(), deadLetterBodyKey{}, readRequestBody(r))
+	h.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// newDeadLetterErrorHandler returns a httputil.ReverseProxy ErrorHandler
+// that writes each request that could not be sent to the upstream server to
+// a new file in opts.DeadLetterDir, in HTTP wire format, then responds with
+// opts.DeadLetterStatus.
+func newDeadLetterErrorHandler(opts *HmacProxyOpts) func(
+	http.ResponseWriter, *http.Request, error) {
+	dir := opts.DeadLetterDir
+	status := opts.DeadLetterStatus
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("http: proxy error: %v", err)
+		if file, err := writeDeadLetter(dir, r); err != nil {
+			log.Printf("failed to write dead letter: %s", err)
+		} else {
+			log.Printf("wrote dead letter: %s", file)
+		}
+		writeError(w, r, "upstream request failed", status)
+	}
+}
+
+// writeDeadLetter writes r, with the body saved by deadLetterHandler, to a
+// new file in dir and returns the file's name.
+func writeDeadLetter(dir string, r *http.Request) (name string, err error) {
+	body, _ := r.Context().Value(deadLetterBodyKey{}).([]byte)
+	c := *r
+	c.Body = ioutil.NopCloser(bytes.NewReader(body))
+	c.ContentLength = int64(len(body))
+
+	var file *os.File
+	if file, err = ioutil.TempFile(dir, "request-*.http"); err != nil {
+		return
+	}
+	name = file.Name()
+	err = c.Write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
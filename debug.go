@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/18F/hmacauth"
+	"net"
+	"net/http"
+)
+
+// debugCanonicalPath is the path at which -enable-debug-canonical reports
+// how the proxy would sign a submitted request.
+const debugCanonicalPath = "/.hmacproxy/canonical"
+
+// debugCanonicalMaxBytes limits the size of requests submitted to
+// debugCanonicalPath, including their bodies.
+const debugCanonicalMaxBytes = 1 << 20
+
+// canonicalDump is the body served by debugCanonicalPath.
+type canonicalDump struct {
+	SigVersion   string `json:"sig_version"`
+	StringToSign string `json:"string_to_sign"`
+	Signature    string `json:"signature"`
+}
+
+type debugCanonicalHandler struct {
+	networks []*net.IPNet
+	auths    map[string]hmacauth.HmacAuth
+	handler  http.Handler
+}
+
+// newDebugCanonicalHandler returns a http.Handler that answers POST requests
+// for debugCanonicalPath from opts.DebugAllowedIPs, each containing an HTTP
+// request, with the string to sign and signature the proxy computes for that
+// request. It passes all other requests through to handler.
+func newDebugCanonicalHandler(opts *HmacProxyOpts,
+	handler http.Handler) http.Handler {
+	networks, err := parseNetworks(opts.DebugAllowedIPs)
+	if err != nil {
+		panic("invalid debug-allowed-ips: " + err.Error())
+	}
+	auths := make(map[string]hmacauth.HmacAuth)
+	for version, newVersionAuth := range canonicalizationStrategies {
+		auths[version] = newAuthFunc(opts, newVersionAuth)(opts)
+	}
+	return debugCanonicalHandler{networks, auths, handler}
+}
+
+func (h debugCanonicalHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	if r.URL.Path != debugCanonicalPath {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	if !allowedAddr(h.networks, r.RemoteAddr) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, r, "method not allowed: "+r.Method,
+			http.StatusMethodNotAllowed)
+		return
+	}
+	submitted, err := http.ReadRequest(bufio.NewReader(
+		http.MaxBytesReader(w, r.Body, debugCanonicalMaxBytes)))
+	if err != nil {
+		writeError(w, r, "invalid request: "+err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+	version := submitted.Header.Get(sigVersionHeader)
+	if version == "" {
+		version = defaultSigVersion
+	}
+	auth, ok := h.auths[version]
+	if !ok {
+		writeError(w, r, "unsupported "+sigVersionHeader+": "+version,
+			http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(canonicalDump{version,
+		auth.StringToSign(submitted), auth.Sign(submitted)})
+}
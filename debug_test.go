@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("HmacProxy canonical request debugging", func() {
+	var (
+		opts  *HmacProxyOpts
+		flags *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet(
+			"HmacProxy canonical request debugging",
+			flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+	})
+
+	// newServer returns a server authenticating requests proxied to
+	// upstream, with -enable-debug-canonical allowing allowedIPs.
+	newServer := func(upstream, allowedIPs string) *httptest.Server {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-digest=sha256",
+			"-auth",
+			"-upstream=" + upstream,
+			"-enable-debug-canonical",
+			"-debug-allowed-ips=" + allowedIPs,
+		})
+		return httptest.NewServer(handler)
+	}
+
+	It("should report the signature the proxy expects", func() {
+		upstream := httptest.NewServer(proxiedServer{})
+		defer upstream.Close()
+		server := newServer(upstream.URL, "127.0.0.1")
+		defer server.Close()
+
+		response, err := http.Post(server.URL+"/.hmacproxy/canonical",
+			"message/http", strings.NewReader(
+				"POST /widgets?id=1 HTTP/1.1\r\n"+
+					"Host: example.com\r\n"+
+					"Content-Type: text/plain\r\n"+
+					"Content-Length: 4\r\n\r\nbody"))
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		var dump struct {
+			SigVersion   string `json:"sig_version"`
+			StringToSign string `json:"string_to_sign"`
+			Signature    string `json:"signature"`
+		}
+		Expect(json.NewDecoder(response.Body).Decode(
+			&dump)).To(Succeed())
+		Expect(dump.SigVersion).To(Equal("v1"))
+		Expect(dump.StringToSign).To(Equal(
+			"POST\ntext/plain\n\n/widgets?id=1"))
+		Expect(dump.Signature).To(HavePrefix("sha256 "))
+
+		request, err := http.NewRequest("POST",
+			server.URL+"/widgets?id=1", strings.NewReader("body"))
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("Content-Type", "text/plain")
+		request.Header.Set("Test-Signature", dump.Signature)
+		response, err = http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(response)).To(Equal("Success!"))
+	})
+
+	It("should reject other addresses", func() {
+		server := newServer("http://localhost/", "10.0.0.0/8")
+		defer server.Close()
+
+		response, err := http.Post(server.URL+"/.hmacproxy/canonical",
+			"message/http", strings.NewReader(
+				"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusForbidden))
+	})
+})
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// delegateTimeout bounds how long a request waits for the
+// -delegate-auth-url service.
+const delegateTimeout = 10 * time.Second
+
+// delegator asks an external service whether to allow a request that has
+// already passed HMAC authentication.
+type delegator struct {
+	url     string
+	headers []string
+	client  *http.Client
+}
+
+// newDelegator returns a delegator for the -delegate-auth-url options
+// specified in opts, or nil if there is no -delegate-auth-url.
+func newDelegator(opts *HmacProxyOpts) *delegator {
+	if opts.DelegateAuthURL == "" {
+		return nil
+	}
+	d := &delegator{url: opts.DelegateAuthURL,
+		client: &http.Client{Timeout: delegateTimeout}}
+	for _, header := range opts.DelegateAuthHeaders {
+		d.headers = append(d.headers, http.CanonicalHeaderKey(header))
+	}
+	return d
+}
+
+// allow sends a GET request to the delegate containing the headers of r
+// named by -delegate-auth-headers, along with the method and URI of r in the
+// X-Original-Method and X-Original-URI headers. It returns true if the
+// delegate responds with a 2xx status. Otherwise it responds to r with the
+// delegate's status and returns false. A nil delegator allows every request.
+func (d *delegator) allow(w http.ResponseWriter, r *http.Request) bool {
+	if d == nil {
+		return true
+	}
+	req, err := http.NewRequest("GET", d.url, nil)
+	if err != nil {
+		panic("invalid delegate-auth-url: " + err.Error())
+	}
+	req = req.WithContext(r.Context())
+	for _, header := range d.headers {
+		if values, ok := r.Header[header]; ok {
+			req.Header[header] = values
+		}
+	}
+	req.Header.Set("X-Original-Method", r.Method)
+	req.Header.Set("X-Original-URI", r.URL.RequestURI())
+
+	response, err := d.client.Do(req)
+	if err != nil {
+		log.Printf("delegate-auth-url request failed: %s", err)
+		writeError(w, r, "delegated authentication failed",
+			http.StatusBadGateway)
+		return false
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode/100 == 2 {
+		return true
+	}
+	writeError(w, r, http.StatusText(response.StatusCode),
+		response.StatusCode)
+	return false
+}
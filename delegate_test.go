@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("HmacProxy delegated authentication", func() {
+	var (
+		delegate *httptest.Server
+		upstream *httptest.Server
+		server   *httptest.Server
+	)
+
+	BeforeEach(func() {
+		// The delegate approves requests carrying the right token
+		// for the path originally requested.
+		delegate = httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Original-URI") != "/foo" {
+					w.WriteHeader(http.StatusNotFound)
+				} else if r.Header.Get("Authorization") !=
+					"Bearer approved" {
+					w.WriteHeader(http.StatusForbidden)
+				}
+			}))
+		upstream = httptest.NewServer(proxiedServer{})
+
+		flags := flag.NewFlagSet(
+			"HmacProxy delegated authentication",
+			flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-no-default-headers",
+			"-auth",
+			"-upstream=" + upstream.URL,
+			"-delegate-auth-url=" + delegate.URL,
+			"-delegate-auth-headers=authorization",
+		})
+		server = httptest.NewServer(handler)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		upstream.Close()
+		delegate.Close()
+	})
+
+	send := func(secret, token string) int {
+		request, err := http.NewRequest("GET", server.URL+"/foo", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("Authorization", "Bearer "+token)
+		hmacauth.NewHmacAuth(crypto.SHA1, []byte(secret),
+			"Test-Signature", nil).SignRequest(request)
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		return response.StatusCode
+	}
+
+	It("should proxy requests approved by both", func() {
+		Expect(send("foobar", "approved")).To(Equal(http.StatusOK))
+	})
+
+	It("should return the delegate's status on denial", func() {
+		Expect(send("foobar", "denied")).To(Equal(http.StatusForbidden))
+	})
+
+	It("should not consult the delegate without a valid signature",
+		func() {
+			Expect(send("bazquux", "approved")).To(
+				Equal(http.StatusUnauthorized))
+		})
+})
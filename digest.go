@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/18F/hmacauth"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestAuto is the -digest value that negotiates the strongest digest
+// supported by both the signing and the authenticating proxy.
+const digestAuto = "auto"
+
+// autoDigests are the digests -digest=auto may choose, strongest first.
+var autoDigests = []string{"sha512", "sha384", "sha256", "sha224", "sha1"}
+
+// negotiationTimeout bounds how long a signing proxy waits for the upstream
+// server's capabilities when negotiating a digest.
+const negotiationTimeout = 10 * time.Second
+
+// negotiationRetryMin and negotiationRetryMax bound how long a signing proxy
+// waits to negotiate again after failing, doubling the wait after each
+// consecutive failure.
+const (
+	negotiationRetryMin = time.Second
+	negotiationRetryMax = time.Minute
+)
+
+// supportedDigests returns the digests accepted by a proxy configured by
+// opts, strongest first. With -digest=auto, these are the autoDigests no
+// weaker than -min-digest.
+func supportedDigests(opts *HmacProxyOpts) []string {
+	if len(opts.AllowedSigAlgs) != 0 {
+		return opts.AllowedSigAlgs
+	} else if opts.Digest.Name != digestAuto {
+		return []string{opts.Digest.Name}
+	}
+	var digests []string
+	for _, name := range autoDigests {
+		if id, err := hmacauth.DigestNameToCryptoHash(
+			name); err == nil && id.Available() {
+			digests = append(digests, name)
+		}
+		if name == opts.MinDigest {
+			break
+		}
+	}
+	return digests
+}
+
+// autoDigestAuth authenticates requests signed with any of the digests it
+// supports, and signs requests with the strongest digest that the upstream
+// server also supports, as advertised by its -expose-capabilities endpoint.
+type autoDigestAuth struct {
+	auths    map[string]hmacauth.HmacAuth
+	digests  []string
+	header   string
+	upstream string
+	client   *http.Client
+
+	negotiation *digestNegotiation
+}
+
+// digestNegotiation is the state of an autoDigestAuth's negotiation with the
+// upstream server.
+type digestNegotiation struct {
+	mu      sync.Mutex
+	chosen  string
+	err     error
+	retryAt time.Time
+	delay   time.Duration
+
+	// done is closed when the negotiation in progress, if any, ends.
+	done chan struct{}
+}
+
+// newAutoDigestAuth returns an autoDigestAuth using newAuth to create the
+// hmacauth.HmacAuth for each digest supported by opts.
+func newAutoDigestAuth(opts *HmacProxyOpts,
+	newAuth func(opts *HmacProxyOpts) hmacauth.HmacAuth) hmacauth.HmacAuth {
+	a := autoDigestAuth{
+		auths:   make(map[string]hmacauth.HmacAuth),
+		digests: supportedDigests(opts),
+		header:  opts.SignHeader,
+		client:  &http.Client{Timeout: negotiationTimeout},
+
+		negotiation: &digestNegotiation{},
+	}
+	if opts.Upstream.URL != nil {
+		a.upstream = strings.TrimSuffix(opts.Upstream.URL.String(), "/") +
+			capabilitiesPath
+	}
+	for _, name := range a.digests {
+		digestOpts := *opts
+		digestOpts.Digest.Name = name
+		digestOpts.Digest.ID, _ = hmacauth.DigestNameToCryptoHash(name)
+		a.auths[name] = newAuth(&digestOpts)
+	}
+	return a
+}
+
+// negotiate returns the strongest digest supported by both this proxy and
+// the upstream server. It fetches the upstream server's capabilities until
+// it succeeds, waiting longer after each failure, during which it returns
+// the last error. Requests arriving while a fetch is in progress wait for
+// its result.
+func (a autoDigestAuth) negotiate() (string, error) {
+	n := a.negotiation
+	n.mu.Lock()
+	for n.done != nil {
+		done := n.done
+		n.mu.Unlock()
+		<-done
+		n.mu.Lock()
+	}
+	if n.chosen != "" || time.Now().Before(n.retryAt) {
+		defer n.mu.Unlock()
+		return n.chosen, n.err
+	}
+	done := make(chan struct{})
+	n.done = done
+	n.mu.Unlock()
+
+	chosen, err := a.fetchDigest()
+	if err != nil {
+		log.Printf("digest negotiation failed: %s", err)
+	}
+
+	n.mu.Lock()
+	n.chosen, n.err, n.done = chosen, err, nil
+	if err != nil {
+		n.delay *= 2
+		if n.delay < negotiationRetryMin {
+			n.delay = negotiationRetryMin
+		} else if n.delay > negotiationRetryMax {
+			n.delay = negotiationRetryMax
+		}
+		n.retryAt = time.Now().Add(n.delay)
+	}
+	n.mu.Unlock()
+	close(done)
+	return chosen, err
+}
+
+// fetchDigest fetches the upstream server's capabilities and returns the
+// strongest digest it has in common with this proxy.
+func (a autoDigestAuth) fetchDigest() (digest string, err error) {
+	response, err := a.client.Get(a.upstream)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = errors.New("capabilities request returned " +
+			response.Status)
+		return
+	}
+	var upstream capabilities
+	if err = json.NewDecoder(response.Body).Decode(&upstream); err != nil {
+		return
+	}
+	accepted := make(map[string]bool)
+	for _, name := range upstream.Digests {
+		accepted[name] = true
+	}
+	for _, name := range a.digests {
+		if accepted[name] {
+			return name, nil
+		}
+	}
+	err = errors.New("no digest in common with upstream, which " +
+		"supports: " + strings.Join(upstream.Digests, ","))
+	return
+}
+
+// signer returns the hmacauth.HmacAuth for the negotiated digest, or nil if
+// negotiation failed.
+func (a autoDigestAuth) signer() hmacauth.HmacAuth {
+	if digest, err := a.negotiate(); err == nil {
+		return a.auths[digest]
+	}
+	return nil
+}
+
+// authenticator returns the hmacauth.HmacAuth for the digest named in the
+// signature of r, or the strongest digest if r's signature names none that
+// is supported, so that it may report why the signature is invalid.
+func (a autoDigestAuth) authenticator(r *http.Request) hmacauth.HmacAuth {
+	signature := r.Header.Get(a.header)
+	if i := strings.IndexAny(signature, " ="); i > 0 {
+		if auth, ok := a.auths[signature[:i]]; ok {
+			return auth
+		}
+	}
+	return a.auths[a.digests[0]]
+}
+
+// Sign returns the signature of r using the negotiated digest, or "" if
+// negotiation failed.
+func (a autoDigestAuth) Sign(r *http.Request) string {
+	if auth := a.signer(); auth != nil {
+		return auth.Sign(r)
+	}
+	return ""
+}
+
+// SignRequest signs r using the negotiated digest. If negotiation failed,
+// it leaves r unsigned and has signingHandler reject it.
+func (a autoDigestAuth) SignRequest(r *http.Request) {
+	if auth := a.signer(); auth != nil {
+		auth.SignRequest(r)
+	} else {
+		failSigning(r, "digest negotiation failed",
+			http.StatusBadGateway)
+	}
+}
+
+func (a autoDigestAuth) StringToSign(r *http.Request) string {
+	return a.auths[a.digests[0]].StringToSign(r)
+}
+
+func (a autoDigestAuth) SignatureFromHeader(r *http.Request) string {
+	return r.Header.Get(a.header)
+}
+
+func (a autoDigestAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	return a.authenticator(r).AuthenticateRequest(r)
+}
+
+// sigAlgHeader is the signed request header in which a request may name the
+// digest of its signature, from those allowed by -allowed-sig-algs.
+const sigAlgHeader = "X-Sig-Alg"
+
+// sigAlgAuth signs and authenticates each request using the digest named in
+// its sigAlgHeader, or -digest if it names none, so that clients may move
+// from one digest to another one request at a time. Signatures must use the
+// named digest, and the header must be signed, so that neither can be
+// changed to another allowed digest in transit.
+type sigAlgAuth struct {
+	auths  map[string]hmacauth.HmacAuth
+	digest string
+	header string
+}
+
+// newSigAlgAuth returns a sigAlgAuth using newAuth to create the
+// hmacauth.HmacAuth for each digest allowed by opts.
+func newSigAlgAuth(opts *HmacProxyOpts,
+	newAuth func(opts *HmacProxyOpts) hmacauth.HmacAuth) hmacauth.HmacAuth {
+	a := sigAlgAuth{
+		auths:  make(map[string]hmacauth.HmacAuth),
+		digest: opts.Digest.Name,
+		header: opts.SignHeader,
+	}
+	for _, name := range append(opts.AllowedSigAlgs, opts.Digest.Name) {
+		digestOpts := *opts
+		digestOpts.Digest.Name = name
+		digestOpts.Digest.ID, _ = hmacauth.DigestNameToCryptoHash(name)
+		a.auths[name] = newAuth(&digestOpts)
+	}
+	return a
+}
+
+// requestDigest returns the digest named by r's sigAlgHeader, or -digest if
+// it names none.
+func (a sigAlgAuth) requestDigest(r *http.Request) string {
+	if digest := r.Header.Get(sigAlgHeader); digest != "" {
+		return digest
+	}
+	return a.digest
+}
+
+// signer returns the hmacauth.HmacAuth for the digest named by r, after
+// naming -digest in r's sigAlgHeader if r names none that is allowed.
+func (a sigAlgAuth) signer(r *http.Request) hmacauth.HmacAuth {
+	if auth, ok := a.auths[r.Header.Get(sigAlgHeader)]; ok {
+		return auth
+	}
+	r.Header.Set(sigAlgHeader, a.digest)
+	return a.auths[a.digest]
+}
+
+func (a sigAlgAuth) Sign(r *http.Request) string {
+	return a.signer(r).Sign(r)
+}
+
+func (a sigAlgAuth) SignRequest(r *http.Request) {
+	a.signer(r).SignRequest(r)
+}
+
+func (a sigAlgAuth) StringToSign(r *http.Request) string {
+	return a.auths[a.digest].StringToSign(r)
+}
+
+func (a sigAlgAuth) SignatureFromHeader(r *http.Request) string {
+	return r.Header.Get(a.header)
+}
+
+func (a sigAlgAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	digest := a.requestDigest(r)
+	auth, ok := a.auths[digest]
+	headerSignature = a.SignatureFromHeader(r)
+	if headerSignature == "" {
+		result = hmacauth.ResultNoSignature
+		return
+	} else if !ok {
+		result = hmacauth.ResultUnsupportedAlgorithm
+		return
+	} else if !strings.HasPrefix(headerSignature, digest+" ") &&
+		!strings.HasPrefix(headerSignature, digest+"=") {
+		result = hmacauth.ResultMismatch
+		return
+	}
+	return auth.AuthenticateRequest(r)
+}
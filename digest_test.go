@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("HmacProxy digest negotiation", func() {
+	var (
+		localOpts, upstreamOpts   *HmacProxyOpts
+		localFlags, upstreamFlags *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		localFlags = flag.NewFlagSet(
+			"HmacProxy digest negotiation (local)",
+			flag.ContinueOnError)
+		localOpts = RegisterCommandLineOptions(localFlags)
+		upstreamFlags = flag.NewFlagSet(
+			"HmacProxy digest negotiation (upstream)",
+			flag.ContinueOnError)
+		upstreamOpts = RegisterCommandLineOptions(upstreamFlags)
+	})
+
+	// signature sends a request through a signing proxy using
+	// -digest=auto to upstream, returning the response status and body.
+	signature := func(upstream *httptest.Server) (int, string) {
+		handler, _ := newHandler(localFlags, localOpts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-digest=auto",
+			"-upstream=" + upstream.URL,
+		})
+		local := httptest.NewServer(handler)
+		defer local.Close()
+
+		response, err := http.Get(local.URL + "/")
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		return response.StatusCode, readBody(response)
+	}
+
+	It("should negotiate sha512 between two instances", func() {
+		proxied := httptest.NewServer(signatureServer{})
+		defer proxied.Close()
+		handler, _ := newHandler(upstreamFlags, upstreamOpts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-digest=auto",
+			"-expose-capabilities",
+			"-auth",
+			"-upstream=" + proxied.URL,
+		})
+		upstream := httptest.NewServer(handler)
+		defer upstream.Close()
+
+		status, body := signature(upstream)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(HavePrefix("sha512 "))
+	})
+
+	It("should choose the strongest digest in common", func() {
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == capabilitiesPath {
+					_, _ = w.Write([]byte(
+						`{"digests":["md5","sha256"]}`))
+				} else {
+					signatureServer{}.ServeHTTP(w, r)
+				}
+			}))
+		defer upstream.Close()
+
+		_, body := signature(upstream)
+		Expect(strings.SplitN(body, " ", 2)[0]).To(Equal("sha256"))
+	})
+
+	It("should fail rather than negotiate below -min-digest", func() {
+		fetches, proxied := 0, 0
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != capabilitiesPath {
+					proxied++
+					return
+				}
+				fetches++
+				_, _ = w.Write([]byte(
+					`{"digests":["sha224","sha1"]}`))
+			}))
+		defer upstream.Close()
+
+		handler, _ := newHandler(localFlags, localOpts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-digest=auto",
+			"-upstream=" + upstream.URL,
+		})
+		local := httptest.NewServer(handler)
+		defer local.Close()
+
+		for i := 0; i != 2; i++ {
+			response, err := http.Get(local.URL + "/")
+			Expect(err).NotTo(HaveOccurred())
+			response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusBadGateway))
+		}
+		Expect(proxied).To(Equal(0))
+		// The second request arrives before it's time to
+		// negotiate again.
+		Expect(fetches).To(Equal(1))
+	})
+})
+
+var _ = Describe("HmacProxy signed digest selection", func() {
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		flags := flag.NewFlagSet(
+			"HmacProxy signed digest selection", flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-no-default-headers",
+			"-auth",
+			"-allowed-sig-algs=sha256,sha512",
+		})
+		server = httptest.NewServer(handler)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// send sends a request naming digest in its X-Sig-Alg header, signed
+	// using hash.
+	send := func(digest string, hash crypto.Hash) int {
+		request, err := http.NewRequest("GET", server.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("X-Sig-Alg", digest)
+		hmacauth.NewHmacAuth(hash, []byte("foobar"), "Test-Signature",
+			[]string{"X-Sig-Alg"}).SignRequest(request)
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		return response.StatusCode
+	}
+
+	It("should authenticate each allowed digest", func() {
+		Expect(send("sha256", crypto.SHA256)).To(
+			Equal(http.StatusAccepted))
+		Expect(send("sha512", crypto.SHA512)).To(
+			Equal(http.StatusAccepted))
+	})
+
+	It("should reject a digest that isn't allowed", func() {
+		Expect(send("sha224", crypto.SHA224)).To(
+			Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject a signature using another digest", func() {
+		Expect(send("sha512", crypto.SHA256)).To(
+			Equal(http.StatusUnauthorized))
+	})
+
+	It("should sign with the digest a request names", func() {
+		flags := flag.NewFlagSet("HmacProxy signed digest selection "+
+			"(local)", flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-no-default-headers",
+			"-upstream=" + server.URL,
+			"-digest=sha256",
+			"-allowed-sig-algs=sha256,sha512",
+		})
+		local := httptest.NewServer(handler)
+		defer local.Close()
+
+		for _, digest := range []string{"sha512", "sha256", ""} {
+			request, err := http.NewRequest(
+				"GET", local.URL+"/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("X-Sig-Alg", digest)
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusAccepted))
+		}
+	})
+})
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// dirAuthConfig contains the authentication parameters for one directory
+// listed in the -dir-auth-config file. Digest and Headers default to -digest
+// and -headers if omitted.
+type dirAuthConfig struct {
+	Secret  string   `json:"secret"`
+	Digest  string   `json:"digest"`
+	Headers []string `json:"headers"`
+}
+
+// loadDirAuthConfig reads the -dir-auth-config file, a JSON object mapping
+// each directory path prefix to its dirAuthConfig.
+func loadDirAuthConfig(path string) (
+	dirs map[string]dirAuthConfig, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err == nil {
+		err = json.Unmarshal(data, &dirs)
+	}
+	return
+}
+
+// dirAuthHandler authenticates each request for a file using the
+// configuration for the longest directory prefix of its path listed in
+// opts.DirAuths, or the top-level configuration if none is listed.
+type dirAuthHandler struct {
+	prefixes []string
+	dirs     map[string]http.Handler
+	handler  http.Handler
+}
+
+// newDirAuthHandler returns a dirAuthHandler for the configuration in opts.
+func newDirAuthHandler(opts *HmacProxyOpts) (
+	handler http.Handler, description string) {
+	h := dirAuthHandler{dirs: make(map[string]http.Handler)}
+	// Nonces are issued at -nonce-path by the top-level handler, so every
+	// directory must accept them.
+	nonces := newNonceStore(opts)
+	for prefix, dirOpts := range opts.DirAuths {
+		h.dirs[prefix], _ = versionsHandlerWithNonces(dirOpts, nonces)
+		h.prefixes = append(h.prefixes, prefix)
+	}
+	sort.Strings(h.prefixes)
+	h.handler, description = versionsHandlerWithNonces(opts, nonces)
+	description += ", with separate secrets for: " +
+		strings.Join(h.prefixes, ", ")
+	handler = h
+	return
+}
+
+// ServeHTTP matches the cleaned path, since that is the file the file server
+// serves, so that a path such as "/public/../admin/" can't evade the
+// configuration for "/admin/".
+func (h dirAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean("/"+r.URL.Path) + "/"
+	handler := h.handler
+	for _, prefix := range h.prefixes {
+		if strings.HasPrefix(p, prefix) {
+			handler = h.dirs[prefix]
+		}
+	}
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("HmacProxy per-directory authentication", func() {
+	var (
+		dir, root, config string
+		server            *httptest.Server
+	)
+
+	// serve starts a server for root with config and the options in argv.
+	serve := func(argv ...string) *httptest.Server {
+		flags := flag.NewFlagSet(
+			"HmacProxy per-directory authentication",
+			flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, description := newHandler(flags, opts, append([]string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-no-default-headers",
+			"-auth",
+			"-file-root=" + root,
+			"-dir-auth-config=" + config,
+		}, argv...))
+		Expect(description).To(Equal("serving files from " + root +
+			" for authenticated requests, with separate secrets " +
+			"for: /admin/"))
+		return httptest.NewServer(handler)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "hmacproxy-test")
+		Expect(err).NotTo(HaveOccurred())
+		root = filepath.Join(dir, "root")
+		for _, sub := range []string{"admin", "public"} {
+			Expect(os.MkdirAll(filepath.Join(root, sub),
+				0755)).To(Succeed())
+			Expect(ioutil.WriteFile(
+				filepath.Join(root, sub, "file.txt"),
+				[]byte(sub+" file"), 0644)).To(Succeed())
+		}
+		config = filepath.Join(dir, "dirs.json")
+		Expect(ioutil.WriteFile(config, []byte(`{
+			"/admin/": {"secret": "admin-secret", "digest": "sha256"}
+		}`), 0644)).To(Succeed())
+		server = serve()
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	// get requests path signed with secret using hash, returning the
+	// response status.
+	get := func(path, secret string, hash crypto.Hash) int {
+		request, err := http.NewRequest("GET", server.URL+path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		hmacauth.NewHmacAuth(hash, []byte(secret), "Test-Signature",
+			nil).SignRequest(request)
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		return response.StatusCode
+	}
+
+	It("should require the directory's secret under it", func() {
+		Expect(get("/admin/file.txt", "admin-secret",
+			crypto.SHA256)).To(Equal(http.StatusOK))
+		Expect(get("/admin/file.txt", "foobar", crypto.SHA1)).To(
+			Equal(http.StatusUnauthorized))
+	})
+
+	It("should require the top-level secret elsewhere", func() {
+		Expect(get("/public/file.txt", "foobar", crypto.SHA1)).To(
+			Equal(http.StatusOK))
+		Expect(get("/public/file.txt", "admin-secret",
+			crypto.SHA256)).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should match the cleaned path", func() {
+		Expect(get("/public/../admin/file.txt", "foobar",
+			crypto.SHA1)).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should not accept the top-level previous secret under a "+
+		"directory", func() {
+		server.Close()
+		server = serve("-previous-secret=oldfoobar",
+			"-rotation-grace=1h")
+		Expect(get("/public/file.txt", "oldfoobar", crypto.SHA1)).To(
+			Equal(http.StatusOK))
+		Expect(get("/admin/file.txt", "oldfoobar", crypto.SHA1)).To(
+			Equal(http.StatusUnauthorized))
+		Expect(get("/admin/file.txt", "oldfoobar",
+			crypto.SHA256)).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject -webhook-preset", func() {
+		flags := flag.NewFlagSet(
+			"HmacProxy per-directory authentication",
+			flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		Expect(flags.Parse([]string{
+			"-port=8080",
+			"-secret=foobar",
+			"-auth",
+			"-file-root=" + root,
+			"-dir-auth-config=" + config,
+			"-webhook-preset=github",
+		})).To(Succeed())
+		Expect(opts.Validate()).To(MatchError(optionErrors([]string{
+			"dir-auth-config cannot be combined with " +
+				"-webhook-preset",
+		})))
+	})
+
+	It("should accept nonces from -nonce-path under a directory", func() {
+		server.Close()
+		server = serve("-nonce-path=/nonce", "-headers=X-Nonce")
+
+		response, err := http.Get(server.URL + "/nonce")
+		Expect(err).NotTo(HaveOccurred())
+		nonce := readBody(response)
+		response.Body.Close()
+
+		request, err := http.NewRequest(
+			"GET", server.URL+"/admin/file.txt", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("X-Nonce", nonce)
+		hmacauth.NewHmacAuth(crypto.SHA256, []byte("admin-secret"),
+			"Test-Signature",
+			[]string{"X-Nonce"}).SignRequest(request)
+		response, err = http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+	})
+})
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"time"
+)
+
+// eventReportInterval is how often an eventSocket logs the number of events
+// it has dropped.
+const eventReportInterval = time.Second
+
+// eventWriteTimeout bounds the time an eventSocket waits to connect to the
+// -event-socket, or to write an event to it, before dropping the event.
+const eventWriteTimeout = 100 * time.Millisecond
+
+// eventSocketNetworks maps each -event-socket-type value to the network
+// passed to net.Dial.
+var eventSocketNetworks = map[string]string{
+	"stream":   "unix",
+	"datagram": "unixgram",
+}
+
+// requestEvent is the JSON event written to the -event-socket for each
+// request.
+type requestEvent struct {
+	Time       string  `json:"time"`
+	Remote     string  `json:"remote"`
+	Method     string  `json:"method"`
+	Host       string  `json:"host"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Size       int     `json:"size"`
+	DurationMs float64 `json:"duration_ms"`
+	AuthMs     float64 `json:"auth_ms"`
+	UpstreamMs float64 `json:"upstream_ms"`
+	Result     string  `json:"result,omitempty"`
+}
+
+// formatEvent returns the requestEvent for entry as a line of JSON.
+func formatEvent(entry *logEntry) []byte {
+	r := entry.request
+	milliseconds := func(d time.Duration) float64 {
+		return d.Seconds() * 1000
+	}
+	event, err := json.Marshal(requestEvent{
+		Time:       entry.start.UTC().Format(time.RFC3339Nano),
+		Remote:     remoteHost(r),
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Status:     entry.status,
+		Size:       entry.size,
+		DurationMs: milliseconds(time.Since(entry.start)),
+		AuthMs:     milliseconds(entry.authTime),
+		UpstreamMs: milliseconds(entry.upstreamTime),
+		Result:     entry.result,
+	})
+	if err != nil {
+		panic("failed to encode event: " + err.Error())
+	}
+	return append(event, '\n')
+}
+
+// eventSocket is the asyncSink for -event-socket, which writes events to a
+// local collector listening on a Unix socket. Events that can't be delivered
+// within eventWriteTimeout are dropped, so that a slow or absent collector
+// never holds up the queue for long.
+type eventSocket struct {
+	network string
+	path    string
+	conn    net.Conn
+}
+
+// newEventSocket returns an asyncWriter queueing up to size events for the
+// socket at path, connecting to it using network when the first event is
+// written, and again after any failure.
+func newEventSocket(network, path string, size int) *asyncWriter {
+	return newAsyncWriter(&eventSocket{network: network, path: path},
+		size, eventReportInterval)
+}
+
+// openEventSocket returns the asyncWriter for the -event-socket specified
+// by opts.
+func openEventSocket(opts *HmacProxyOpts) *asyncWriter {
+	return newEventSocket(eventSocketNetworks[opts.EventSocketType],
+		opts.EventSocket, opts.EventBuffer)
+}
+
+// write sends event to the socket, returning false if that fails.
+func (s *eventSocket) write(event []byte) bool {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.path,
+			eventWriteTimeout)
+		if err != nil {
+			return false
+		}
+		s.conn = conn
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+	if _, err := s.conn.Write(event); err != nil {
+		// A partial write leaves a stream mid-event, and a failed one
+		// may mean the collector has gone away, so connect again.
+		_ = s.conn.Close()
+		s.conn = nil
+		return false
+	}
+	return true
+}
+
+func (s *eventSocket) flush(dropped int) {
+	if dropped != 0 {
+		log.Printf("dropped %d events: -event-socket is not keeping "+
+			"up", dropped)
+	}
+}
+
+func (s *eventSocket) close() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
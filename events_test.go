@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("HmacProxy event socket", func() {
+	var (
+		dir      string
+		path     string
+		listener net.Listener
+		logs     *gbytes.Buffer
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "hmacproxy-test")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "events.sock")
+		listener, err = net.Listen("unix", path)
+		Expect(err).NotTo(HaveOccurred())
+		logs = gbytes.NewBuffer()
+		log.SetOutput(logs)
+	})
+
+	AfterEach(func() {
+		log.SetOutput(os.Stderr)
+		listener.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should send an event for each request", func() {
+		flags := flag.NewFlagSet("HmacProxy event socket",
+			flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-event-socket=" + path,
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		for _, path := range []string{"/foo", "/bar"} {
+			response, err := http.Get(server.URL + path)
+			Expect(err).NotTo(HaveOccurred())
+			response.Body.Close()
+		}
+
+		conn, err := listener.Accept()
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		events := bufio.NewScanner(conn)
+		for _, path := range []string{"/foo", "/bar"} {
+			Expect(events.Scan()).To(BeTrue())
+			var event requestEvent
+			Expect(json.Unmarshal(
+				events.Bytes(), &event)).To(Succeed())
+			Expect(event.Method).To(Equal("GET"))
+			Expect(event.Path).To(Equal(path))
+			Expect(event.Status).To(Equal(http.StatusUnauthorized))
+			Expect(event.Result).To(Equal("no-signature"))
+		}
+	})
+
+	It("should drop events rather than wait for a slow consumer", func() {
+		// The listener accepts connections, but never reads from them.
+		socket := newEventSocket("unix", path, 10)
+		defer socket.Close()
+
+		event := append(bytes.Repeat([]byte("x"), 64*1024), '\n')
+		start := time.Now()
+		for i := 0; i != 1000; i++ {
+			_, err := socket.Write(event)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Eventually(logs, 2*eventReportInterval).Should(gbytes.Say(
+			`dropped \d+ events: -event-socket is not keeping up`))
+	})
+})
@@ -1,85 +1,774 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"github.com/18F/hmacauth"
+	"io"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
+	"time"
 )
 
 // NewHTTPProxyHandler returns a http.Handler and its description based on the
 // configuration specified in opts.
 func NewHTTPProxyHandler(opts *HmacProxyOpts) (
 	handler http.Handler, description string) {
-	auth := hmacauth.NewHmacAuth(opts.Digest.ID,
-		[]byte(opts.Secret), opts.SignHeader, opts.Headers)
+	if opts.WebhookPreset != "" {
+		auth := withPreviousSecret(
+			opts, newWebhookAuth(opts), newWebhookAuth)
+		auth = wrapAudit(opts, newAuditor(opts), auth)
+		auth = wrapSignExempt(opts, wrapSignMethods(opts, auth))
+		handler, description = modeHandler(opts, auth)
+		handler = wrapHandler(opts, handler)
+		return
+	}
+
+	if opts.BatchMode != "" {
+		handler, description = newBatchHandler(opts)
+	} else if len(opts.Hosts) != 0 {
+		handler, description = newHostsHandler(opts)
+	} else if len(opts.DirAuths) != 0 {
+		handler, description = newDirAuthHandler(opts)
+	} else {
+		handler, description = versionsHandler(opts)
+	}
+	handler = wrapHandler(opts, handler)
+	return
+}
+
+// versionsHandler returns the http.Handler and its description for opts.Mode,
+// using the version of the signing scheme selected by each request.
+func versionsHandler(opts *HmacProxyOpts) (
+	handler http.Handler, description string) {
+	return versionsHandlerWithNonces(opts, newNonceStore(opts))
+}
+
+// versionsHandlerWithNonces returns the versionsHandler for opts, issuing and
+// consuming nonces using nonces, which may be shared with other handlers.
+func versionsHandlerWithNonces(opts *HmacProxyOpts, nonces *nonceStore) (
+	handler http.Handler, description string) {
+	audit := newAuditor(opts)
+	versions := make(map[string]http.Handler)
+	for version, newVersionAuth := range canonicalizationStrategies {
+		newAuth := newAuthFunc(opts, newVersionAuth)
+		auth := withPreviousSecret(opts, newAuth(opts), newAuth)
+		auth = wrapSignatureSource(opts, auth)
+		if nonces != nil {
+			auth = nonceAuth{auth, opts.NonceHeader, nonces}
+		}
+		auth = wrapAudit(opts, audit, auth)
+		auth = wrapSignMethods(opts, auth)
+		auth = wrapSignExempt(opts, auth)
+		versions[version], description = modeHandler(opts, auth)
+	}
+	for _, version := range opts.DeprecateSigVersions {
+		versions[version] = deprecationHandler{
+			opts.SigVersionSunset.Time, versions[version]}
+	}
+	handler = sigVersionHandler{versions}
+	if nonces != nil {
+		handler = nonceHandler{opts.NoncePath, nonces, handler}
+	}
+	return
+}
+
+// newAuthFunc returns a function that creates the hmacauth.HmacAuth that signs
+// or authenticates requests using the version of the signing scheme created by
+// newVersionAuth, with the options specified in opts applied.
+func newAuthFunc(opts *HmacProxyOpts,
+	newVersionAuth func(*HmacProxyOpts) hmacauth.HmacAuth) func(
+	*HmacProxyOpts) hmacauth.HmacAuth {
+	newAuth := func(opts *HmacProxyOpts) hmacauth.HmacAuth {
+		return wrapAuth(opts,
+			newDynamicHeadersAuth(opts, newVersionAuth))
+	}
+	if opts.Digest.Name == digestAuto {
+		newDigestAuth := newAuth
+		newAuth = func(opts *HmacProxyOpts) hmacauth.HmacAuth {
+			return newAutoDigestAuth(opts, newDigestAuth)
+		}
+	}
+	if len(opts.AllowedSigAlgs) != 0 {
+		newDigestAuth := newAuth
+		newAuth = func(opts *HmacProxyOpts) hmacauth.HmacAuth {
+			return newSigAlgAuth(opts, newDigestAuth)
+		}
+	}
+	if opts.KeyRotationInterval != 0 {
+		newSecretAuth := newAuth
+		newAuth = func(opts *HmacProxyOpts) hmacauth.HmacAuth {
+			return newIntervalKeyAuth(opts, newSecretAuth)
+		}
+	}
+	if opts.SecretLookup != nil {
+		newKeyAuth := newAuth
+		newAuth = func(opts *HmacProxyOpts) hmacauth.HmacAuth {
+			return newSecretLookupAuth(opts, newKeyAuth)
+		}
+	}
+	return newAuth
+}
 
+// modeHandler returns the http.Handler and its description for opts.Mode,
+// using auth to sign or authenticate requests.
+func modeHandler(opts *HmacProxyOpts, auth hmacauth.HmacAuth) (
+	handler http.Handler, description string) {
 	switch opts.Mode {
 	case HandlerSignAndProxy:
-		return signAndProxyHandler(auth, &opts.Upstream)
+		handler, description = signAndProxyHandler(
+			auth, &opts.Upstream, newUpstreamProxy(opts, auth))
+		handler = newTransformHandler(opts, handler)
+		if opts.SetDateHeader {
+			handler = dateHeaderHandler{handler}
+		}
+		handler = contentLengthHandler{handler}
 	case HandlerAuthAndProxy:
-		return authAndProxyHandler(auth, &opts.Upstream)
+		handler, description = authAndProxyHandler(
+			auth, &opts.Upstream,
+			newTransformHandler(opts, newUpstreamProxy(opts, nil)),
+			opts.AuthFailure == AuthFailurePassthrough,
+			newDelegator(opts))
+		handler = contentLengthHandler{handler}
 	case HandlerAuthForFiles:
-		return authForFilesHandler(auth, opts.FileRoot)
+		handler, description = authForFilesHandler(
+			auth, opts.FileRoot, opts.PublicPaths, opts.AllowArchive,
+			newDelegator(opts))
 	case HandlerAuthOnly:
-		return authenticationOnlyHandler(auth)
+		handler, description = authenticationOnlyHandler(
+			auth, opts.AuthTimeout, opts.AuthTimeoutStatus,
+			newDelegator(opts))
+	default:
+		log.Fatalf("unknown mode: %d\n", opts.Mode)
+	}
+	if len(opts.RequiredHeaders) != 0 {
+		handler = newRequiredHeadersHandler(opts, handler)
+	}
+	if opts.WWWAuthenticate != "" || opts.AuthFailureDelay != 0 {
+		handler = unauthorizedHandler{
+			opts.WWWAuthenticate, opts.AuthFailureDelay, handler}
 	}
-	log.Fatalf("unknown mode: %d\n", opts.Mode)
 	return
 }
 
+// wrapHandler applies the mode-independent handlers specified in opts to the
+// handler for the selected mode.
+func wrapHandler(opts *HmacProxyOpts, handler http.Handler) http.Handler {
+	if len(opts.AllowedHosts) != 0 {
+		handler = newAllowedHostsHandler(opts, handler)
+	}
+	if opts.DenyHeaderInjection {
+		handler = newDuplicateHeadersHandler(opts, handler)
+	}
+	if opts.ExposeCapabilities {
+		handler = newCapabilitiesHandler(opts, handler)
+	}
+	if opts.AdminConfigPath != "" {
+		handler = newAdminConfigHandler(opts, handler)
+	}
+	if opts.EnableDebugCanonical {
+		handler = newDebugCanonicalHandler(opts, handler)
+	}
+	if opts.HealthPath != "" {
+		handler = newHealthHandler(opts, handler)
+	}
+	handler = methodHandler{opts.AllowTrace, opts.AllowConnect, handler}
+	if opts.MaxHeaderValueBytes != 0 {
+		handler = newHeaderValueSizeHandler(opts, handler)
+	}
+	handler = headerCountHandler{opts.MaxHeaders, handler}
+	if opts.ErrorFormat == ErrorFormatProblem {
+		handler = problemHandler{handler}
+	}
+	if opts.LogFormat != "" || opts.EventSocket != "" {
+		handler = newLoggingHandler(opts, handler)
+	}
+	return handler
+}
+
+type duplicateHeadersHandler struct {
+	headers []string
+	handler http.Handler
+}
+
+// newDuplicateHeadersHandler returns a http.Handler that rejects requests
+// containing more than one instance of the signature header or any of the
+// signed headers, since other parsers may not pick the value that was signed.
+func newDuplicateHeadersHandler(opts *HmacProxyOpts,
+	handler http.Handler) http.Handler {
+	headers := []string{http.CanonicalHeaderKey(opts.SignHeader)}
+	for _, header := range opts.Headers {
+		headers = append(headers, http.CanonicalHeaderKey(header))
+	}
+	return duplicateHeadersHandler{headers, handler}
+}
+
+func (h duplicateHeadersHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	for _, header := range h.headers {
+		if len(r.Header[header]) > 1 {
+			writeError(w, r, "duplicate header: "+header,
+				http.StatusBadRequest)
+			return
+		}
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+type headerCountHandler struct {
+	max     int
+	handler http.Handler
+}
+
+// ServeHTTP rejects requests containing more than h.max distinct headers,
+// before any time is spent authenticating them.
+func (h headerCountHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	if len(r.Header) > h.max {
+		writeError(w, r, "too many headers",
+			http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// methodHandler rejects TRACE requests unless -allow-trace is specified, since
+// echoing a request back can expose its credentials to cross-site tracing.
+// It rejects CONNECT requests unless -allow-connect is specified, since the
+// proxy never opens tunnels for clients itself; in auth-only mode, it may
+// authenticate them for a forward proxy that does.
+type methodHandler struct {
+	allowTrace   bool
+	allowConnect bool
+	handler      http.Handler
+}
+
+func (h methodHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method == http.MethodConnect && !h.allowConnect) ||
+		(r.Method == http.MethodTrace && !h.allowTrace) {
+		writeError(w, r, "method not allowed: "+r.Method,
+			http.StatusMethodNotAllowed)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// headerValueSizeHandler rejects requests in which the combined values of any
+// signed header exceed h.max bytes, before any time is spent signing or
+// authenticating them.
+type headerValueSizeHandler struct {
+	max     int
+	headers []string
+	handler http.Handler
+}
+
+// newHeaderValueSizeHandler returns a headerValueSizeHandler limiting the
+// signed headers specified by opts to opts.MaxHeaderValueBytes.
+func newHeaderValueSizeHandler(opts *HmacProxyOpts,
+	handler http.Handler) http.Handler {
+	var headers []string
+	for _, list := range [][]string{opts.Headers,
+		opts.AllowedSignedHeaders} {
+		for _, header := range list {
+			headers = append(headers,
+				http.CanonicalHeaderKey(header))
+		}
+	}
+	return headerValueSizeHandler{opts.MaxHeaderValueBytes, headers,
+		handler}
+}
+
+func (h headerValueSizeHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	for _, header := range h.headers {
+		size := 0
+		for _, value := range r.Header[header] {
+			size += len(value)
+		}
+		if size > h.max {
+			writeError(w, r, "header value too large: "+header,
+				http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// requiredHeadersHandler rejects requests missing any of the -required-headers
+// with 428 Precondition Required, naming the header, so that clients can tell
+// a missing header apart from a signature mismatch. Requests using methods
+// that -sign-methods leaves unsigned need not include the headers.
+type requiredHeadersHandler struct {
+	headers []string
+	methods map[string]bool
+	handler http.Handler
+}
+
+func newRequiredHeadersHandler(opts *HmacProxyOpts,
+	handler http.Handler) http.Handler {
+	var headers []string
+	for _, header := range opts.RequiredHeaders {
+		headers = append(headers, http.CanonicalHeaderKey(header))
+	}
+	var methods map[string]bool
+	if len(opts.SignMethods) != 0 {
+		methods = make(map[string]bool)
+		for _, method := range opts.SignMethods {
+			methods[method] = true
+		}
+	}
+	return requiredHeadersHandler{headers, methods, handler}
+}
+
+func (h requiredHeadersHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	if h.methods == nil || h.methods[r.Method] {
+		for _, header := range h.headers {
+			if len(r.Header[header]) == 0 {
+				writeError(w, r, "missing required header: "+
+					header, http.StatusPreconditionRequired)
+				return
+			}
+		}
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// allowedHostsHandler rejects requests for hosts other than those listed in
+// -allowed-hosts, before any time is spent authenticating them. A listed
+// host without a port matches requests for that host on any port.
+type allowedHostsHandler struct {
+	hosts   map[string]bool
+	handler http.Handler
+}
+
+func newAllowedHostsHandler(opts *HmacProxyOpts,
+	handler http.Handler) http.Handler {
+	hosts := make(map[string]bool)
+	for _, host := range opts.AllowedHosts {
+		hosts[strings.ToLower(host)] = true
+	}
+	return allowedHostsHandler{hosts, handler}
+}
+
+func (h allowedHostsHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	host := strings.ToLower(r.Host)
+	hostname, _, err := net.SplitHostPort(host)
+	if !h.hosts[host] && (err != nil || !h.hosts[hostname]) {
+		writeError(w, r, "host not allowed: "+r.Host,
+			http.StatusBadRequest)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
 type signingHandler struct {
 	auth    hmacauth.HmacAuth
 	handler http.Handler
 }
 
+// signFailureKey is the request context key under which signingHandler
+// stores the signFailure for a request, so that the hmacauth.HmacAuth
+// signing it may report that it could not.
+type signFailureKey struct{}
+
+// signFailure describes the error response to a request that could not be
+// signed.
+type signFailure struct {
+	message string
+	status  int
+}
+
+// failSigning has signingHandler respond to r with message and status rather
+// than proxying it unsigned.
+func failSigning(r *http.Request, message string, status int) {
+	if failure, ok := r.Context().Value(
+		signFailureKey{}).(*signFailure); ok {
+		*failure = signFailure{message, status}
+	}
+}
+
 func (h signingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	failure := &signFailure{}
+	r = r.WithContext(context.WithValue(r.Context(), signFailureKey{},
+		failure))
 	h.auth.SignRequest(r)
+	recordAuthTime(r, start)
+	if failure.status != 0 {
+		writeError(w, r, failure.message, failure.status)
+		return
+	}
 	h.handler.ServeHTTP(w, r)
 }
 
-func signAndProxyHandler(auth hmacauth.HmacAuth, upstream *HmacProxyURL) (
-	handler http.Handler, description string) {
+// dateHeaderHandler sets the Date header of requests that lack one, so that
+// the time a request was sent may be covered by its signature.
+type dateHeaderHandler struct {
+	handler http.Handler
+}
+
+func (h dateHeaderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Date") == "" {
+		r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// errBodyLength is the error reading the body of a request that is shorter
+// than its Content-Length.
+var errBodyLength = errors.New("request body does not match Content-Length")
+
+// contentLengthHandler checks the body of each request with a Content-Length
+// as it is read, rejecting requests whose body is shorter than its
+// Content-Length, so that a body cut short isn't signed, authenticated, or
+// proxied as though it were complete.
+type contentLengthHandler struct {
+	handler http.Handler
+}
+
+// contentLengthBodyKey is the request context key under which
+// contentLengthHandler stores the contentLengthBody of a request, so that
+// the upstream proxy may check it after signing or authentication has read
+// the body.
+type contentLengthBodyKey struct{}
+
+func (h contentLengthHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	if r.ContentLength > 0 {
+		body := &contentLengthBody{r.Body, r.ContentLength, nil}
+		r = r.WithContext(context.WithValue(r.Context(),
+			contentLengthBodyKey{}, body))
+		r.Body = body
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// contentLengthBody streams a request body, returning errBodyLength if it
+// ends before its Content-Length.
+type contentLengthBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *contentLengthBody) Read(p []byte) (n int, err error) {
+	if b.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	// hmacauth reads the body with a single call to Read, so fill p.
+	n, err = io.ReadFull(b.ReadCloser, p)
+	b.remaining -= int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		b.err, err = errBodyLength, errBodyLength
+	}
+	return
+}
+
+// contentLengthCheckHandler rejects requests whose body was found to be
+// shorter than its Content-Length while it was signed or authenticated,
+// since hmacauth ignores the error.
+type contentLengthCheckHandler struct {
+	handler http.Handler
+}
+
+func (h contentLengthCheckHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	if body, ok := r.Context().Value(
+		contentLengthBodyKey{}).(*contentLengthBody); ok &&
+		body.err != nil {
+		writeError(w, r, body.err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// newUpstreamProxy returns a http.Handler that proxies requests to the
+// upstream server specified in opts. signer, if not nil, signs the requests
+// made to follow upstream redirects.
+func newUpstreamProxy(opts *HmacProxyOpts,
+	signer hmacauth.HmacAuth) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(opts.Upstream.URL)
+	proxy.Transport = timingTransport{newUpstreamTransport(opts)}
+	if opts.FollowUpstreamRedirects != 0 {
+		proxy.Transport = redirectTransport{proxy.Transport,
+			opts.FollowUpstreamRedirects, signer}
+	}
+	if opts.ExpectContinue == ExpectContinueRespond {
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			// The proxy has already sent 100 Continue to the
+			// client while reading the body, so waiting for the
+			// upstream server to do the same would only delay it.
+			r.Header.Del("Expect")
+		}
+	}
+	if opts.RewriteRedirects {
+		proxy.ModifyResponse = newRedirectRewriter(opts)
+	}
+	if opts.EmitVia {
+		addVia(proxy, opts.ViaPseudonym)
+	}
+	var handler http.Handler = proxy
+	handleError := badGatewayErrorHandler
+	if opts.DeadLetterDir != "" {
+		handleError = newDeadLetterErrorHandler(opts)
+		handler = deadLetterHandler{proxy}
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request,
+		err error) {
+		if errors.Is(err, errBodyLength) {
+			writeError(w, r, errBodyLength.Error(),
+				http.StatusBadRequest)
+		} else if !clientDisconnected(r, opts.LogClientDisconnects,
+			err) {
+			handleError(w, r, err)
+		}
+	}
+	if opts.UpstreamProxyProtocol != "" {
+		handler = proxyProtocolHandler{handler}
+	}
+	return contentLengthCheckHandler{handler}
+}
+
+// badGatewayErrorHandler logs errors from the upstream server and responds
+// with 502 Bad Gateway, as httputil.ReverseProxy does by default.
+func badGatewayErrorHandler(w http.ResponseWriter, r *http.Request,
+	err error) {
+	log.Printf("http: proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// clientDisconnected reports whether err was caused by the client of r
+// disconnecting, in which case there is no one to respond to. Such errors
+// are only logged when logDisconnects is true.
+func clientDisconnected(r *http.Request, logDisconnects bool,
+	err error) bool {
+	if err == nil || r.Context().Err() != context.Canceled {
+		return false
+	}
+	if logDisconnects {
+		log.Printf("client disconnected: %s %s: %v", r.Method,
+			r.URL.Path, err)
+	}
+	return true
+}
+
+// newRedirectRewriter returns a httputil.ReverseProxy ModifyResponse function
+// that rewrites Location headers pointing to the upstream server to point to
+// the Host requested from the proxy instead, so that clients aren't sent
+// the upstream server's internal host name.
+func newRedirectRewriter(opts *HmacProxyOpts) func(*http.Response) error {
+	upstream := opts.Upstream.URL
+	scheme := "http"
+	if opts.SslCert != "" {
+		scheme = "https"
+	}
+	return func(response *http.Response) error {
+		location, err := response.Location()
+		if err != nil || location.Host != upstream.Host ||
+			location.Scheme != upstream.Scheme {
+			return nil
+		}
+		location.Scheme = scheme
+		location.Host = response.Request.Host
+		response.Header.Set("Location", location.String())
+		return nil
+	}
+}
+
+// newUpstreamTransport returns a http.Transport for connecting to the
+// upstream server, with the same settings as http.DefaultTransport apart from
+// those specified in opts.
+func newUpstreamTransport(opts *HmacProxyOpts) *http.Transport {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       opts.UpstreamIdleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if opts.UpstreamProxyProtocol != "" {
+		transport.DialContext = newProxyProtocolDialer(
+			opts.UpstreamProxyProtocol, transport.DialContext)
+		// Each connection carries the address of a single client.
+		transport.DisableKeepAlives = true
+	}
+	if opts.UpstreamClientCert != "" {
+		cert, err := newClientCertificate(
+			opts.UpstreamClientCert, opts.UpstreamClientKey)
+		if err != nil {
+			panic("failed to load upstream-client-cert: " +
+				err.Error())
+		}
+		transport.TLSClientConfig = &tls.Config{
+			GetClientCertificate: cert.GetClientCertificate,
+		}
+	}
+	return transport
+}
+
+func signAndProxyHandler(auth hmacauth.HmacAuth, upstream *HmacProxyURL,
+	proxy http.Handler) (handler http.Handler, description string) {
 	description = "proxying signed requests to: " + upstream.Raw
-	proxy := httputil.NewSingleHostReverseProxy(upstream.URL)
 	handler = signingHandler{auth, proxy}
 	return
 }
 
 type authHandler struct {
-	auth    hmacauth.HmacAuth
-	handler http.Handler
+	auth        hmacauth.HmacAuth
+	handler     http.Handler
+	passthrough bool
+	delegate    *delegator
 }
 
 func (h authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	result, _, _ := h.auth.AuthenticateRequest(r)
-	if result != hmacauth.ResultMatch {
-		http.Error(w, "unauthorized request", http.StatusUnauthorized)
-	} else {
+	recordAuthTime(r, start)
+	recordAuthResult(r, authResultNames[result])
+	if result != hmacauth.ResultMatch && !h.passthrough {
+		writeError(w, r, "unauthorized request",
+			http.StatusUnauthorized)
+	} else if result != hmacauth.ResultMatch || h.delegate.allow(w, r) {
 		h.handler.ServeHTTP(w, r)
 	}
 }
 
-func authAndProxyHandler(auth hmacauth.HmacAuth, upstream *HmacProxyURL) (
+// unauthorizedHandler adds a WWW-Authenticate header containing challenge,
+// if any, to 401 Unauthorized responses that lack one, so that clients learn
+// how to authenticate. It also delays those responses by between delay and
+// twice delay, chosen at random, so that the time taken to reject a request
+// reveals little about why it was rejected.
+type unauthorizedHandler struct {
+	challenge string
+	delay     time.Duration
+	handler   http.Handler
+}
+
+func (h unauthorizedHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	writer := &unauthorizedWriter{w, h.challenge, 0}
+	h.handler.ServeHTTP(writer, r)
+	// The server sends the buffered response once this returns, so
+	// sleeping here delays it without blocking the handler's writes.
+	if writer.status == http.StatusUnauthorized && h.delay > 0 {
+		time.Sleep(h.delay + time.Duration(rand.Int63n(int64(h.delay))))
+	}
+}
+
+// unauthorizedWriter adds the WWW-Authenticate challenge to 401 responses and
+// records the status, so that unauthorizedHandler can delay them.
+type unauthorizedWriter struct {
+	http.ResponseWriter
+	challenge string
+	status    int
+}
+
+func (w *unauthorizedWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+	if status == http.StatusUnauthorized && w.challenge != "" &&
+		w.Header().Get("WWW-Authenticate") == "" {
+		w.Header().Set("WWW-Authenticate", w.challenge)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *unauthorizedWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush allows the reverse proxy to flush streaming responses. It leaves 401
+// responses buffered until unauthorizedHandler's delay has passed.
+func (w *unauthorizedWriter) Flush() {
+	if w.status == http.StatusUnauthorized {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack allows the reverse proxy to take over the connection when the
+// upstream server switches protocols, such as to WebSocket.
+func (w *unauthorizedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+func authAndProxyHandler(auth hmacauth.HmacAuth, upstream *HmacProxyURL,
+	proxy http.Handler, passthrough bool, delegate *delegator) (
 	handler http.Handler, description string) {
 	description = "proxying authenticated requests to: " + upstream.Raw
-	proxy := httputil.NewSingleHostReverseProxy(upstream.URL)
-	handler = authHandler{auth, proxy}
+	handler = authHandler{auth, proxy, passthrough, delegate}
 	return
 }
 
-func authForFilesHandler(auth hmacauth.HmacAuth, fileRoot string) (
+type publicPathsHandler struct {
+	paths   map[string]bool
+	public  http.Handler
+	handler http.Handler
+}
+
+func (h publicPathsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.paths[r.URL.Path] {
+		h.public.ServeHTTP(w, r)
+	} else {
+		h.handler.ServeHTTP(w, r)
+	}
+}
+
+func authForFilesHandler(auth hmacauth.HmacAuth, fileRoot string,
+	publicPaths []string, allowArchive bool, delegate *delegator) (
 	handler http.Handler, description string) {
 	description = "serving files from " + fileRoot +
 		" for authenticated requests"
 	fileServer := http.FileServer(http.Dir(fileRoot))
-	handler = authHandler{auth, fileServer}
+	handler = fileServer
+	if allowArchive {
+		handler = archiveHandler{fileRoot, handler}
+	}
+	handler = authHandler{auth, handler, false, delegate}
+
+	if len(publicPaths) != 0 {
+		paths := make(map[string]bool)
+		for _, path := range publicPaths {
+			paths[path] = true
+		}
+		handler = publicPathsHandler{paths, fileServer, handler}
+	}
 	return
 }
 
 type authOnlyHandler struct {
-	auth hmacauth.HmacAuth
+	auth          hmacauth.HmacAuth
+	timeout       time.Duration
+	timeoutStatus int
+	delegate      *delegator
 }
 
 func (h authOnlyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -88,18 +777,54 @@ func (h authOnlyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			r.URL = origURL
 		}
 	}
-	result, _, _ := h.auth.AuthenticateRequest(r)
-
-	if result != hmacauth.ResultMatch {
-		http.Error(w, "unauthorized request", http.StatusUnauthorized)
+	start := time.Now()
+	result, finished := h.authenticate(r)
+	recordAuthTime(r, start)
+	if finished {
+		recordAuthResult(r, authResultNames[result])
 	} else {
+		recordAuthResult(r, "timeout")
+	}
+
+	if !finished {
+		writeError(w, r, "authentication timed out", h.timeoutStatus)
+	} else if result != hmacauth.ResultMatch {
+		writeError(w, r, "unauthorized request",
+			http.StatusUnauthorized)
+	} else if h.delegate.allow(w, r) {
 		w.WriteHeader(http.StatusAccepted)
 	}
 }
 
-func authenticationOnlyHandler(auth hmacauth.HmacAuth) (
+// authenticate returns the result of authenticating r, and false if that
+// took longer than the handler's timeout.
+func (h authOnlyHandler) authenticate(r *http.Request) (
+	result hmacauth.AuthenticationResult, finished bool) {
+	if h.timeout == 0 {
+		result, _, _ = h.auth.AuthenticateRequest(r)
+		return result, true
+	}
+
+	results := make(chan hmacauth.AuthenticationResult, 1)
+	go func() {
+		result, _, _ := h.auth.AuthenticateRequest(r)
+		results <- result
+	}()
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+
+	select {
+	case result = <-results:
+		finished = true
+	case <-timer.C:
+	}
+	return
+}
+
+func authenticationOnlyHandler(auth hmacauth.HmacAuth,
+	timeout time.Duration, timeoutStatus int, delegate *delegator) (
 	handler http.Handler, description string) {
 	description = "responding Accepted/Unauthorized for auth queries"
-	handler = authOnlyHandler{auth}
+	handler = authOnlyHandler{auth, timeout, timeoutStatus, delegate}
 	return
 }
@@ -1,15 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto"
 	"flag"
+	"github.com/18F/hmacauth"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 func newHandler(flags *flag.FlagSet, opts *HmacProxyOpts,
@@ -22,13 +34,19 @@ func newHandler(flags *flag.FlagSet, opts *HmacProxyOpts,
 	// zero, but the test servers will pick ports dynamically. To avoid
 	// having useless -port arguments in the test, we'll add a fake
 	// argument here.
-	opts.Port = 1
+	opts.Ports = HmacProxyPorts{1}
 	if err := opts.Validate(); err != nil {
 		panic("error parsing options: " + err.Error())
 	}
 	return NewHTTPProxyHandler(opts)
 }
 
+func readBody(response *http.Response) string {
+	body, err := ioutil.ReadAll(response.Body)
+	Expect(err).NotTo(HaveOccurred())
+	return string(body)
+}
+
 type authDelegatingServer struct {
 	authServerURL string
 }
@@ -53,6 +71,35 @@ func (ps proxiedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("Success!"))
 }
 
+// upgradeEchoServer switches each request's connection to a protocol that
+// echoes back one line.
+type upgradeEchoServer struct{}
+
+func (s upgradeEchoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	_ = rw.Flush()
+	line, _ := rw.ReadString('\n')
+	_, _ = rw.WriteString(line)
+	_ = rw.Flush()
+}
+
+type slowAuth struct {
+	hmacauth.HmacAuth
+	delay time.Duration
+}
+
+func (sa slowAuth) AuthenticateRequest(r *http.Request) (
+	hmacauth.AuthenticationResult, string, string) {
+	time.Sleep(sa.delay)
+	return sa.HmacAuth.AuthenticateRequest(r)
+}
+
 var _ = Describe("HmacProxy Handlers", func() {
 	var (
 		localOpts, upstreamOpts   *HmacProxyOpts
@@ -231,6 +278,128 @@ var _ = Describe("HmacProxy Handlers", func() {
 		})
 	})
 
+	Context("sending range requests to a file serving upstream", func() {
+		var (
+			auth     hmacauth.HmacAuth
+			upstream *httptest.Server
+			fileRoot string
+		)
+
+		BeforeEach(func() {
+			var err error
+			fileRoot, err = ioutil.TempDir("", "hmacproxy-test")
+			Expect(err).NotTo(HaveOccurred())
+			err = ioutil.WriteFile(filepath.Join(fileRoot, "file.txt"),
+				[]byte("0123456789"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			upstream, _ = upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-no-default-headers",
+				"-auth",
+				"-file-root=" + fileRoot,
+			})
+			auth = hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+				"Test-Signature", nil)
+		})
+
+		AfterEach(func() {
+			upstream.Close()
+			os.RemoveAll(fileRoot)
+		})
+
+		rangeRequest := func(byteRange string) (int, string) {
+			request, err := http.NewRequest(
+				"GET", upstream.URL+"/file.txt", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Range", byteRange)
+			auth.SignRequest(request)
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			body, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			return response.StatusCode, string(body)
+		}
+
+		It("should return partial content", func() {
+			status, body := rangeRequest("bytes=2-5")
+			Expect(status).To(Equal(http.StatusPartialContent))
+			Expect(body).To(Equal("2345"))
+		})
+
+		It("should reject an unsatisfiable range", func() {
+			status, _ := rangeRequest("bytes=20-30")
+			Expect(status).To(Equal(
+				http.StatusRequestedRangeNotSatisfiable))
+		})
+
+		It("should honor If-Range", func() {
+			request, err := http.NewRequest(
+				"GET", upstream.URL+"/file.txt", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Range", "bytes=2-5")
+			request.Header.Set("If-Range",
+				"Mon, 02 Jan 2006 15:04:05 GMT")
+			auth.SignRequest(request)
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			body, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(string(body)).To(Equal("0123456789"))
+		})
+
+		It("should not serve a range without authentication", func() {
+			request, err := http.NewRequest(
+				"GET", upstream.URL+"/file.txt", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Range", "bytes=2-5")
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("sending unsigned requests to a file serving upstream", func() {
+		It("should serve public paths without a signature", func() {
+			fileRoot, err := ioutil.TempDir("", "hmacproxy-test")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(fileRoot)
+			for _, name := range []string{"robots.txt", "secret.txt"} {
+				err = ioutil.WriteFile(filepath.Join(fileRoot, name),
+					[]byte(name), 0644)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			upstream, _ := upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-file-root=" + fileRoot,
+				"-public-paths=/favicon.ico,/robots.txt",
+			})
+
+			response, err := http.Get(upstream.URL + "/robots.txt")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			body, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(string(body)).To(Equal("robots.txt"))
+
+			response, err = http.Get(upstream.URL + "/secret.txt")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusUnauthorized))
+		})
+	})
+
 	Context("sending requests to a proxying upstream", func() {
 		It("should succeed when the configurations match", func() {
 			proxied := httptest.NewServer(proxiedServer{})
@@ -294,4 +463,1058 @@ var _ = Describe("HmacProxy Handlers", func() {
 			Expect(string(body)).To(Equal("unauthorized request\n"))
 		})
 	})
+
+	Context("authenticating slowly in auth-only mode", func() {
+		var auth hmacauth.HmacAuth
+
+		BeforeEach(func() {
+			auth = hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+				"Test-Signature", nil)
+		})
+
+		signedRequest := func() *http.Request {
+			request, err := http.NewRequest("GET", "/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			auth.SignRequest(request)
+			return request
+		}
+
+		It("should return the timeout status when exceeded", func() {
+			handler, _ := authenticationOnlyHandler(
+				slowAuth{auth, time.Second},
+				10*time.Millisecond, http.StatusGatewayTimeout,
+				nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, signedRequest())
+			Expect(recorder.Code).To(Equal(http.StatusGatewayTimeout))
+			Expect(recorder.Body.String()).To(Equal(
+				"authentication timed out\n"))
+		})
+
+		It("should authenticate within the timeout", func() {
+			handler, _ := authenticationOnlyHandler(
+				slowAuth{auth, time.Millisecond},
+				time.Second, http.StatusGatewayTimeout, nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, signedRequest())
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		})
+	})
+
+	Context("sending duplicate signed headers", func() {
+		var auth hmacauth.HmacAuth
+
+		BeforeEach(func() {
+			auth = hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+				"Test-Signature", []string{"Content-Type"})
+		})
+
+		duplicateHeaderRequest := func(url string) *http.Request {
+			request, err := http.NewRequest("GET", url, nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Add("Content-Type", "text/plain")
+			request.Header.Add("Content-Type", "application/json")
+			auth.SignRequest(request)
+			return request
+		}
+
+		It("should reject them when asked", func() {
+			upstream, _ := upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-headers=Content-Type",
+				"-auth",
+				"-deny-header-injection",
+			})
+
+			response, err := http.DefaultClient.Do(
+				duplicateHeaderRequest(upstream.URL + "/"))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			body, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(
+				Equal(http.StatusBadRequest))
+			Expect(string(body)).To(Equal(
+				"duplicate header: Content-Type\n"))
+		})
+
+		It("should accept them by default", func() {
+			upstream, _ := upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-headers=Content-Type",
+				"-auth",
+			})
+
+			response, err := http.DefaultClient.Do(
+				duplicateHeaderRequest(upstream.URL + "/"))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusAccepted))
+		})
+	})
+
+	Context("passing failed requests through to the upstream", func() {
+		It("should proxy a mismatched request", func() {
+			proxied := httptest.NewServer(proxiedServer{})
+			upstream, _ := upstreamServer([]string{
+				"-secret=bazquux",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-upstream=" + proxied.URL,
+				"-auth-failure=passthrough",
+			})
+			local, _ := localServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+			})
+
+			response, err := http.Get(local.URL)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(response)).To(Equal("Success!"))
+		})
+
+		It("should block a mismatched request by default", func() {
+			proxied := httptest.NewServer(proxiedServer{})
+			upstream, _ := upstreamServer([]string{
+				"-secret=bazquux",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-upstream=" + proxied.URL,
+			})
+			local, _ := localServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+			})
+
+			response, err := http.Get(local.URL)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("setting the Date header before signing", func() {
+		It("should add a signed Date header when asked", func() {
+			auth := hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+				"Test-Signature", []string{"Date"})
+			upstream := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					result, _, _ := auth.AuthenticateRequest(r)
+					w.Header().Set("Test-Date", r.Header.Get("Date"))
+					w.Header().Set("Test-Result", result.String())
+				}))
+			defer upstream.Close()
+			local, _ := localServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-headers=Date",
+				"-upstream=" + upstream.URL,
+				"-set-date-header",
+			})
+			defer local.Close()
+
+			response, err := http.Get(local.URL)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			_, err = http.ParseTime(response.Header.Get("Test-Date"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.Header.Get("Test-Result")).To(
+				Equal(hmacauth.ResultMatch.String()))
+		})
+	})
+
+	Context("closing idle upstream connections", func() {
+		var (
+			upstream    *httptest.Server
+			connections int32
+		)
+
+		BeforeEach(func() {
+			connections = 0
+			upstream = httptest.NewUnstartedServer(proxiedServer{})
+			upstream.Config.ConnState = func(conn net.Conn,
+				state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt32(&connections, 1)
+				}
+			}
+			upstream.Start()
+		})
+
+		AfterEach(func() {
+			upstream.Close()
+		})
+
+		// sendTwice sends two requests through a signing proxy with
+		// the specified idle timeout, pausing between them, and
+		// returns the number of upstream connections opened.
+		sendTwice := func(idleTimeout string) int32 {
+			local, _ := localServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+				"-upstream-idle-timeout=" + idleTimeout,
+			})
+			defer local.Close()
+			for i := 0; i != 2; i++ {
+				response, err := http.Get(local.URL)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(readBody(response)).To(Equal("Success!"))
+				response.Body.Close()
+				time.Sleep(200 * time.Millisecond)
+			}
+			return atomic.LoadInt32(&connections)
+		}
+
+		It("should reuse connections within the timeout", func() {
+			Expect(sendTwice("1m")).To(Equal(int32(1)))
+		})
+
+		It("should not reuse connections past the timeout", func() {
+			Expect(sendTwice("50ms")).To(Equal(int32(2)))
+		})
+	})
+
+	Context("sending requests with Expect: 100-continue", func() {
+		var upstream *httptest.Server
+
+		BeforeEach(func() {
+			upstream = httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Test-Expect",
+						r.Header.Get("Expect"))
+					body, _ := ioutil.ReadAll(r.Body)
+					_, _ = w.Write(body)
+				}))
+		})
+
+		AfterEach(func() {
+			upstream.Close()
+		})
+
+		// put sends a body through a signing proxy with the
+		// specified -expect-continue value, using a client that
+		// waits for 100 Continue before sending the body.
+		put := func(expectContinue string) (*http.Response,
+			time.Duration) {
+			local, _ := localServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+				"-expect-continue=" + expectContinue,
+			})
+			defer local.Close()
+			request, err := http.NewRequest("PUT", local.URL,
+				strings.NewReader("request body"))
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Expect", "100-continue")
+			client := &http.Client{Transport: &http.Transport{
+				ExpectContinueTimeout: 5 * time.Second,
+			}}
+			start := time.Now()
+			response, err := client.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			return response, time.Since(start)
+		}
+
+		It("should respond to the expectation itself", func() {
+			response, elapsed := put("respond")
+			defer response.Body.Close()
+			Expect(elapsed).To(BeNumerically("<", time.Second))
+			Expect(readBody(response)).To(Equal("request body"))
+			Expect(response.Header.Get("Test-Expect")).To(BeEmpty())
+		})
+
+		It("should forward the expectation when asked", func() {
+			response, elapsed := put("forward")
+			defer response.Body.Close()
+			Expect(elapsed).To(BeNumerically("<", time.Second))
+			Expect(readBody(response)).To(Equal("request body"))
+			Expect(response.Header.Get("Test-Expect")).To(
+				Equal("100-continue"))
+		})
+	})
+
+	Context("limiting the number of headers", func() {
+		sendHeaders := func(count int) int {
+			local, _ := localServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-max-headers=10",
+			})
+			defer local.Close()
+			request, err := http.NewRequest("GET", local.URL, nil)
+			Expect(err).NotTo(HaveOccurred())
+			// The client adds User-Agent and Accept-Encoding.
+			for i := 2; i != count; i++ {
+				request.Header.Set(
+					"X-Test-"+strconv.Itoa(i), "value")
+			}
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return response.StatusCode
+		}
+
+		It("should reject requests exceeding the limit", func() {
+			Expect(sendHeaders(11)).To(Equal(
+				http.StatusRequestHeaderFieldsTooLarge))
+		})
+
+		It("should authenticate requests within the limit", func() {
+			Expect(sendHeaders(10)).To(Equal(
+				http.StatusUnauthorized))
+		})
+	})
+
+	Context("proxying redirects from the upstream", func() {
+		var upstream *httptest.Server
+
+		BeforeEach(func() {
+			upstream = httptest.NewUnstartedServer(nil)
+			upstream.Config.Handler = http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					http.Redirect(w, r, upstream.URL+"/next?a=b",
+						http.StatusFound)
+				})
+			upstream.Start()
+		})
+
+		AfterEach(func() {
+			upstream.Close()
+		})
+
+		redirect := func(argv ...string) string {
+			local, _ := localServer(append([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+			}, argv...))
+			defer local.Close()
+			request, err := http.NewRequest("GET", local.URL+"/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Host = "proxy.example.com"
+			response, err := http.DefaultTransport.RoundTrip(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusFound))
+			return response.Header.Get("Location")
+		}
+
+		It("should rewrite the upstream host when asked", func() {
+			Expect(redirect("-rewrite-redirects")).To(Equal(
+				"http://proxy.example.com/next?a=b"))
+		})
+
+		It("should pass the upstream host through by default", func() {
+			Expect(redirect()).To(Equal(upstream.URL + "/next?a=b"))
+		})
+	})
+
+	Context("adding the proxy to the Via header", func() {
+		var upstream *httptest.Server
+
+		BeforeEach(func() {
+			upstream = httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Via",
+						"1.1 origin-cache")
+					_, _ = w.Write(
+						[]byte(r.Header.Get("Via")))
+				}))
+		})
+
+		AfterEach(func() {
+			upstream.Close()
+		})
+
+		via := func(via string, argv ...string) (string, string) {
+			local, _ := localServer(append([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+			}, argv...))
+			defer local.Close()
+			request, err := http.NewRequest(
+				"GET", local.URL+"/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			if via != "" {
+				request.Header.Set("Via", via)
+			}
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return readBody(response), response.Header.Get("Via")
+		}
+
+		It("should add the proxy toward the upstream", func() {
+			upstreamVia, clientVia := via("", "-emit-via")
+			Expect(upstreamVia).To(Equal("1.1 hmacproxy"))
+			Expect(clientVia).To(Equal(
+				"1.1 origin-cache, 1.1 hmacproxy"))
+		})
+
+		It("should append to an existing chain", func() {
+			upstreamVia, _ := via("1.0 edge", "-emit-via",
+				"-via-pseudonym=signer")
+			Expect(upstreamVia).To(Equal("1.0 edge, 1.1 signer"))
+		})
+
+		It("should leave the header alone by default", func() {
+			upstreamVia, clientVia := via("1.0 edge")
+			Expect(upstreamVia).To(Equal("1.0 edge"))
+			Expect(clientVia).To(Equal("1.1 origin-cache"))
+		})
+	})
+
+	Context("following redirects from the upstream", func() {
+		var redirector, upstream *httptest.Server
+
+		BeforeEach(func() {
+			redirector = httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					switch r.URL.Path {
+					case "/start":
+						http.Redirect(w, r, "/final",
+							http.StatusFound)
+					case "/loop":
+						http.Redirect(w, r, "/loop",
+							http.StatusFound)
+					case "/elsewhere":
+						http.Redirect(w, r,
+							"http://example.com/",
+							http.StatusFound)
+					default:
+						_, _ = w.Write([]byte(r.Method +
+							" " + r.URL.Path))
+					}
+				}))
+			upstream, _ = upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-upstream=" + redirector.URL,
+			})
+		})
+
+		AfterEach(func() {
+			upstream.Close()
+			redirector.Close()
+		})
+
+		get := func(path string) *http.Response {
+			local, _ := localServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+				"-follow-upstream-redirects=3",
+			})
+			defer local.Close()
+			request, err := http.NewRequest("POST", local.URL+path,
+				strings.NewReader("body"))
+			Expect(err).NotTo(HaveOccurred())
+			response, err := http.DefaultTransport.RoundTrip(request)
+			Expect(err).NotTo(HaveOccurred())
+			return response
+		}
+
+		It("should return the final response, signed again", func() {
+			response := get("/start")
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(response)).To(Equal("GET /final"))
+		})
+
+		It("should return a redirect loop to the client", func() {
+			response := get("/loop")
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusFound))
+			Expect(response.Header.Get("Location")).To(Equal("/loop"))
+		})
+
+		It("should return a redirect to another host", func() {
+			response := get("/elsewhere")
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusFound))
+			Expect(response.Header.Get("Location")).To(
+				Equal("http://example.com/"))
+		})
+	})
+
+	Context("handling TRACE and CONNECT", func() {
+		// status sends a signed request to a proxy configured by argv,
+		// returning the response status.
+		status := func(method string, argv ...string) int {
+			upstream, _ := upstreamServer(append([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-no-default-headers",
+				"-auth",
+			}, argv...))
+			defer upstream.Close()
+
+			request, err := http.NewRequest(method, upstream.URL+"/",
+				nil)
+			Expect(err).NotTo(HaveOccurred())
+			hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+				"Test-Signature", nil).SignRequest(request)
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return response.StatusCode
+		}
+
+		It("should reject TRACE by default", func() {
+			Expect(status("TRACE")).To(
+				Equal(http.StatusMethodNotAllowed))
+			Expect(status("GET")).To(Equal(http.StatusAccepted))
+		})
+
+		It("should handle TRACE with -allow-trace", func() {
+			Expect(status("TRACE", "-allow-trace")).To(
+				Equal(http.StatusAccepted))
+		})
+
+		It("should reject CONNECT by default", func() {
+			Expect(status("CONNECT")).To(
+				Equal(http.StatusMethodNotAllowed))
+			Expect(status("CONNECT", "-allow-trace")).To(
+				Equal(http.StatusMethodNotAllowed))
+		})
+
+		It("should authenticate CONNECT with -allow-connect", func() {
+			Expect(status("CONNECT", "-allow-connect")).To(
+				Equal(http.StatusAccepted))
+		})
+
+		It("should only allow CONNECT in auth-only mode", func() {
+			err := upstreamFlags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=http://localhost/",
+				"-allow-connect",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(upstreamOpts.Validate()).To(MatchError(
+				optionErrors([]string{"allow-connect " +
+					"requires -auth without -upstream " +
+					"or -file-root"})))
+		})
+	})
+
+	Context("limiting the size of signed header values", func() {
+		// send sends a request whose Gap-Auth header is size bytes
+		// long through a signing proxy.
+		send := func(size int) int {
+			upstream, _ := upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-headers=Gap-Auth",
+				"-auth",
+			})
+			defer upstream.Close()
+			local, _ := localServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-headers=Gap-Auth",
+				"-upstream=" + upstream.URL,
+				"-max-header-value-bytes=1024",
+			})
+			defer local.Close()
+
+			request, err := http.NewRequest("GET", local.URL+"/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Gap-Auth", strings.Repeat("x", size))
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return response.StatusCode
+		}
+
+		It("should reject oversized values", func() {
+			Expect(send(1025)).To(Equal(
+				http.StatusRequestHeaderFieldsTooLarge))
+		})
+
+		It("should sign values within the limit", func() {
+			Expect(send(1024)).To(Equal(http.StatusAccepted))
+		})
+	})
+
+	Context("requiring signed headers", func() {
+		// send sends a request with the Gap-Auth header set to value,
+		// unless it is empty, signed with secret to an authenticating
+		// proxy that requires the header.
+		send := func(value, secret string) (int, string) {
+			upstream, _ := upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-headers=Gap-Auth",
+				"-auth",
+				"-required-headers=gap-auth",
+			})
+			defer upstream.Close()
+
+			request, err := http.NewRequest(
+				"GET", upstream.URL+"/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			if value != "" {
+				request.Header.Set("Gap-Auth", value)
+			}
+			hmacauth.NewHmacAuth(crypto.SHA1, []byte(secret),
+				"Test-Signature", []string{"Gap-Auth"},
+			).SignRequest(request)
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return response.StatusCode, readBody(response)
+		}
+
+		It("should reject a missing header as a precondition", func() {
+			status, body := send("", "foobar")
+			Expect(status).To(
+				Equal(http.StatusPreconditionRequired))
+			Expect(body).To(ContainSubstring(
+				"missing required header: Gap-Auth"))
+		})
+
+		It("should reject a wrong signature as unauthorized", func() {
+			status, _ := send("mbland", "badsecret")
+			Expect(status).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should authenticate requests including the header", func() {
+			status, _ := send("mbland", "foobar")
+			Expect(status).To(Equal(http.StatusAccepted))
+		})
+	})
+
+	Context("authenticating headers folded across lines", func() {
+		It("should authenticate the unfolded value", func() {
+			upstream, _ := upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-headers=Gap-Auth",
+				"-auth",
+			})
+			defer upstream.Close()
+
+			// A legacy client signs the value with each obs-fold
+			// replaced by a single space, as RFC 7230 specifies.
+			signed, err := http.NewRequest("GET", "/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			signed.Header.Set("Gap-Auth", "legacy client folded")
+			signature := hmacauth.NewHmacAuth(crypto.SHA1,
+				[]byte("foobar"), "Test-Signature",
+				[]string{"Gap-Auth"}).Sign(signed)
+
+			conn, err := net.Dial("tcp",
+				upstream.Listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Write([]byte("GET / HTTP/1.1\r\n" +
+				"Host: localhost\r\n" +
+				"Gap-Auth: legacy\r\n   client\r\n" +
+				"\tfolded\r\n" +
+				"Test-Signature: " + signature + "\r\n\r\n"))
+			Expect(err).NotTo(HaveOccurred())
+			response, err := http.ReadResponse(
+				bufio.NewReader(conn), nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusAccepted))
+		})
+	})
+
+	Context("limiting the allowed hosts", func() {
+		It("should reject hosts that aren't listed", func() {
+			upstream, _ := upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-no-default-headers",
+				"-auth",
+				"-allowed-hosts=api.example.com," +
+					"Other.example.com:8080",
+			})
+			defer upstream.Close()
+			auth := hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+				"Test-Signature", nil)
+
+			status := func(host string) int {
+				request, err := http.NewRequest(
+					"GET", upstream.URL+"/", nil)
+				Expect(err).NotTo(HaveOccurred())
+				request.Host = host
+				auth.SignRequest(request)
+				response, err := http.DefaultClient.Do(request)
+				Expect(err).NotTo(HaveOccurred())
+				defer response.Body.Close()
+				return response.StatusCode
+			}
+
+			Expect(status("api.example.com")).To(
+				Equal(http.StatusAccepted))
+			Expect(status("API.example.com:443")).To(
+				Equal(http.StatusAccepted))
+			Expect(status("other.example.com:8080")).To(
+				Equal(http.StatusAccepted))
+			Expect(status("other.example.com")).To(
+				Equal(http.StatusBadRequest))
+			Expect(status("evil.example.com")).To(
+				Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("sending a WWW-Authenticate challenge", func() {
+		challenge := func(argv ...string) string {
+			upstream, _ := upstreamServer(append([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+			}, argv...))
+			defer upstream.Close()
+			response, err := http.Get(upstream.URL + "/")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusUnauthorized))
+			return response.Header.Get("WWW-Authenticate")
+		}
+
+		It("should send the configured challenge", func() {
+			Expect(challenge(`-www-authenticate=HMAC realm="api"`)).To(
+				Equal(`HMAC realm="api"`))
+		})
+
+		It("should send no challenge by default", func() {
+			Expect(challenge()).To(BeEmpty())
+		})
+	})
+
+	Context("when the client disconnects mid-body", func() {
+		var logs *gbytes.Buffer
+
+		BeforeEach(func() {
+			logs = gbytes.NewBuffer()
+			log.SetOutput(logs)
+		})
+
+		AfterEach(func() {
+			log.SetOutput(os.Stderr)
+		})
+
+		// disconnect sends the start of a request with a chunked body
+		// through a signing proxy configured by argv, then disconnects
+		// once the upstream server begins reading the body.
+		disconnect := func(argv ...string) {
+			started := make(chan struct{}, 1)
+			upstream := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					started <- struct{}{}
+					_, _ = ioutil.ReadAll(r.Body)
+				}))
+			defer upstream.Close()
+			local, _ := localServer(append([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+			}, argv...))
+			defer local.Close()
+
+			conn, err := net.Dial("tcp",
+				local.Listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			_, err = conn.Write([]byte("POST / HTTP/1.1\r\n" +
+				"Host: localhost\r\n" +
+				"Transfer-Encoding: chunked\r\n\r\n" +
+				"5\r\nhello\r\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(started).Should(Receive())
+			Expect(conn.Close()).To(Succeed())
+		}
+
+		It("should abandon the request quietly", func() {
+			disconnect()
+			Consistently(logs, 300*time.Millisecond).ShouldNot(
+				gbytes.Say("proxy error"))
+		})
+
+		It("should log the disconnect when asked", func() {
+			disconnect("-log-client-disconnects")
+			Eventually(logs).Should(gbytes.Say(
+				"client disconnected: POST /: "))
+			Expect(logs.Contents()).NotTo(
+				ContainSubstring("proxy error"))
+		})
+	})
+
+	Context("with -error-format=problem", func() {
+		It("should describe errors as problem details", func() {
+			upstream, _ := upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-error-format=problem",
+			})
+			defer upstream.Close()
+			response, err := http.Get(upstream.URL + "/")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusUnauthorized))
+			Expect(response.Header.Get("Content-Type")).To(
+				Equal("application/problem+json"))
+			Expect(readBody(response)).To(MatchJSON(`{
+				"type": "about:blank",
+				"title": "Unauthorized",
+				"status": 401,
+				"detail": "unauthorized request"
+			}`))
+		})
+	})
+
+	Context("sending a body shorter than its Content-Length", func() {
+		// sendShort sends a request with a short body to a local
+		// server configured with argv, returning its response.
+		sendShort := func(argv ...string) *http.Response {
+			upstream := httptest.NewServer(proxiedServer{})
+			defer upstream.Close()
+			local, _ := localServer(append([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+			}, argv...))
+			defer local.Close()
+
+			conn, err := net.Dial("tcp", local.Listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Write([]byte("POST / HTTP/1.1\r\n" +
+				"Host: localhost\r\nContent-Length: 10\r\n\r\n" +
+				"short"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.(*net.TCPConn).CloseWrite()).To(Succeed())
+			response, err := http.ReadResponse(
+				bufio.NewReader(conn), nil)
+			Expect(err).NotTo(HaveOccurred())
+			return response
+		}
+
+		It("should reject the request", func() {
+			response := sendShort()
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusBadRequest))
+			Expect(readBody(response)).To(Equal(
+				"request body does not match Content-Length\n"))
+		})
+
+		It("should reject the request while streaming it", func() {
+			response := sendShort("-sign-exempt-prefix=/")
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusBadRequest))
+			Expect(readBody(response)).To(Equal(
+				"request body does not match Content-Length\n"))
+		})
+	})
+
+	Context("sending a large body", func() {
+		It("should sign and proxy all of it", func() {
+			body := bytes.Repeat([]byte("0123456789abcdef"), 1<<18)
+			auth := hmacauth.NewHmacAuth(crypto.SHA1,
+				[]byte("foobar"), "Test-Signature", nil)
+			upstream := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					received, _ := ioutil.ReadAll(r.Body)
+					r.Body = ioutil.NopCloser(
+						bytes.NewReader(received))
+					result, _, _ :=
+						auth.AuthenticateRequest(r)
+					size := strconv.Itoa(len(received))
+					_, _ = w.Write([]byte(
+						result.String() + " " + size))
+				}))
+			defer upstream.Close()
+			local, _ := localServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-no-default-headers",
+				"-upstream=" + upstream.URL,
+			})
+			defer local.Close()
+
+			response, err := http.Post(local.URL+"/", "text/plain",
+				bytes.NewReader(body))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(response)).To(Equal(
+				hmacauth.ResultMatch.String() + " " +
+					strconv.Itoa(len(body))))
+		})
+	})
+
+	Context("delaying authentication failures", func() {
+		It("should only delay failures", func() {
+			upstream, _ := upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-no-default-headers",
+				"-auth",
+				"-auth-failure-delay=100ms",
+			})
+			defer upstream.Close()
+
+			elapsed := func(sign bool) (int, time.Duration) {
+				request, err := http.NewRequest(
+					"GET", upstream.URL+"/", nil)
+				Expect(err).NotTo(HaveOccurred())
+				if sign {
+					hmacauth.NewHmacAuth(crypto.SHA1,
+						[]byte("foobar"), "Test-Signature",
+						nil).SignRequest(request)
+				}
+				start := time.Now()
+				response, err := http.DefaultClient.Do(request)
+				Expect(err).NotTo(HaveOccurred())
+				response.Body.Close()
+				return response.StatusCode, time.Since(start)
+			}
+
+			status, duration := elapsed(false)
+			Expect(status).To(Equal(http.StatusUnauthorized))
+			Expect(duration).To(BeNumerically(">=",
+				100*time.Millisecond))
+			status, duration = elapsed(true)
+			Expect(status).To(Equal(http.StatusAccepted))
+			Expect(duration).To(BeNumerically("<",
+				100*time.Millisecond))
+		})
+
+		It("should pass through connections that switch protocols",
+			func() {
+				echo := httptest.NewServer(upgradeEchoServer{})
+				defer echo.Close()
+				upstream, _ := upstreamServer([]string{
+					"-secret=foobar",
+					"-sign-header=Test-Signature",
+					"-no-default-headers",
+					"-auth",
+					"-upstream=" + echo.URL,
+					"-auth-failure-delay=100ms",
+				})
+				defer upstream.Close()
+
+				conn, err := net.Dial("tcp",
+					upstream.Listener.Addr().String())
+				Expect(err).NotTo(HaveOccurred())
+				defer conn.Close()
+				request, err := http.NewRequest(
+					"GET", upstream.URL+"/", nil)
+				Expect(err).NotTo(HaveOccurred())
+				request.Header.Set("Connection", "Upgrade")
+				request.Header.Set("Upgrade", "echo")
+				hmacauth.NewHmacAuth(crypto.SHA1,
+					[]byte("foobar"), "Test-Signature",
+					nil).SignRequest(request)
+				Expect(request.Write(conn)).To(Succeed())
+
+				reader := bufio.NewReader(conn)
+				response, err := http.ReadResponse(reader, nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response.StatusCode).To(Equal(
+					http.StatusSwitchingProtocols))
+				_, err = conn.Write([]byte("ping\n"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.ReadString('\n')).To(
+					Equal("ping\n"))
+			})
+	})
+
+	Context("proxying response trailers", func() {
+		It("should forward trailers set by the upstream", func() {
+			proxied := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Trailer", "Grpc-Status")
+					_, _ = w.Write([]byte("body"))
+					w.Header().Set("Grpc-Status", "0")
+				}))
+			defer proxied.Close()
+			upstream, _ := upstreamServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-upstream=" + proxied.URL,
+			})
+			defer upstream.Close()
+			local, _ := localServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+			})
+			defer local.Close()
+
+			response, err := http.Get(local.URL + "/")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(readBody(response)).To(Equal("body"))
+			Expect(response.Trailer.Get("Grpc-Status")).To(Equal("0"))
+		})
+	})
+
+	Context("saving requests the upstream failed", func() {
+		It("should write a dead letter for each failure", func() {
+			dir, err := ioutil.TempDir("", "hmacproxy-test")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			// Nothing listens on the address of a closed server.
+			closed := httptest.NewServer(proxiedServer{})
+			closed.Close()
+			local, _ := localServer([]string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + closed.URL,
+				"-dead-letter-dir=" + dir,
+				"-dead-letter-status=503",
+			})
+			defer local.Close()
+
+			response, err := http.Post(local.URL+"/foo?bar=baz",
+				"text/plain", strings.NewReader("request body"))
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusServiceUnavailable))
+
+			files, err := filepath.Glob(filepath.Join(dir, "*.http"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+			f, err := os.Open(files[0])
+			Expect(err).NotTo(HaveOccurred())
+			defer f.Close()
+			saved, err := http.ReadRequest(bufio.NewReader(f))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(saved.Method).To(Equal("POST"))
+			Expect(saved.URL.RequestURI()).To(Equal("/foo?bar=baz"))
+			Expect(saved.Header.Get("Content-Type")).To(
+				Equal("text/plain"))
+			Expect(saved.Header.Get("Test-Signature")).NotTo(BeEmpty())
+			body, err := ioutil.ReadAll(saved.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("request body"))
+		})
+	})
 })
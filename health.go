@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthProbeTimeout bounds how long a health check waits to connect to the
+// upstream server when -health-includes-upstream is specified.
+const healthProbeTimeout = 2 * time.Second
+
+// healthTokenHeader carries the -health-secret in health check requests.
+const healthTokenHeader = "X-Health-Token"
+
+// drainCheckInterval bounds how often proxied requests check whether the
+// -drain-file exists. Health check requests always check it.
+const drainCheckInterval = time.Second
+
+type healthHandler struct {
+	path        string
+	body        string
+	contentType string
+	detail      bool
+	upstream    *url.URL
+	drain       *drainStatus
+	configHash  string
+	token       []byte
+	handler     http.Handler
+}
+
+// healthDetail is the JSON body of health check responses when
+// -health-detail is specified.
+type healthDetail struct {
+	Status string             `json:"status"`
+	Checks []dependencyHealth `json:"checks"`
+}
+
+// dependencyHealth is the status of one of the dependencies checked by the
+// health check.
+type dependencyHealth struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// newHealthHandler returns a http.Handler that answers requests for
+// opts.HealthPath without authentication, passing all other requests through
+// to handler.
+func newHealthHandler(opts *HmacProxyOpts, handler http.Handler) http.Handler {
+	h := healthHandler{
+		path:        opts.HealthPath,
+		body:        opts.HealthBody,
+		contentType: opts.HealthContentType,
+		detail:      opts.HealthDetail,
+		token:       []byte(opts.HealthSecret),
+		handler:     handler,
+	}
+	if opts.DrainFile != "" {
+		h.drain = newDrainStatus(opts.DrainFile)
+	}
+	if opts.HealthIncludesUpstream {
+		h.upstream = opts.Upstream.URL
+	}
+	if opts.ConfigHash {
+		h.configHash = configHash(opts)
+	}
+	return h
+}
+
+func (h healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != h.path {
+		if h.drain != nil && h.drain.cached() {
+			// Ask clients to reconnect, so that a load balancer
+			// may move them to another instance.
+			w.Header().Set("Connection", "close")
+		}
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	if len(h.token) != 0 && subtle.ConstantTimeCompare(h.token,
+		[]byte(r.Header.Get(healthTokenHeader))) != 1 {
+		writeError(w, r, "missing or invalid "+healthTokenHeader,
+			http.StatusUnauthorized)
+		return
+	}
+	draining := h.drain != nil && h.drain.check()
+	if h.configHash != "" {
+		w.Header().Set("X-Config-Hash", h.configHash)
+	}
+	if h.detail {
+		h.serveDetail(w, draining)
+		return
+	}
+	if draining {
+		writeError(w, r, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if h.upstream != nil && !upstreamReachable(h.upstream) {
+		writeError(w, r, "upstream unreachable",
+			http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", h.contentType)
+	_, _ = w.Write([]byte(h.body))
+}
+
+// serveDetail responds with the status of each dependency checked by the
+// health check, as JSON.
+func (h healthHandler) serveDetail(w http.ResponseWriter, draining bool) {
+	detail := healthDetail{Status: "ok", Checks: []dependencyHealth{}}
+	check := func(name string, ok bool, failure string) {
+		status := "ok"
+		if !ok {
+			status = failure
+			detail.Status = "unhealthy"
+		}
+		detail.Checks = append(detail.Checks,
+			dependencyHealth{name, status})
+	}
+	if h.drain != nil {
+		check("drain", !draining, "draining")
+	}
+	if h.upstream != nil {
+		check("upstream", upstreamReachable(h.upstream), "unreachable")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if detail.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(detail)
+}
+
+// drainStatus remembers whether the -drain-file existed when last checked.
+type drainStatus struct {
+	path     string
+	now      func() time.Time
+	mu       sync.Mutex
+	checked  time.Time
+	draining bool
+}
+
+func newDrainStatus(path string) *drainStatus {
+	return &drainStatus{path: path, now: time.Now}
+}
+
+// check reports whether the drain file exists.
+func (d *drainStatus) check() bool {
+	_, err := os.Stat(d.path)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.checked = d.now()
+	d.draining = err == nil
+	return d.draining
+}
+
+// cached reports whether the drain file existed when last checked, checking
+// again if that was more than drainCheckInterval ago.
+func (d *drainStatus) cached() bool {
+	d.mu.Lock()
+	stale := d.now().Sub(d.checked) >= drainCheckInterval
+	draining := d.draining
+	d.mu.Unlock()
+	if stale {
+		return d.check()
+	}
+	return draining
+}
+
+// upstreamReachable reports whether a TCP connection to the upstream server
+// can be established.
+func upstreamReachable(upstream *url.URL) bool {
+	address := upstream.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "80"
+		if upstream.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	conn, err := net.DialTimeout("tcp", address, healthProbeTimeout)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
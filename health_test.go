@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("HmacProxy health check", func() {
+	var (
+		opts     *HmacProxyOpts
+		flags    *flag.FlagSet
+		upstream *httptest.Server
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet(
+			"HmacProxy health check", flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+		upstream = httptest.NewServer(proxiedServer{})
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	healthCheck := func(server *httptest.Server) (int, string) {
+		response, err := http.Get(server.URL + "/healthz")
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return response.StatusCode, string(body)
+	}
+
+	It("should respond with a custom body and content type", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-health-path=/healthz",
+			`-health-body={"status":"ok"}`,
+			"-health-content-type=application/json",
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		response, err := http.Get(server.URL + "/healthz")
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Header.Get("Content-Type")).To(
+			Equal("application/json"))
+		Expect(readBody(response)).To(Equal(`{"status":"ok"}`))
+	})
+
+	It("should pass other requests through", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-health-path=/healthz",
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		response, err := http.Get(server.URL + "/")
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		status, body := healthCheck(server)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("ok"))
+	})
+
+	It("should ignore the upstream by default", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-upstream=" + upstream.URL,
+			"-health-path=/healthz",
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		status, _ := healthCheck(server)
+		Expect(status).To(Equal(http.StatusOK))
+		upstream.Close()
+		status, _ = healthCheck(server)
+		Expect(status).To(Equal(http.StatusOK))
+	})
+
+	It("should fail when the upstream is unreachable if asked", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-upstream=" + upstream.URL,
+			"-health-path=/healthz",
+			"-health-includes-upstream",
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		status, _ := healthCheck(server)
+		Expect(status).To(Equal(http.StatusOK))
+		upstream.Close()
+		status, body := healthCheck(server)
+		Expect(status).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(Equal("upstream unreachable\n"))
+	})
+
+	It("should report draining while the drain file exists", func() {
+		dir, err := ioutil.TempDir("", "hmacproxy-test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		drainFile := filepath.Join(dir, "drain")
+
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-upstream=" + upstream.URL,
+			"-health-path=/healthz",
+			"-drain-file=" + drainFile,
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		proxied := func() *http.Response {
+			response, err := http.Get(server.URL + "/")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			return response
+		}
+
+		status, _ := healthCheck(server)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(proxied().Close).To(BeFalse())
+
+		Expect(ioutil.WriteFile(drainFile, nil, 0644)).To(Succeed())
+		status, body := healthCheck(server)
+		Expect(status).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(Equal("draining\n"))
+		Expect(proxied().Close).To(BeTrue())
+
+		Expect(os.Remove(drainFile)).To(Succeed())
+		status, _ = healthCheck(server)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(proxied().Close).To(BeFalse())
+	})
+
+	It("should check the drain file at most once per interval "+
+		"for proxied requests", func() {
+		dir, err := ioutil.TempDir("", "hmacproxy-test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		drainFile := filepath.Join(dir, "drain")
+
+		now := time.Unix(1444059176, 0)
+		drain := newDrainStatus(drainFile)
+		drain.now = func() time.Time { return now }
+		Expect(drain.cached()).To(BeFalse())
+
+		Expect(ioutil.WriteFile(drainFile, nil, 0644)).To(Succeed())
+		Expect(drain.cached()).To(BeFalse())
+		now = now.Add(drainCheckInterval)
+		Expect(drain.cached()).To(BeTrue())
+
+		Expect(os.Remove(drainFile)).To(Succeed())
+		Expect(drain.check()).To(BeFalse())
+		Expect(drain.cached()).To(BeFalse())
+	})
+
+	It("should detail the status of each dependency", func() {
+		dir, err := ioutil.TempDir("", "hmacproxy-test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		drainFile := filepath.Join(dir, "drain")
+		Expect(ioutil.WriteFile(drainFile, nil, 0644)).To(Succeed())
+
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-upstream=" + upstream.URL,
+			"-health-path=/healthz",
+			"-health-includes-upstream",
+			"-drain-file=" + drainFile,
+			"-health-detail",
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		response, err := http.Get(server.URL + "/healthz")
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(
+			Equal(http.StatusServiceUnavailable))
+		Expect(response.Header.Get("Content-Type")).To(
+			Equal("application/json"))
+		var detail healthDetail
+		Expect(json.NewDecoder(response.Body).Decode(&detail)).To(
+			Succeed())
+		Expect(detail).To(Equal(healthDetail{
+			Status: "unhealthy",
+			Checks: []dependencyHealth{
+				{"drain", "draining"},
+				{"upstream", "ok"},
+			},
+		}))
+
+		Expect(os.Remove(drainFile)).To(Succeed())
+		status, body := healthCheck(server)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(MatchJSON(`{"status": "ok", "checks": [
+			{"name": "drain", "status": "ok"},
+			{"name": "upstream", "status": "ok"}
+		]}`))
+	})
+
+	It("should be open when no health secret is set", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-health-path=/healthz",
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		status, body := healthCheck(server)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("ok"))
+	})
+
+	It("should require the health token when a secret is set", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-health-path=/healthz",
+			"-health-secret=healthtoken",
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		status, _ := healthCheck(server)
+		Expect(status).To(Equal(http.StatusUnauthorized))
+
+		check := func(token string) int {
+			req, err := http.NewRequest(
+				"GET", server.URL+"/healthz", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("X-Health-Token", token)
+			response, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			response.Body.Close()
+			return response.StatusCode
+		}
+		Expect(check("wrongtoken")).To(Equal(http.StatusUnauthorized))
+		Expect(check("healthtoken")).To(Equal(http.StatusOK))
+	})
+
+	It("should describe failures as problem details with "+
+		"-error-format=problem", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-health-path=/healthz",
+			"-health-secret=healthtoken",
+			"-error-format=problem",
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		status, body := healthCheck(server)
+		Expect(status).To(Equal(http.StatusUnauthorized))
+		Expect(body).To(MatchJSON(`{
+			"type": "about:blank",
+			"title": "Unauthorized",
+			"status": 401,
+			"detail": "missing or invalid X-Health-Token"
+		}`))
+	})
+})
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// hostConfig contains the signing parameters for one host listed in the
+// -hosts-config file. Headers defaults to -headers if omitted.
+type hostConfig struct {
+	Upstream string   `json:"upstream"`
+	Secret   string   `json:"secret"`
+	Headers  []string `json:"headers"`
+}
+
+// loadHostsConfig reads the -hosts-config file, a JSON object mapping each
+// host name to its hostConfig.
+func loadHostsConfig(path string) (hosts map[string]hostConfig, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err == nil {
+		err = json.Unmarshal(data, &hosts)
+	}
+	return
+}
+
+type hostsHandler struct {
+	hosts map[string]http.Handler
+}
+
+// newHostsHandler returns a http.Handler that signs and proxies each request
+// according to the configuration in opts.Hosts for the request's Host.
+func newHostsHandler(opts *HmacProxyOpts) (
+	handler http.Handler, description string) {
+	h := hostsHandler{make(map[string]http.Handler)}
+	var names []string
+	for host, hostOpts := range opts.Hosts {
+		h.hosts[host], _ = versionsHandler(hostOpts)
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	description = "proxying signed requests for hosts: " +
+		strings.Join(names, ", ")
+	handler = h
+	return
+}
+
+func (h hostsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(r.Host)
+	handler, ok := h.hosts[host]
+	if !ok {
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			handler, ok = h.hosts[name]
+		}
+	}
+	if !ok {
+		writeError(w, r, "unknown host: "+r.Host, http.StatusNotFound)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
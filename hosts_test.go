@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+// hostUpstream returns a server that responds with its name and whether the
+// request was signed with secret.
+func hostUpstream(name, secret string) *httptest.Server {
+	auth := hmacauth.NewHmacAuth(crypto.SHA1, []byte(secret),
+		"Test-Signature", []string{"Date"})
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			result, _, _ := auth.AuthenticateRequest(r)
+			_, _ = w.Write([]byte(name + " " + result.String()))
+		}))
+}
+
+var _ = Describe("HmacProxy per-host signing", func() {
+	var (
+		dir                  string
+		upstreamA, upstreamB *httptest.Server
+		server               *httptest.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "hmacproxy-test")
+		Expect(err).NotTo(HaveOccurred())
+		upstreamA = hostUpstream("a", "secret-a")
+		upstreamB = hostUpstream("b", "secret-b")
+		config := filepath.Join(dir, "hosts.json")
+		Expect(ioutil.WriteFile(config, []byte(`{
+			"a.example.com": {
+				"upstream": "`+upstreamA.URL+`",
+				"secret": "secret-a",
+				"headers": ["Date"]
+			},
+			"B.example.com": {
+				"upstream": "`+upstreamB.URL+`",
+				"secret": "secret-b",
+				"headers": ["Date"]
+			}
+		}`), 0644)).To(Succeed())
+
+		flags := flag.NewFlagSet(
+			"HmacProxy per-host signing", flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, description := newHandler(flags, opts, []string{
+			"-sign-header=Test-Signature",
+			"-hosts-config=" + config,
+		})
+		Expect(description).To(Equal("proxying signed requests " +
+			"for hosts: a.example.com, b.example.com"))
+		server = httptest.NewServer(handler)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		upstreamA.Close()
+		upstreamB.Close()
+		os.RemoveAll(dir)
+	})
+
+	get := func(host string) (int, string) {
+		request, err := http.NewRequest("GET", server.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Host = host
+		request.Header.Set("Date", "Mon, 05 Oct 2015 15:32:56 GMT")
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		return response.StatusCode, readBody(response)
+	}
+
+	It("should sign with each host's secret and upstream", func() {
+		status, body := get("a.example.com")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("a " + hmacauth.ResultMatch.String()))
+
+		status, body = get("b.example.com:8080")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("b " + hmacauth.ResultMatch.String()))
+	})
+
+	It("should reject unknown hosts", func() {
+		status, _ := get("c.example.com")
+		Expect(status).To(Equal(http.StatusNotFound))
+	})
+
+	It("should reject -webhook-preset", func() {
+		flags := flag.NewFlagSet("HmacProxy per-host signing (preset)",
+			flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		Expect(flags.Parse([]string{
+			"-port=8080",
+			"-webhook-preset=github",
+			"-hosts-config=" + filepath.Join(dir, "hosts.json"),
+		})).To(Succeed())
+		Expect(opts.Validate()).To(MatchError(optionErrors([]string{
+			"hosts-config cannot be combined with -auth, " +
+				"-upstream, -secret, or -webhook-preset",
+		})))
+	})
+})
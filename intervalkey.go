@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"github.com/18F/hmacauth"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// intervalKeyAuth signs and authenticates requests using a key derived from
+// the secret for the current -key-rotation-interval, so that a leaked
+// signature can only be replayed until the interval ends.
+type intervalKeyAuth struct {
+	opts     HmacProxyOpts
+	newAuth  func(opts *HmacProxyOpts) hmacauth.HmacAuth
+	interval int64
+	now      func() time.Time
+	cache    *intervalKeyCache
+}
+
+// intervalKeyCache holds the hmacauth.HmacAuth for the most recent interval,
+// so that state such as -digest=auto negotiation is kept between requests.
+type intervalKeyCache struct {
+	mu     sync.Mutex
+	number int64
+	auth   hmacauth.HmacAuth
+}
+
+// newIntervalKeyAuth returns an hmacauth.HmacAuth that uses newAuth with keys
+// derived from opts.Secret for each opts.KeyRotationInterval.
+func newIntervalKeyAuth(opts *HmacProxyOpts,
+	newAuth func(opts *HmacProxyOpts) hmacauth.HmacAuth) hmacauth.HmacAuth {
+	return intervalKeyAuth{*opts, newAuth,
+		int64(opts.KeyRotationInterval / time.Second), time.Now,
+		&intervalKeyCache{}}
+}
+
+// deriveIntervalKey derives the key for an interval from secret using HKDF
+// with SHA-256, no salt, and the decimal interval number as the info.
+func deriveIntervalKey(secret []byte, interval int64) []byte {
+	extract := hmac.New(sha256.New, nil)
+	_, _ = extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	_, _ = expand.Write([]byte(strconv.FormatInt(interval, 10)))
+	_, _ = expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// current returns the hmacauth.HmacAuth for the interval containing now,
+// creating it only when a new interval begins.
+func (a intervalKeyAuth) current() hmacauth.HmacAuth {
+	number := a.now().Unix() / a.interval
+	a.cache.mu.Lock()
+	defer a.cache.mu.Unlock()
+	if a.cache.auth == nil || a.cache.number != number {
+		opts := a.opts
+		opts.Secret = string(deriveIntervalKey([]byte(a.opts.Secret),
+			number))
+		a.cache.number, a.cache.auth = number, a.newAuth(&opts)
+	}
+	return a.cache.auth
+}
+
+func (a intervalKeyAuth) Sign(r *http.Request) string {
+	return a.current().Sign(r)
+}
+
+func (a intervalKeyAuth) SignRequest(r *http.Request) {
+	a.current().SignRequest(r)
+}
+
+func (a intervalKeyAuth) StringToSign(r *http.Request) string {
+	return a.current().StringToSign(r)
+}
+
+func (a intervalKeyAuth) SignatureFromHeader(r *http.Request) string {
+	return a.current().SignatureFromHeader(r)
+}
+
+func (a intervalKeyAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	return a.current().AuthenticateRequest(r)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("HmacProxy interval keys", func() {
+	newAuth := func(opts *HmacProxyOpts) hmacauth.HmacAuth {
+		return hmacauth.NewHmacAuth(crypto.SHA1, []byte(opts.Secret),
+			"Test-Signature", nil)
+	}
+
+	// authAt returns an intervalKeyAuth for hourly intervals whose clock
+	// reads at.
+	authAt := func(at time.Time) hmacauth.HmacAuth {
+		return intervalKeyAuth{HmacProxyOpts{Secret: "foobar"}, newAuth,
+			3600, func() time.Time { return at },
+			&intervalKeyCache{}}
+	}
+
+	// authenticate signs a request at signedAt, then authenticates it at
+	// authenticatedAt.
+	authenticate := func(signedAt, authenticatedAt time.Time) (
+		result hmacauth.AuthenticationResult) {
+		request, err := http.NewRequest("GET", "http://localhost/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		authAt(signedAt).SignRequest(request)
+		result, _, _ = authAt(authenticatedAt).AuthenticateRequest(
+			request)
+		return
+	}
+
+	start := time.Date(2015, 10, 5, 15, 0, 0, 0, time.UTC)
+
+	It("should authenticate requests within the same interval", func() {
+		Expect(authenticate(start, start.Add(59*time.Minute))).To(
+			Equal(hmacauth.ResultMatch))
+	})
+
+	It("should reject requests signed in an earlier interval", func() {
+		Expect(authenticate(start.Add(59*time.Minute),
+			start.Add(61*time.Minute))).To(
+			Equal(hmacauth.ResultMismatch))
+	})
+
+	It("should not sign with the secret itself", func() {
+		request, err := http.NewRequest("GET", "http://localhost/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(authAt(start).Sign(request)).NotTo(
+			Equal(newAuth(&HmacProxyOpts{Secret: "foobar"}).Sign(
+				request)))
+	})
+
+	It("should authenticate using -key-rotation-interval", func() {
+		flags := flag.NewFlagSet("HmacProxy interval keys",
+			flag.ContinueOnError)
+		handler, _ := newHandler(flags,
+			RegisterCommandLineOptions(flags), []string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-no-default-headers",
+				"-auth",
+				"-key-rotation-interval=24h",
+			})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		request, err := http.NewRequest("GET", server.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		key := deriveIntervalKey([]byte("foobar"),
+			time.Now().Unix()/86400)
+		hmacauth.NewHmacAuth(crypto.SHA1, key, "Test-Signature",
+			nil).SignRequest(request)
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusAccepted))
+	})
+
+	It("should negotiate -digest=auto once per interval", func() {
+		fetches := 0
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == capabilitiesPath {
+					fetches++
+					_, _ = w.Write([]byte(
+						`{"digests":["sha256"]}`))
+				}
+			}))
+		defer upstream.Close()
+
+		flags := flag.NewFlagSet("HmacProxy interval keys (auto)",
+			flag.ContinueOnError)
+		handler, _ := newHandler(flags,
+			RegisterCommandLineOptions(flags), []string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-digest=auto",
+				"-key-rotation-interval=24h",
+				"-upstream=" + upstream.URL,
+			})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		for i := 0; i != 3; i++ {
+			response, err := http.Get(server.URL + "/")
+			Expect(err).NotTo(HaveOccurred())
+			response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		}
+		Expect(fetches).To(Equal(1))
+	})
+})
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"time"
+)
+
+// logFlushInterval is how often a logBuffer flushes buffered lines.
+const logFlushInterval = time.Second
+
+// logBuffer is the asyncSink for -log-buffer, which writes access log lines
+// to its output in batches.
+type logBuffer struct {
+	output *bufio.Writer
+}
+
+// newLogBuffer returns an asyncWriter queueing up to size access log lines
+// for output.
+func newLogBuffer(output io.Writer, size int) *asyncWriter {
+	return newAsyncWriter(logBuffer{bufio.NewWriter(output)}, size,
+		logFlushInterval)
+}
+
+func (b logBuffer) write(line []byte) bool {
+	_, _ = b.output.Write(line)
+	return true
+}
+
+func (b logBuffer) flush(dropped int) {
+	if err := b.output.Flush(); err != nil {
+		log.Printf("failed to write access log: %s", err)
+	}
+	if dropped != 0 {
+		log.Printf("dropped %d access log lines: -log-buffer is full",
+			dropped)
+	}
+}
+
+func (b logBuffer) close() {}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"io"
+	"time"
+)
+
+var _ = Describe("HmacProxy buffered access log", func() {
+	var (
+		output *gbytes.Buffer
+		buffer *asyncWriter
+	)
+
+	BeforeEach(func() {
+		output = gbytes.NewBuffer()
+		buffer = newLogBuffer(output, 10)
+	})
+
+	It("should eventually write buffered lines", func() {
+		_, err := io.WriteString(buffer, "first\n")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = io.WriteString(buffer, "second\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(output.Contents()).To(BeEmpty())
+		Eventually(output, 2*logFlushInterval).Should(
+			gbytes.Say("first\nsecond\n"))
+		Expect(buffer.Close()).To(Succeed())
+	})
+
+	It("should write every buffered line when closed", func() {
+		start := time.Now()
+		for _, line := range []string{"one\n", "two\n", "three\n"} {
+			_, err := io.WriteString(buffer, line)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(buffer.Close()).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically("<",
+			logFlushInterval))
+		Expect(string(output.Contents())).To(
+			Equal("one\ntwo\nthree\n"))
+
+		_, err := io.WriteString(buffer, "four\n")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/18F/hmacauth"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFormatters maps each -log-format value to the function that formats an
+// access log line in that format.
+var logFormatters = map[string]func(entry *logEntry) string{
+	"combined":        formatCombined,
+	"combined-timing": formatCombinedTiming,
+	"logfmt":          formatLogfmt,
+}
+
+// logEntry contains the information about a request and its response that is
+// written to the access log.
+type logEntry struct {
+	request *http.Request
+	start   time.Time
+	status  int
+	size    int
+
+	// authTime and upstreamTime are the time spent signing or
+	// authenticating the request and waiting for the upstream server's
+	// response headers, respectively.
+	authTime     time.Duration
+	upstreamTime time.Duration
+
+	// result is the outcome of authenticating the request, if it was
+	// authenticated.
+	result string
+}
+
+// logEntryKey is the request context key under which loggingHandler stores
+// the logEntry for a request, so that other handlers may record timings.
+type logEntryKey struct{}
+
+// requestLogEntry returns the logEntry stored in the context of r, or nil if
+// access logging is disabled.
+func requestLogEntry(r *http.Request) *logEntry {
+	entry, _ := r.Context().Value(logEntryKey{}).(*logEntry)
+	return entry
+}
+
+// recordAuthTime adds the time elapsed since start to the authentication
+// time of the logEntry for r, if any.
+func recordAuthTime(r *http.Request, start time.Time) {
+	if entry := requestLogEntry(r); entry != nil {
+		entry.authTime += time.Since(start)
+	}
+}
+
+// authResultNames maps each hmacauth.AuthenticationResult to the name
+// written to the access log.
+var authResultNames = map[hmacauth.AuthenticationResult]string{
+	hmacauth.ResultNoSignature:          "no-signature",
+	hmacauth.ResultInvalidFormat:        "invalid-format",
+	hmacauth.ResultUnsupportedAlgorithm: "unsupported-algorithm",
+	hmacauth.ResultMatch:                "match",
+	hmacauth.ResultMismatch:             "mismatch",
+}
+
+// recordAuthResult records the outcome of authenticating r in the logEntry
+// for r, if any.
+func recordAuthResult(r *http.Request, result string) {
+	if entry := requestLogEntry(r); entry != nil {
+		entry.result = result
+	}
+}
+
+// timingTransport records the time taken by each upstream round trip in the
+// logEntry for the request, if any.
+type timingTransport struct {
+	http.RoundTripper
+}
+
+func (t timingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := t.RoundTripper.RoundTrip(r)
+	if entry := requestLogEntry(r); entry != nil {
+		entry.upstreamTime += time.Since(start)
+	}
+	return response, err
+}
+
+type loggingHandler struct {
+	format  func(entry *logEntry) string
+	output  io.Writer
+	mu      *sync.Mutex
+	events  io.Writer
+	handler http.Handler
+}
+
+// newLoggingHandler returns a http.Handler that writes an access log line to
+// standard output for every request passed through to handler, in the format
+// specified by opts.LogFormat, and an event to opts.EventSocket, if either is
+// specified.
+func newLoggingHandler(opts *HmacProxyOpts,
+	handler http.Handler) http.Handler {
+	output := opts.LogOutput
+	if output == nil {
+		output = os.Stdout
+	}
+	events := opts.EventOutput
+	if events == nil && opts.EventSocket != "" {
+		events = openEventSocket(opts)
+	}
+	return loggingHandler{logFormatters[opts.LogFormat], output,
+		&sync.Mutex{}, events, handler}
+}
+
+func (h loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entry := &logEntry{request: r, start: time.Now()}
+	ctx := context.WithValue(r.Context(), logEntryKey{}, entry)
+	h.handler.ServeHTTP(&responseLogger{w, entry}, r.WithContext(ctx))
+	if entry.status == 0 {
+		entry.status = http.StatusOK
+	}
+
+	if h.events != nil {
+		_, _ = h.events.Write(formatEvent(entry))
+	}
+	if h.format == nil {
+		return
+	}
+	line := h.format(entry) + "\n"
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, _ = io.WriteString(h.output, line)
+}
+
+// responseLogger records the status code and size of a response in a
+// logEntry.
+type responseLogger struct {
+	http.ResponseWriter
+	entry *logEntry
+}
+
+func (l *responseLogger) WriteHeader(status int) {
+	if l.entry.status == 0 {
+		l.entry.status = status
+	}
+	l.ResponseWriter.WriteHeader(status)
+}
+
+func (l *responseLogger) Write(b []byte) (int, error) {
+	if l.entry.status == 0 {
+		l.entry.status = http.StatusOK
+	}
+	n, err := l.ResponseWriter.Write(b)
+	l.entry.size += n
+	return n, err
+}
+
+// Flush allows the reverse proxy to flush streaming responses.
+func (l *responseLogger) Flush() {
+	if flusher, ok := l.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack allows the reverse proxy to take over the connection when the
+// upstream server switches protocols, such as to WebSocket.
+func (l *responseLogger) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := l.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	if l.entry.status == 0 {
+		l.entry.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// remoteHost returns the host portion of the request's remote address.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// quoteLogField escapes value so that it may appear between double quotes in
+// a log line, substituting "-" for empty values.
+func quoteLogField(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return `"` + value + `"`
+}
+
+// formatCombined formats entry in the Apache Combined Log Format:
+//
+//	host - - [time] "METHOD uri proto" status size "referer" "user-agent"
+func formatCombined(entry *logEntry) string {
+	r := entry.request
+	size := "-"
+	if entry.size != 0 {
+		size = strconv.Itoa(entry.size)
+	}
+	return strings.Join([]string{
+		remoteHost(r), "-", "-",
+		entry.start.Format("[02/Jan/2006:15:04:05 -0700]"),
+		quoteLogField(r.Method + " " + r.RequestURI + " " + r.Proto),
+		strconv.Itoa(entry.status), size,
+		quoteLogField(r.Referer()),
+		quoteLogField(r.UserAgent()),
+	}, " ")
+}
+
+// formatCombinedTiming formats entry in the Apache Combined Log Format,
+// followed by the time spent signing or authenticating the request and
+// waiting for the upstream server's response headers:
+//
+//	... "referer" "user-agent" auth_ms=0.125 upstream_ms=20.500
+func formatCombinedTiming(entry *logEntry) string {
+	return formatCombined(entry) +
+		" auth_ms=" + formatMilliseconds(entry.authTime) +
+		" upstream_ms=" + formatMilliseconds(entry.upstreamTime)
+}
+
+func formatMilliseconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds()*1000, 'f', 3, 64)
+}
+
+// formatLogfmt formats entry as logfmt key=value pairs:
+//
+//	ts=2015-10-05T15:32:56Z remote=127.0.0.1 method=GET path=/ status=200
+//	size=0 dur=12.500ms result=match
+func formatLogfmt(entry *logEntry) string {
+	r := entry.request
+	pairs := []string{
+		"ts=" + entry.start.UTC().Format(time.RFC3339),
+		"remote=" + logfmtValue(remoteHost(r)),
+		"method=" + logfmtValue(r.Method),
+		"path=" + logfmtValue(r.URL.Path),
+		"status=" + strconv.Itoa(entry.status),
+		"size=" + strconv.Itoa(entry.size),
+		"dur=" + formatMilliseconds(time.Since(entry.start)) + "ms",
+	}
+	if entry.result != "" {
+		pairs = append(pairs, "result="+entry.result)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// logfmtValue quotes value if it is empty or contains spaces, control
+// characters, or characters with special meaning in logfmt.
+func logfmtValue(value string) string {
+	if value == "" || strings.IndexFunc(value, func(c rune) bool {
+		return c <= ' ' || c == '=' || c == '"' || c == '\\' ||
+			c == 0x7f
+	}) != -1 {
+		return strconv.Quote(value)
+	}
+	return value
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// combinedLogLine matches a line in the Apache Combined Log Format.
+var combinedLogLine = regexp.MustCompile(`^(\S+) (\S+) (\S+) ` +
+	`\[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) (\d+|-) ` +
+	`"((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)"\n$`)
+
+var _ = Describe("HmacProxy access log", func() {
+	var (
+		opts  *HmacProxyOpts
+		flags *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet(
+			"HmacProxy access log", flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+	})
+
+	// logRequest sends request through a handler configured by argv and
+	// returns the access log output.
+	logRequest := func(argv []string, request *http.Request) string {
+		handler, _ := newHandler(flags, opts, argv)
+		var output bytes.Buffer
+		logging := handler.(loggingHandler)
+		logging.output = &output
+		logging.ServeHTTP(httptest.NewRecorder(), request)
+		return output.String()
+	}
+
+	It("should write lines in combined log format", func() {
+		request := httptest.NewRequest("GET", "/foo?bar=baz", nil)
+		request.RemoteAddr = "192.168.0.1:12345"
+		request.Header.Set("Referer", "https://example.com/")
+		request.Header.Set("User-Agent", `Test "Agent"`)
+
+		line := logRequest([]string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-log-format=combined",
+		}, request)
+		fields := combinedLogLine.FindStringSubmatch(line)
+		Expect(fields).NotTo(BeNil(), line)
+		Expect(fields[1:4]).To(Equal(
+			[]string{"192.168.0.1", "-", "-"}))
+		_, err := time.Parse("02/Jan/2006:15:04:05 -0700", fields[4])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fields[5]).To(Equal("GET /foo?bar=baz HTTP/1.1"))
+		Expect(fields[6]).To(Equal("401"))
+		Expect(fields[7]).To(Equal("21"))
+		Expect(fields[8]).To(Equal("https://example.com/"))
+		Expect(fields[9]).To(Equal(`Test \"Agent\"`))
+	})
+
+	It("should log authentication and upstream times separately", func() {
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(100 * time.Millisecond)
+			}))
+		defer upstream.Close()
+		request := httptest.NewRequest("GET", "/", nil)
+		hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+			"Test-Signature", nil).SignRequest(request)
+
+		line := logRequest([]string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-no-default-headers",
+			"-auth",
+			"-upstream=" + upstream.URL,
+			"-log-format=combined-timing",
+		}, request)
+		timing := regexp.MustCompile(
+			` auth_ms=(\S+) upstream_ms=(\S+)\n$`)
+		fields := timing.FindStringSubmatch(line)
+		Expect(fields).NotTo(BeNil(), line)
+		Expect(combinedLogLine.MatchString(
+			line[:len(line)-len(fields[0])]+"\n")).To(BeTrue(), line)
+		authMs, err := strconv.ParseFloat(fields[1], 64)
+		Expect(err).NotTo(HaveOccurred())
+		upstreamMs, err := strconv.ParseFloat(fields[2], 64)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(upstreamMs).To(BeNumerically(">=", 100))
+		Expect(authMs).To(BeNumerically("<", 50))
+	})
+
+	It("should write lines in logfmt", func() {
+		request := httptest.NewRequest("GET", "/foo%20bar?baz=quux", nil)
+		request.RemoteAddr = "192.168.0.1:12345"
+
+		line := logRequest([]string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-log-format=logfmt",
+		}, request)
+		Expect(line).To(HaveSuffix("\n"))
+		pair := regexp.MustCompile(
+			`^(\w+)=("(?:[^"\\]|\\.)*"|[^ "=]+)(?: |\n$)`)
+		fields := make(map[string]string)
+		var keys []string
+		for rest := line; rest != ""; {
+			match := pair.FindStringSubmatch(rest)
+			Expect(match).NotTo(BeNil(), rest)
+			value := match[2]
+			if strings.HasPrefix(value, `"`) {
+				var err error
+				value, err = strconv.Unquote(value)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			keys = append(keys, match[1])
+			fields[match[1]] = value
+			rest = rest[len(match[0]):]
+		}
+		Expect(keys).To(Equal([]string{"ts", "remote", "method",
+			"path", "status", "size", "dur", "result"}))
+		_, err := time.Parse(time.RFC3339, fields["ts"])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fields["remote"]).To(Equal("192.168.0.1"))
+		Expect(fields["method"]).To(Equal("GET"))
+		Expect(fields["path"]).To(Equal("/foo bar"))
+		Expect(fields["status"]).To(Equal("401"))
+		Expect(fields["dur"]).To(MatchRegexp(`^\d+\.\d{3}ms$`))
+		Expect(fields["result"]).To(Equal("no-signature"))
+	})
+
+	It("should log an empty response size as -", func() {
+		var output bytes.Buffer
+		handler := loggingHandler{formatCombined, &output, &sync.Mutex{},
+			nil, http.HandlerFunc(func(w http.ResponseWriter,
+				r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})}
+		handler.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest("DELETE", "/", nil))
+		fields := combinedLogLine.FindStringSubmatch(output.String())
+		Expect(fields).NotTo(BeNil(), output.String())
+		Expect(fields[5]).To(Equal("DELETE / HTTP/1.1"))
+		Expect(fields[6]).To(Equal("204"))
+		Expect(fields[7]).To(Equal("-"))
+		Expect(fields[8]).To(Equal("-"))
+	})
+
+	It("should pass through connections that switch protocols", func() {
+		upstream := httptest.NewServer(upgradeEchoServer{})
+		defer upstream.Close()
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-upstream=" + upstream.URL,
+			"-log-format=combined",
+		})
+		output := gbytes.NewBuffer()
+		logging := handler.(loggingHandler)
+		logging.output = output
+		server := httptest.NewServer(logging)
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n" +
+			"Host: localhost\r\nConnection: Upgrade\r\n" +
+			"Upgrade: echo\r\n\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		reader := bufio.NewReader(conn)
+		response, err := http.ReadResponse(reader, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(
+			Equal(http.StatusSwitchingProtocols))
+		_, err = conn.Write([]byte("ping\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reader.ReadString('\n')).To(Equal("ping\n"))
+
+		Expect(conn.Close()).To(Succeed())
+		Eventually(output).Should(gbytes.Say(`"GET / HTTP/1.1" 101 `))
+	})
+
+	It("should serialize concurrent writes", func() {
+		var output bytes.Buffer
+		handler := loggingHandler{formatCombined, &output, &sync.Mutex{},
+			nil, http.NotFoundHandler()}
+		var wg sync.WaitGroup
+		for i := 0; i != 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handler.ServeHTTP(httptest.NewRecorder(),
+					httptest.NewRequest("GET", "/", nil))
+			}()
+		}
+		wg.Wait()
+		Expect(bytes.Count(output.Bytes(), []byte("\n"))).To(Equal(10))
+	})
+})
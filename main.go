@@ -1,30 +1,82 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 )
 
 func main() {
 	opts := RegisterCommandLineOptions(flag.CommandLine)
 	flag.Parse()
-	if err := opts.Validate(); err != nil {
+	err := opts.Validate()
+	if opts.Explain {
+		fmt.Fprint(os.Stderr, opts.ExplainMode())
+	}
+	if err != nil {
+		if opts.ErrorsJSON {
+			_ = json.NewEncoder(os.Stderr).Encode(err)
+			os.Exit(1)
+		}
 		log.Fatal(err)
 	}
+	opts.WarnIfWeakDigest(log.New(os.Stderr, "", log.LstdFlags))
+	if opts.ConfigHash {
+		log.Printf("configuration hash: %s", configHash(opts))
+	}
 
-	address := ":" + strconv.Itoa(opts.Port)
-	handler, description := NewHTTPProxyHandler(opts)
-	server := &http.Server{Addr: address, Handler: handler}
-	fmt.Printf("port %d: %s\n", opts.Port, description)
+	// Queued access log lines and events are written before exiting.
+	var queues []io.Closer
+	if opts.LogBuffer != 0 {
+		buffer := newLogBuffer(os.Stdout, opts.LogBuffer)
+		opts.LogOutput = buffer
+		queues = append(queues, buffer)
+	}
+	if opts.EventSocket != "" {
+		socket := openEventSocket(opts)
+		opts.EventOutput = socket
+		queues = append(queues, socket)
+	}
+	if len(queues) != 0 {
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			for _, queue := range queues {
+				_ = queue.Close()
+			}
+			os.Exit(0)
+		}()
+	}
 
-	var err error
-	if opts.SslCert != "" {
-		err = server.ListenAndServeTLS(opts.SslCert, opts.SslKey)
-	} else {
-		err = server.ListenAndServe()
+	handler, description := NewHTTPProxyHandler(opts)
+	listeners, err := newListeners(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, port := range opts.Ports {
+		fmt.Printf("port %d: %s\n", port, description)
+	}
+	if opts.RedirectHTTPPort != 0 {
+		redirects, err := net.Listen(
+			"tcp", ":"+strconv.Itoa(opts.RedirectHTTPPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("port %d: redirecting to HTTPS on port %d\n",
+			opts.RedirectHTTPPort, opts.Ports[0])
+		go func() {
+			log.Fatal(http.Serve(
+				redirects, httpsRedirectHandler{opts.Ports[0]}))
+		}()
 	}
-	log.Fatal(err)
+	log.Fatal(serve(opts, handler, listeners))
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/18F/hmacauth"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// multipartAuth computes signatures over a canonical form of
+// multipart/form-data request bodies, so that clients may send the parts in
+// any order. The request body itself is passed through unchanged. Other
+// bodies, and multipart bodies that fail to parse, are signed as they are.
+type multipartAuth struct {
+	hmacauth.HmacAuth
+	header string
+}
+
+// canonicalMultipart returns the canonical form of a multipart/form-data
+// body with the given boundary. Each part becomes "name=value", or
+// "name=filename;sha256=<hex digest of the content>" for file parts, with
+// the name, value, and filename escaped as in a URL query. The parts are
+// sorted and joined by "&".
+func canonicalMultipart(body []byte, boundary string) ([]byte, error) {
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	var parts []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		value := url.QueryEscape(string(content))
+		if filename := part.FileName(); filename != "" {
+			hash := sha256.Sum256(content)
+			value = url.QueryEscape(filename) + ";sha256=" +
+				hex.EncodeToString(hash[:])
+		}
+		parts = append(parts, url.QueryEscape(part.FormName())+"="+
+			value)
+	}
+	sort.Strings(parts)
+	return []byte(strings.Join(parts, "&")), nil
+}
+
+// canonicalized returns a copy of r whose body is in canonical form, or r
+// itself if its body isn't a valid multipart/form-data body.
+func (a multipartAuth) canonicalized(r *http.Request) *http.Request {
+	mediaType, params, err := mime.ParseMediaType(
+		r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" ||
+		params["boundary"] == "" {
+		return r
+	}
+	body, err := canonicalMultipart(readRequestBody(r), params["boundary"])
+	if err != nil {
+		return r
+	}
+	c := copyRequest(r)
+	c.Body = ioutil.NopCloser(bytes.NewReader(body))
+	c.ContentLength = int64(len(body))
+	return c
+}
+
+func (a multipartAuth) Sign(r *http.Request) string {
+	return a.HmacAuth.Sign(a.canonicalized(r))
+}
+
+func (a multipartAuth) SignRequest(r *http.Request) {
+	r.Header.Set(a.header, a.Sign(r))
+}
+
+func (a multipartAuth) StringToSign(r *http.Request) string {
+	return a.HmacAuth.StringToSign(a.canonicalized(r))
+}
+
+func (a multipartAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	return a.HmacAuth.AuthenticateRequest(a.canonicalized(r))
+}
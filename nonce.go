@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/18F/hmacauth"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nonceStore issues single-use nonces and records which of them have been
+// consumed. Each nonce has the form "<expiry>.<random hex>.<hmac hex>", where
+// the HMAC covers the expiry and random parts, so that nonces may be checked
+// without keeping track of every nonce issued. Only consumed nonces are kept,
+// and only until they expire.
+type nonceStore struct {
+	key  []byte
+	ttl  time.Duration
+	now  func() time.Time
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// newNonceStore returns a nonceStore for the -nonce-path options specified in
+// opts, or nil if there is no -nonce-path.
+func newNonceStore(opts *HmacProxyOpts) *nonceStore {
+	if opts.NoncePath == "" {
+		return nil
+	}
+	return &nonceStore{key: []byte(opts.Secret), ttl: opts.NonceTTL,
+		now: time.Now, used: make(map[string]time.Time)}
+}
+
+// issue returns a new nonce that expires after the store's ttl.
+func (s *nonceStore) issue() (nonce string, err error) {
+	random := make([]byte, 16)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	nonce = strconv.FormatInt(s.now().Add(s.ttl).Unix(), 10) + "." +
+		hex.EncodeToString(random)
+	nonce += "." + hexHmacSha256(s.key, []byte(nonce))
+	return
+}
+
+// consume reports whether nonce was issued by the store, has not expired, and
+// has not been consumed before, and marks it as consumed.
+func (s *nonceStore) consume(nonce string) bool {
+	parts := strings.Split(nonce, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]),
+		[]byte(hexHmacSha256(s.key, []byte(payload)))) {
+		return false
+	}
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	expiry := time.Unix(seconds, 0)
+	now := s.now()
+	if !now.Before(expiry) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for used, usedExpiry := range s.used {
+		if !now.Before(usedExpiry) {
+			delete(s.used, used)
+		}
+	}
+	if _, ok := s.used[nonce]; ok {
+		return false
+	}
+	s.used[nonce] = expiry
+	return true
+}
+
+// nonceAuth consumes the nonce in the header of each request that otherwise
+// authenticates successfully, failing requests whose nonce is missing,
+// expired, forged, or already used. The header must be one of the signed
+// headers, so that a captured nonce can't be moved to another request.
+type nonceAuth struct {
+	hmacauth.HmacAuth
+	header string
+	nonces *nonceStore
+}
+
+func (a nonceAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	result, headerSignature, computedSignature =
+		a.HmacAuth.AuthenticateRequest(r)
+	if result == hmacauth.ResultMatch &&
+		!a.nonces.consume(r.Header.Get(a.header)) {
+		result = hmacauth.ResultMismatch
+	}
+	return
+}
+
+type nonceHandler struct {
+	path    string
+	nonces  *nonceStore
+	handler http.Handler
+}
+
+func (h nonceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != h.path {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	nonce, err := h.nonces.issue()
+	if err != nil {
+		writeError(w, r, "failed to issue nonce",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write([]byte(nonce))
+}
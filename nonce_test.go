@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("HmacProxy nonces", func() {
+	var (
+		opts  *HmacProxyOpts
+		flags *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet("HmacProxy nonces", flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+	})
+
+	It("should accept a nonce only once", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-headers=X-Nonce",
+			"-auth",
+			"-nonce-path=/nonce",
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		response, err := http.Get(server.URL + "/nonce")
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		nonce := readBody(response)
+
+		auth := hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+			"Test-Signature", []string{"X-Nonce"})
+		authenticate := func(nonce string) int {
+			req, err := http.NewRequest("GET", server.URL+"/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("X-Nonce", nonce)
+			auth.SignRequest(req)
+			response, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return response.StatusCode
+		}
+		Expect(authenticate(nonce)).To(Equal(http.StatusAccepted))
+		Expect(authenticate(nonce)).To(Equal(http.StatusUnauthorized))
+		Expect(authenticate("")).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject expired and forged nonces", func() {
+		now := time.Now()
+		nonces := &nonceStore{key: []byte("foobar"), ttl: time.Minute,
+			now:  func() time.Time { return now },
+			used: make(map[string]time.Time)}
+		forger := &nonceStore{key: []byte("barbaz"), ttl: time.Minute,
+			now: func() time.Time { return now }}
+
+		forged, err := forger.issue()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nonces.consume(forged)).To(BeFalse())
+
+		expired, err := nonces.issue()
+		Expect(err).NotTo(HaveOccurred())
+		now = now.Add(2 * time.Minute)
+		Expect(nonces.consume(expired)).To(BeFalse())
+	})
+
+	It("should require the nonce header to be signed", func() {
+		Expect(flags.Parse([]string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-nonce-path=/nonce",
+		})).To(Succeed())
+		opts.Ports = HmacProxyPorts{1}
+		Expect(opts.Validate()).To(MatchError(optionErrors([]string{
+			"nonce-header must be one of -headers: X-Nonce",
+		})))
+	})
+})
@@ -2,77 +2,527 @@ package main
 
 import (
 	"crypto"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"flag"
 	"github.com/18F/hmacauth"
+	"io"
+	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // HmacProxyOpts contains the parameters needed to determine which
 // authentication handler to launch and to configure it properly.
 type HmacProxyOpts struct {
-	Port       int
-	Auth       bool
-	Digest     HmacProxyDigest
-	Secret     string
-	SignHeader string
-	Headers    HmacProxyHeaders
-	Upstream   HmacProxyURL
-	FileRoot   string
-	SslCert    string
-	SslKey     string
-	Mode       HmacProxyMode
+	Ports       HmacProxyPorts
+	Auth        bool
+	Digest      HmacProxyDigest
+	Secret      string
+	SignHeader  string
+	Headers     HmacProxyHeaders
+	Upstream    HmacProxyURL
+	FileRoot    string
+	PublicPaths HmacProxyList
+	SslCert     string
+	SslKey      string
+	Mode        HmacProxyMode
+
+	MaxConnections    int
+	MaxConnsPerIP     int
+	ReadHeaderTimeout time.Duration
+	ErrorsJSON        bool
+	TLSSessionMaxAge  time.Duration
+	TLSALPN           HmacProxyList
+	RedirectHTTPPort  int
+
+	HealthPath             string
+	HealthIncludesUpstream bool
+	HealthBody             string
+	HealthContentType      string
+	HealthDetail           bool
+	HealthSecret           string
+	DrainFile              string
+
+	AdminConfigPath string
+	AdminAllowedIPs HmacProxyList
+	ConfigHash      bool
+
+	EnableDebugCanonical bool
+	DebugAllowedIPs      HmacProxyList
+
+	AuthTimeout       time.Duration
+	AuthTimeoutStatus int
+
+	DenyHeaderInjection bool
+	AllowWeakDigest     bool
+	MinDigest           string
+
+	TransformCmd     string
+	TransformTimeout time.Duration
+
+	SignaturePrefixAlgo bool
+	WebhookPreset       string
+	BatchMode           string
+
+	AuthFailure      string
+	ErrorFormat      string
+	LogFormat        string
+	LogBuffer        int
+	LogOutput        io.Writer
+	WWWAuthenticate  string
+	AuthFailureDelay time.Duration
+
+	LogClientDisconnects bool
+
+	EventSocket     string
+	EventSocketType string
+	EventBuffer     int
+	EventOutput     io.Writer
+
+	NoDefaultHeaders bool
+
+	AllowArchive bool
+
+	SetDateHeader bool
+
+	PreviousSecret string
+	RotationGrace  time.Duration
+	RotatedAt      HmacProxyTime
+
+	KeyRotationInterval time.Duration
+
+	SecretsFile string
+	KeyIDHeader string
+
+	// SecretLookup, when not nil, returns the secret with which to sign
+	// or authenticate each request in place of Secret. Validate sets it
+	// from -secrets-file; it is omitted from -admin-config-path.
+	SecretLookup func(r *http.Request) ([]byte, error) `json:"-"`
+
+	DeprecateSigVersions HmacProxyList
+	SigVersionSunset     HmacProxyTime
+
+	Explain bool
+
+	UpstreamIdleTimeout     time.Duration
+	FollowUpstreamRedirects int
+	UpstreamProxyProtocol   string
+	UpstreamClientCert      string
+	UpstreamClientKey       string
+
+	ExposeCapabilities bool
+
+	ExpectContinue string
+
+	HostsConfig string
+	Hosts       map[string]*HmacProxyOpts
+
+	DirAuthConfig string
+	DirAuths      map[string]*HmacProxyOpts
+
+	AuditWebhookURL string
+	AuditSuccesses  bool
+
+	BodyNewline        string
+	MultipartCanonical bool
+
+	MinBodySignBytes int64
+	SortQueryParams  bool
+	QueryDupPolicy   string
+
+	AllowedSigAlgs HmacProxyList
+
+	DynamicSignedHeadersFrom string
+	AllowedSignedHeaders     HmacProxyList
+	RequiredHeaders          HmacProxyList
+	SignatureSources         HmacProxyList
+
+	DelegateAuthURL     string
+	DelegateAuthHeaders HmacProxyList
+
+	MaxHeaders          int
+	MaxHeaderValueBytes int
+	AllowedHosts        HmacProxyList
+	AllowTrace          bool
+	AllowConnect        bool
+
+	SignMethods        HmacProxyList
+	SignExemptPrefixes HmacProxyList
+
+	RewriteRedirects bool
+
+	EmitVia      bool
+	ViaPseudonym string
+
+	DeadLetterDir    string
+	DeadLetterStatus int
+
+	NoncePath   string
+	NonceHeader string
+	NonceTTL    time.Duration
 }
 
 // RegisterCommandLineOptions configures flags to fill in the fields of a new
 // HmacProxyOpts object based on command line options.
 func RegisterCommandLineOptions(flags *flag.FlagSet) (opts *HmacProxyOpts) {
 	opts = &HmacProxyOpts{}
-	flags.IntVar(&opts.Port, "port", 0,
-		"Port on which to listen for requests")
+	flags.Var(&opts.Ports, "port",
+		"Ports on which to listen for requests, comma-separated")
 	flags.BoolVar(&opts.Auth, "auth", false,
 		"Authenticate requests rather than signing them")
 	flags.StringVar(&opts.Digest.Name, "digest", "sha1",
-		"Hash algorithm to use when signing requests")
+		"Hash algorithm to use when signing requests, or auto to "+
+			"negotiate the strongest with the -upstream proxy")
+	flags.StringVar(&opts.MinDigest, "min-digest", "sha256",
+		"Weakest digest -digest=auto may negotiate or accept")
 	flags.StringVar(&opts.Secret, "secret", "",
 		"Secret key")
+	flags.StringVar(&opts.PreviousSecret, "previous-secret", "",
+		"Secret key replaced by -secret, accepted by -auth until "+
+			"-rotation-grace expires")
+	flags.DurationVar(&opts.RotationGrace, "rotation-grace", 0,
+		"How long after -rotated-at to accept -previous-secret")
+	flags.Var(&opts.RotatedAt, "rotated-at",
+		"RFC 3339 time at which -secret replaced -previous-secret; "+
+			"defaults to startup")
+	flags.DurationVar(&opts.KeyRotationInterval, "key-rotation-interval",
+		0, "Sign and authenticate using a key derived from -secret "+
+			"for each interval of this length; -secret itself "+
+			"if zero")
+	flags.StringVar(&opts.SecretsFile, "secrets-file", "",
+		"JSON file mapping each key ID in -key-id-header to the "+
+			"secret with which to sign or authenticate its "+
+			"requests")
+	flags.StringVar(&opts.KeyIDHeader, "key-id-header", "",
+		"Signed header identifying the -secrets-file key for each "+
+			"request")
+	flags.Var(&opts.DeprecateSigVersions, "deprecate-sig-version",
+		"Signature scheme versions whose responses carry a "+
+			"Deprecation header, comma-separated")
+	flags.Var(&opts.SigVersionSunset, "sig-version-sunset",
+		"RFC 3339 time at which the -deprecate-sig-version "+
+			"versions will stop working, sent in a Sunset header")
 	flags.StringVar(&opts.SignHeader, "sign-header", "",
 		"Header containing request signature")
+	flags.Var(&opts.SignMethods, "sign-methods",
+		"Only sign or authenticate requests using these methods, "+
+			"comma-separated; all methods if empty")
+	flags.Var(&opts.SignExemptPrefixes, "sign-exempt-prefix",
+		"Proxy requests for paths beginning with these prefixes "+
+			"without signing them, comma-separated")
 	flags.Var(&opts.Headers, "headers",
-		"Headers to factor into the signature, comma-separated")
+		"Headers to factor into the signature, comma-separated; "+
+			"defaults to "+strings.Join(defaultHeaders, ","))
+	flags.BoolVar(&opts.NoDefaultHeaders, "no-default-headers", false,
+		"Sign no headers when -headers is not specified")
+	flags.BoolVar(&opts.SetDateHeader, "set-date-header", false,
+		"Set the Date header of requests without one before signing")
+	flags.StringVar(&opts.DynamicSignedHeadersFrom,
+		"dynamic-signed-headers-from", "", "Header in which each "+
+			"request lists the headers its signature covers, "+
+			"in place of -headers")
+	flags.Var(&opts.AllowedSignedHeaders, "allowed-signed-headers",
+		"Headers that -dynamic-signed-headers-from may list, "+
+			"comma-separated")
 	flags.StringVar(&opts.Upstream.Raw, "upstream", "",
 		"Signed/authenticated requests are proxied to this server")
+	flags.DurationVar(&opts.UpstreamIdleTimeout, "upstream-idle-timeout",
+		90*time.Second, "Close idle connections to -upstream after "+
+			"this long; never if zero")
+	flags.StringVar(&opts.UpstreamProxyProtocol, "upstream-proxy-protocol",
+		"", "Send each client's address to -upstream in a PROXY "+
+			"protocol header of this version: v1 or v2")
+	flags.StringVar(&opts.UpstreamClientCert, "upstream-client-cert", "",
+		"Certificate to present to -upstream over HTTPS, reloaded "+
+			"when it changes")
+	flags.StringVar(&opts.UpstreamClientKey, "upstream-client-key", "",
+		"Private key for -upstream-client-cert")
+	flags.IntVar(&opts.FollowUpstreamRedirects,
+		"follow-upstream-redirects", 0, "Follow up to this many "+
+			"redirects from -upstream to the same host, rather "+
+			"than returning them")
+	flags.BoolVar(&opts.RewriteRedirects, "rewrite-redirects", false,
+		"Rewrite redirects to the -upstream host to point to the "+
+			"proxy instead")
+	flags.BoolVar(&opts.EmitVia, "emit-via", false,
+		"Add the proxy to the Via header of requests to -upstream "+
+			"and of its responses")
+	flags.StringVar(&opts.ViaPseudonym, "via-pseudonym", "hmacproxy",
+		"Name by which -emit-via identifies the proxy")
+	flags.StringVar(&opts.DeadLetterDir, "dead-letter-dir", "",
+		"Directory in which to save requests that could not be sent "+
+			"to -upstream")
+	flags.IntVar(&opts.DeadLetterStatus, "dead-letter-status",
+		http.StatusBadGateway, "HTTP status code to return for "+
+			"requests saved to -dead-letter-dir")
+	flags.StringVar(&opts.ExpectContinue, "expect-continue",
+		ExpectContinueRespond, "How to handle Expect: 100-continue "+
+			"when proxying: respond or forward")
+	flags.StringVar(&opts.HostsConfig, "hosts-config", "",
+		"JSON file mapping each Host to the upstream, secret, and "+
+			"headers with which to sign its requests")
 	flags.StringVar(&opts.FileRoot, "file-root", "",
 		"Root of file system from which to serve documents")
+	flags.StringVar(&opts.DirAuthConfig, "dir-auth-config", "",
+		"JSON file mapping directories under -file-root to the "+
+			"secret, digest, and headers with which to "+
+			"authenticate requests for their files")
+	flags.Var(&opts.PublicPaths, "public-paths",
+		"Paths under -file-root to serve without authentication, "+
+			"comma-separated")
+	flags.BoolVar(&opts.AllowArchive, "allow-archive", false,
+		"Serve gzipped tarballs of directories under -file-root "+
+			"requested with ?archive=tar.gz")
 	flags.StringVar(&opts.SslCert, "ssl-cert", "",
 		"Path to the server's SSL certificate")
 	flags.StringVar(&opts.SslKey, "ssl-key", "",
 		"Path to the key for -ssl-cert")
+	flags.IntVar(&opts.MaxConnections, "max-connections", 0,
+		"Maximum number of simultaneous client connections; "+
+			"unlimited if zero")
+	flags.IntVar(&opts.MaxConnsPerIP, "max-conns-per-ip", 0,
+		"Maximum number of simultaneous connections from each client "+
+			"IP address; unlimited if zero")
+	flags.DurationVar(&opts.ReadHeaderTimeout, "read-header-timeout", 0,
+		"Close connections that don't send complete request headers "+
+			"within this long, logging each; unlimited if zero")
+	flags.DurationVar(&opts.TLSSessionMaxAge, "tls-session-max-age", 0,
+		"Rotate TLS session ticket keys at this interval, limiting "+
+			"how long sessions may be resumed")
+	flags.Var(&opts.TLSALPN, "tls-alpn", "Comma-separated ALPN "+
+		"protocols to offer TLS clients, in order of preference "+
+		"(default h2,http/1.1)")
+	flags.IntVar(&opts.RedirectHTTPPort, "redirect-http-port", 0,
+		"Port on which to redirect plaintext requests to HTTPS on "+
+			"the first -port")
+	flags.BoolVar(&opts.ExposeCapabilities, "expose-capabilities", false,
+		"Describe the signing configuration as JSON at "+
+			capabilitiesPath)
+	flags.BoolVar(&opts.Explain, "explain", false,
+		"Explain on standard error how the options select a mode")
+	flags.BoolVar(&opts.ErrorsJSON, "errors-json", false,
+		"Report invalid options as a JSON array on standard error")
+	flags.StringVar(&opts.HealthPath, "health-path", "",
+		"Path at which to answer health checks without authentication")
+	flags.StringVar(&opts.AdminConfigPath, "admin-config-path", "",
+		"Path at which to serve the redacted configuration to "+
+			"signed GET requests from -admin-allowed-ips")
+	flags.Var(&opts.AdminAllowedIPs, "admin-allowed-ips", "IP addresses "+
+		"and CIDR networks allowed to request -admin-config-path, "+
+		"comma-separated")
+	flags.BoolVar(&opts.ConfigHash, "config-hash", false,
+		"Log a hash of the redacted configuration at startup, and "+
+			"send it in an X-Config-Hash header with health checks")
+	flags.BoolVar(&opts.EnableDebugCanonical, "enable-debug-canonical",
+		false, "Answer POST requests for "+debugCanonicalPath+
+			" from -debug-allowed-ips with the string to sign and "+
+			"signature of the HTTP request in the body")
+	flags.Var(&opts.DebugAllowedIPs, "debug-allowed-ips", "IP addresses "+
+		"and CIDR networks allowed to use -enable-debug-canonical, "+
+		"comma-separated")
+	flags.BoolVar(&opts.HealthIncludesUpstream,
+		"health-includes-upstream", false,
+		"Report unhealthy when the -upstream server is unreachable")
+	flags.StringVar(&opts.HealthBody, "health-body", "ok",
+		"Body of healthy responses to -health-path")
+	flags.StringVar(&opts.HealthContentType, "health-content-type",
+		"text/plain; charset=utf-8",
+		"Content type of healthy responses to -health-path")
+	flags.BoolVar(&opts.HealthDetail, "health-detail", false,
+		"Respond to -health-path with JSON detailing the status of "+
+			"each dependency")
+	flags.StringVar(&opts.HealthSecret, "health-secret", "",
+		"Token that health checks must send in an "+healthTokenHeader+
+			" header; none if empty")
+	flags.StringVar(&opts.DrainFile, "drain-file", "",
+		"Report unhealthy and close client connections while "+
+			"this file exists")
+	flags.DurationVar(&opts.AuthTimeout, "auth-timeout", 0,
+		"Maximum time to spend authenticating a request in -auth "+
+			"only mode; unlimited if zero")
+	flags.IntVar(&opts.AuthTimeoutStatus, "auth-timeout-status",
+		http.StatusInternalServerError,
+		"HTTP status code to return when -auth-timeout is exceeded")
+	flags.Var(&opts.SignatureSources, "signature-source", "Places to "+
+		"look for the signature of authenticated requests, in order "+
+		"of precedence: header (-sign-header), authorization, "+
+		"cookie:NAME, or query:NAME, comma-separated; only "+
+		"-sign-header if empty")
+	flags.Var(&opts.RequiredHeaders, "required-headers", "Signed headers "+
+		"that requests must include, comma-separated; requests "+
+		"missing one receive 428 Precondition Required")
+	flags.IntVar(&opts.MaxHeaders, "max-headers", 100,
+		"Maximum number of distinct headers in a request")
+	flags.IntVar(&opts.MaxHeaderValueBytes, "max-header-value-bytes", 0,
+		"Maximum combined size of the values of each signed header; "+
+			"unlimited if zero")
+	flags.Var(&opts.AllowedHosts, "allowed-hosts", "Host headers to "+
+		"accept, comma-separated; all if not specified")
+	flags.BoolVar(&opts.AllowTrace, "allow-trace", false,
+		"Handle TRACE requests rather than rejecting them")
+	flags.BoolVar(&opts.AllowConnect, "allow-connect", false,
+		"Authenticate CONNECT requests for a forward proxy rather "+
+			"than rejecting them; requires -auth without "+
+			"-upstream or -file-root")
+	flags.BoolVar(&opts.DenyHeaderInjection, "deny-header-injection",
+		false, "Reject requests containing more than one of any "+
+			"signed header")
+	flags.Var(&opts.AllowedSigAlgs, "allowed-sig-algs", "Digests that "+
+		"requests may select in the signed "+sigAlgHeader+" header, "+
+		"comma-separated")
+	flags.BoolVar(&opts.AllowWeakDigest, "i-know-md5-is-weak", false,
+		"Suppress the startup warning for md5 and sha1 digests")
+	flags.StringVar(&opts.TransformCmd, "transform-cmd", "",
+		"Program that rewrites the headers of proxied requests")
+	flags.DurationVar(&opts.TransformTimeout, "transform-timeout",
+		time.Second, "Maximum time to wait for -transform-cmd")
+	flags.BoolVar(&opts.SignaturePrefixAlgo, "signature-prefix-algo",
+		false, "Format signatures as <digest>=<hex> rather than "+
+			"<digest> <base64>")
+	flags.StringVar(&opts.BodyNewline, "body-newline", BodyNewlinePreserve,
+		"Line endings to which to convert request bodies before "+
+			"signing or authenticating: preserve, lf, or crlf")
+	flags.BoolVar(&opts.MultipartCanonical, "multipart-canonical", false,
+		"Sign and authenticate multipart/form-data bodies in a "+
+			"canonical form, so that parts may be sent in any order")
+	flags.Int64Var(&opts.MinBodySignBytes, "min-body-sign-bytes", 0,
+		"Sign and authenticate request bodies shorter than this many "+
+			"bytes as if they were empty, leaving them "+
+			"unauthenticated")
+	flags.BoolVar(&opts.SortQueryParams, "sort-query-params", false,
+		"Sort query parameters before signing or authenticating, so "+
+			"that they may be sent in any order")
+	flags.StringVar(&opts.QueryDupPolicy, "query-dup-policy",
+		QueryDupPolicyPreserve, "How to order the values of repeated "+
+			"query parameters before signing or authenticating: "+
+			"preserve or sort")
+	flags.StringVar(&opts.WebhookPreset, "webhook-preset", "",
+		"Sign or authenticate requests using a webhook provider's "+
+			"scheme: github or stripe")
+	flags.StringVar(&opts.BatchMode, "batch-mode", "",
+		"Authenticate each signed item of a JSON batch: reject, to "+
+			"reject batches containing any invalid item, or "+
+			"filter, to proxy only the valid items")
+	flags.StringVar(&opts.AuthFailure, "auth-failure", AuthFailureBlock,
+		"What to do with requests that fail authentication before "+
+			"proxying: block or passthrough")
+	flags.StringVar(&opts.WWWAuthenticate, "www-authenticate", "",
+		"WWW-Authenticate challenge to send with 401 Unauthorized "+
+			"responses, e.g. 'HMAC realm=\"api\"'")
+	flags.DurationVar(&opts.AuthFailureDelay, "auth-failure-delay", 0,
+		"Delay 401 Unauthorized responses by between this and twice "+
+			"this, at random")
+	flags.StringVar(&opts.AuditWebhookURL, "audit-webhook-url", "",
+		"URL to which to POST a JSON event for each request that "+
+			"fails authentication")
+	flags.BoolVar(&opts.AuditSuccesses, "audit-successes", false,
+		"Also POST -audit-webhook-url events for requests that pass "+
+			"authentication")
+	flags.StringVar(&opts.DelegateAuthURL, "delegate-auth-url", "",
+		"URL of a service that must also approve each authenticated "+
+			"request with a 2xx status")
+	flags.Var(&opts.DelegateAuthHeaders, "delegate-auth-headers",
+		"Request headers to pass to -delegate-auth-url, "+
+			"comma-separated")
+	flags.StringVar(&opts.ErrorFormat, "error-format", ErrorFormatText,
+		"Format of error responses generated by the proxy: text, or "+
+			"problem for RFC 7807 application/problem+json")
+	flags.StringVar(&opts.LogFormat, "log-format", "",
+		"Format of access log lines written to standard output: "+
+			"combined, combined-timing, or logfmt; disabled if "+
+			"empty")
+	flags.BoolVar(&opts.LogClientDisconnects, "log-client-disconnects",
+		false, "Log requests abandoned by clients that disconnected "+
+			"before the proxy responded")
+	flags.IntVar(&opts.LogBuffer, "log-buffer", 0,
+		"Queue up to this many access log lines, writing them in "+
+			"batches; written immediately if zero")
+	flags.StringVar(&opts.EventSocket, "event-socket", "",
+		"Unix socket to which to write a JSON event for each request, "+
+			"for a local collector; disabled if empty")
+	flags.StringVar(&opts.EventSocketType, "event-socket-type", "stream",
+		"Type of -event-socket: stream or datagram")
+	flags.IntVar(&opts.EventBuffer, "event-buffer", 1000,
+		"Queue up to this many events for -event-socket, dropping "+
+			"events while the queue is full")
+	flags.StringVar(&opts.NoncePath, "nonce-path", "",
+		"Path at which to issue single-use nonces that authenticated "+
+			"requests must include")
+	flags.StringVar(&opts.NonceHeader, "nonce-header", "X-Nonce",
+		"Header containing the nonce from -nonce-path; must be one "+
+			"of -headers")
+	flags.DurationVar(&opts.NonceTTL, "nonce-ttl", time.Minute,
+		"How long a nonce from -nonce-path remains valid")
 	return
 }
 
 // Validate ensures that the HmacProxyOpts configuration is correct and parses
 // some of the values into a useable format. It also sets the Mode member that
 // determines which proxy handler to launch. Collects as many error messages
-// as possible and returns them as a single string via the err return value.
+// as possible and returns them as a *ValidationError via the err return
+// value.
 func (opts *HmacProxyOpts) Validate() (err error) {
 	var msgs []string
 	msgs = validateMode(opts, msgs)
 	msgs = validatePort(opts, msgs)
+	msgs = validateWebhookPreset(opts, msgs)
+	msgs = validateBatchMode(opts, msgs)
+	msgs = validateHeaders(opts, msgs)
+	msgs = validateDynamicSignedHeaders(opts, msgs)
+	msgs = validateRequiredHeaders(opts, msgs)
+	msgs = validateSignatureSources(opts, msgs)
+	msgs = validateSecretsFile(opts, msgs)
 	msgs = validateAuthParams(opts, msgs)
+	msgs = validateRotation(opts, msgs)
+	msgs = validateKeyRotationInterval(opts, msgs)
+	msgs = validateDeprecation(opts, msgs)
 	msgs = validateUpstream(opts, msgs)
+	msgs = validateHosts(opts, msgs)
 	msgs = validateFileRoot(opts, msgs)
+	msgs = validateDirAuth(opts, msgs)
 	msgs = validateSsl(opts, msgs)
+	msgs = validateHealth(opts, msgs)
+	msgs = validateAdminConfig(opts, msgs)
+	msgs = validateDebugCanonical(opts, msgs)
+	msgs = validateAuthTimeout(opts, msgs)
+	msgs = validateTransform(opts, msgs)
+	msgs = validateAuthFailure(opts, msgs)
+	msgs = validateLogFormat(opts, msgs)
+	msgs = validateAudit(opts, msgs)
+	msgs = validateDelegateAuth(opts, msgs)
+	msgs = validateMaxHeaders(opts, msgs)
+	msgs = validateAllowConnect(opts, msgs)
+	msgs = validateDeadLetter(opts, msgs)
+	msgs = validateNonce(opts, msgs)
 
 	if len(msgs) != 0 {
-		err = errors.New("Invalid options:\n  " +
-			strings.Join(msgs, "\n  "))
+		err = &ValidationError{msgs}
 	}
 	return
 }
 
+// ValidationError contains every message collected by
+// HmacProxyOpts.Validate.
+type ValidationError struct {
+	Msgs []string
+}
+
+// Error returns all of the validation messages as a single string.
+func (e *ValidationError) Error() string {
+	return "Invalid options:\n  " + strings.Join(e.Msgs, "\n  ")
+}
+
+// MarshalJSON encodes the validation messages as a JSON array of strings.
+func (e *ValidationError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.Msgs)
+}
+
 // HmacProxyHeaders defines a []string that can be used with
 // flag.FlagSet.Var() to parse the comma-separated command line values into
 // the slice.
@@ -90,6 +540,22 @@ func (hph *HmacProxyHeaders) Set(s string) error {
 	return nil
 }
 
+// HmacProxyList defines a []string that can be used with flag.FlagSet.Var()
+// to parse comma-separated command line values into the slice.
+type HmacProxyList []string
+
+// String returns a string representation of HmacProxyList.
+func (hpl *HmacProxyList) String() string {
+	return strings.Join(*hpl, ",")
+}
+
+// Set parses comma-separated values from the input string into the
+// HmacProxyList instance.
+func (hpl *HmacProxyList) Set(s string) error {
+	*hpl = strings.Split(s, ",")
+	return nil
+}
+
 // HmacProxyMode specifies the type of handler to return from
 // NewHTTPProxyHandler.
 type HmacProxyMode int
@@ -112,11 +578,74 @@ const (
 	HandlerAuthOnly
 )
 
+const (
+	// AuthFailureBlock responds to requests that fail authentication
+	// with 401 Unauthorized
+	AuthFailureBlock = "block"
+
+	// AuthFailurePassthrough proxies requests that fail authentication to
+	// the upstream server, which must then enforce its own authentication
+	AuthFailurePassthrough = "passthrough"
+)
+
+const (
+	// ExpectContinueRespond answers Expect: 100-continue on behalf of the
+	// upstream server, removing the header from proxied requests
+	ExpectContinueRespond = "respond"
+
+	// ExpectContinueForward passes Expect: 100-continue through to the
+	// upstream server
+	ExpectContinueForward = "forward"
+)
+
+const (
+	// BatchModeReject rejects batches containing any item that fails
+	// authentication
+	BatchModeReject = "reject"
+
+	// BatchModeFilter removes items that fail authentication from
+	// batches before proxying them
+	BatchModeFilter = "filter"
+)
+
+const (
+	// ErrorFormatText responds to errors with a text/plain message
+	ErrorFormatText = "text"
+
+	// ErrorFormatProblem responds to errors with an RFC 7807
+	// application/problem+json document
+	ErrorFormatProblem = "problem"
+)
+
+const (
+	// BodyNewlinePreserve signs request bodies as they are
+	BodyNewlinePreserve = "preserve"
+
+	// BodyNewlineLF converts "\r\n" to "\n" in request bodies before
+	// signing them
+	BodyNewlineLF = "lf"
+
+	// BodyNewlineCRLF converts "\n" to "\r\n" in request bodies before
+	// signing them
+	BodyNewlineCRLF = "crlf"
+)
+
+const (
+	// QueryDupPolicyPreserve signs the values of repeated query
+	// parameters in the order in which they are sent
+	QueryDupPolicyPreserve = "preserve"
+
+	// QueryDupPolicySort sorts the values of repeated query parameters
+	// before signing them
+	QueryDupPolicySort = "sort"
+)
+
 func validateMode(opts *HmacProxyOpts, msgs []string) []string {
 	upstreamDefined := opts.Upstream.Raw != ""
 	fileRootDefined := opts.FileRoot != ""
 
-	if !(upstreamDefined || fileRootDefined || opts.Auth) {
+	if !(upstreamDefined || fileRootDefined || opts.Auth ||
+		opts.HostsConfig != "") {
 		msgs = append(msgs, "neither -upstream, -file-root, "+
 			"nor -auth specified")
 	} else if upstreamDefined && fileRootDefined {
@@ -138,11 +667,102 @@ func validateMode(opts *HmacProxyOpts, msgs []string) []string {
 	return msgs
 }
 
+// modeNames maps each HmacProxyMode to the name used by ExplainMode.
+var modeNames = map[HmacProxyMode]string{
+	HandlerSignAndProxy: "sign-and-proxy",
+	HandlerAuthAndProxy: "auth-and-proxy",
+	HandlerAuthForFiles: "auth-for-files",
+	HandlerAuthOnly:     "auth-only",
+}
+
+// ExplainMode returns a step-by-step explanation of how validateMode chose
+// opts.Mode from -auth, -upstream, and -file-root, one step per line. It
+// must be called after Validate.
+func (opts *HmacProxyOpts) ExplainMode() string {
+	isSet := func(option string, set bool) string {
+		if set {
+			return option + " is set"
+		}
+		return option + " is not set"
+	}
+	upstreamDefined := opts.Upstream.Raw != ""
+	fileRootDefined := opts.FileRoot != ""
+	steps := []string{
+		isSet("-auth", opts.Auth),
+		isSet("-upstream", upstreamDefined),
+		isSet("-file-root", fileRootDefined),
+	}
+
+	if !opts.Auth {
+		steps = append(steps, "without -auth, requests are signed "+
+			"and proxied to -upstream")
+	} else if upstreamDefined {
+		steps = append(steps, "with -auth and -upstream, requests "+
+			"are authenticated and proxied to -upstream")
+	} else if fileRootDefined {
+		steps = append(steps, "with -auth and -file-root, requests "+
+			"are authenticated and served from -file-root")
+	} else {
+		steps = append(steps, "with -auth alone, requests are "+
+			"answered Accepted or Unauthorized")
+	}
+	steps = append(steps, "mode: "+modeNames[opts.Mode])
+	return strings.Join(steps, "\n") + "\n"
+}
+
+// HmacProxyPorts defines a []int that can be used with flag.FlagSet.Var() to
+// parse comma-separated port numbers from the command line into the slice.
+type HmacProxyPorts []int
+
+// String returns a string representation of HmacProxyPorts.
+func (hpp *HmacProxyPorts) String() string {
+	ports := make([]string, len(*hpp))
+	for i, port := range *hpp {
+		ports[i] = strconv.Itoa(port)
+	}
+	return strings.Join(ports, ",")
+}
+
+// Set parses comma-separated port numbers from the input string into the
+// HmacProxyPorts instance.
+func (hpp *HmacProxyPorts) Set(s string) error {
+	var ports HmacProxyPorts
+	for _, value := range strings.Split(s, ",") {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("invalid port: " + value)
+		}
+		ports = append(ports, port)
+	}
+	*hpp = ports
+	return nil
+}
+
 func validatePort(opts *HmacProxyOpts, msgs []string) []string {
-	if opts.Port <= 0 {
+	valid := len(opts.Ports) != 0
+	seen := make(map[int]bool)
+	for _, port := range opts.Ports {
+		if port <= 0 {
+			valid = false
+		} else if seen[port] {
+			msgs = append(msgs, "port specified more than once: "+
+				strconv.Itoa(port))
+		}
+		seen[port] = true
+	}
+	if !valid {
 		msgs = append(msgs, "port must be specified and "+
 			"greater than zero")
 	}
+	if opts.MaxConnections < 0 {
+		msgs = append(msgs, "max-connections must not be negative")
+	}
+	if opts.MaxConnsPerIP < 0 {
+		msgs = append(msgs, "max-conns-per-ip must not be negative")
+	}
+	if opts.ReadHeaderTimeout < 0 {
+		msgs = append(msgs, "read-header-timeout must not be negative")
+	}
 	return msgs
 }
 
@@ -153,18 +773,447 @@ type HmacProxyDigest struct {
 	ID   crypto.Hash
 }
 
+// weakDigests are hash algorithms supported for compatibility that should no
+// longer be chosen for new deployments.
+var weakDigests = map[crypto.Hash]bool{
+	crypto.MD4:  true,
+	crypto.MD5:  true,
+	crypto.SHA1: true,
+}
+
+// WarnIfWeakDigest logs a warning to logger if opts.Digest is a weak hash
+// algorithm, unless the warning has been suppressed with -i-know-md5-is-weak.
+// It should only be called after Validate succeeds.
+func (opts *HmacProxyOpts) WarnIfWeakDigest(logger *log.Logger) {
+	if weakDigests[opts.Digest.ID] && !opts.AllowWeakDigest {
+		logger.Printf("WARNING: the %s digest is weak; use sha256 or "+
+			"stronger if possible, or pass -i-know-md5-is-weak "+
+			"to silence this warning", opts.Digest.Name)
+	}
+}
+
+// validateBatchMode ensures that -batch-mode is only combined with options
+// that apply to each item of a batch.
+func validateBatchMode(opts *HmacProxyOpts, msgs []string) []string {
+	switch opts.BatchMode {
+	case "":
+		return msgs
+	case BatchModeReject, BatchModeFilter:
+	default:
+		msgs = append(msgs, "invalid batch-mode: "+opts.BatchMode)
+	}
+	if !opts.Auth || opts.Upstream.Raw == "" {
+		msgs = append(msgs, "batch-mode requires -auth and -upstream")
+	}
+	if opts.WebhookPreset != "" || opts.HostsConfig != "" ||
+		opts.DirAuthConfig != "" {
+		msgs = append(msgs, "batch-mode cannot be combined with "+
+			"-webhook-preset, -hosts-config, or -dir-auth-config")
+	}
+	if opts.Digest.Name == digestAuto {
+		msgs = append(msgs, "batch-mode cannot be combined with "+
+			"-digest=auto")
+	}
+	// batchHandler checks each item's signature itself, so options that
+	// apply to the signature header of the batch request would be ignored.
+	unsupported := []struct {
+		name string
+		set  bool
+	}{
+		{"previous-secret", opts.PreviousSecret != ""},
+		{"key-rotation-interval", opts.KeyRotationInterval != 0},
+		{"sign-methods", len(opts.SignMethods) != 0},
+		{"nonce-path", opts.NoncePath != ""},
+		{"audit-webhook-url", opts.AuditWebhookURL != ""},
+		{"www-authenticate", opts.WWWAuthenticate != ""},
+		{"auth-failure-delay", opts.AuthFailureDelay != 0},
+		{"delegate-auth-url", opts.DelegateAuthURL != ""},
+		{"allowed-sig-algs", len(opts.AllowedSigAlgs) != 0},
+		{"required-headers", len(opts.RequiredHeaders) != 0},
+		{"dynamic-signed-headers-from",
+			opts.DynamicSignedHeadersFrom != ""},
+	}
+	for _, option := range unsupported {
+		if option.set {
+			msgs = append(msgs, "batch-mode cannot be combined "+
+				"with -"+option.name)
+		}
+	}
+	return msgs
+}
+
+// validateWebhookPreset sets the digest and signature header for
+// opts.WebhookPreset, if specified.
+func validateWebhookPreset(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.WebhookPreset == "" {
+		return msgs
+	}
+	preset, ok := webhookPresets[opts.WebhookPreset]
+	if !ok {
+		return append(msgs, "unknown webhook-preset: "+
+			opts.WebhookPreset)
+	}
+	if opts.SignHeader != "" && http.CanonicalHeaderKey(
+		opts.SignHeader) != preset.signHeader {
+		msgs = append(msgs, "webhook-preset "+opts.WebhookPreset+
+			" requires -sign-header="+preset.signHeader)
+	}
+	if len(opts.Headers) != 0 || opts.SignaturePrefixAlgo ||
+		opts.BodyNewline != BodyNewlinePreserve {
+		msgs = append(msgs, "webhook-preset cannot be combined with "+
+			"-headers, -signature-prefix-algo, or -body-newline")
+	}
+	if opts.MinBodySignBytes != 0 || opts.SortQueryParams ||
+		opts.QueryDupPolicy != QueryDupPolicyPreserve {
+		msgs = append(msgs, "webhook-preset cannot be combined with "+
+			"-min-body-sign-bytes, -sort-query-params, or "+
+			"-query-dup-policy")
+	}
+	if opts.MultipartCanonical {
+		msgs = append(msgs, "webhook-preset cannot be combined with "+
+			"-multipart-canonical")
+	}
+	opts.SignHeader = preset.signHeader
+	opts.Digest.Name = "sha256"
+	return msgs
+}
+
+// defaultHeaders are the headers factored into the signature when -headers is
+// not specified. Signing and authenticating proxies must agree on the signed
+// headers, so the defaults are the same in every mode.
+var defaultHeaders = []string{"Content-Type", "Date"}
+
+// validateHeaders applies defaultHeaders when neither -headers nor
+// -no-default-headers is specified, and ensures that the Date header set by
+// -set-date-header is signed.
+func validateHeaders(opts *HmacProxyOpts, msgs []string) []string {
+	if len(opts.Headers) == 0 && !opts.NoDefaultHeaders &&
+		opts.WebhookPreset == "" {
+		opts.Headers = append(HmacProxyHeaders(nil), defaultHeaders...)
+	}
+	if !opts.SetDateHeader {
+		return msgs
+	}
+	if opts.Auth {
+		msgs = append(msgs, "set-date-header cannot be combined "+
+			"with -auth")
+	}
+	dateSigned := false
+	for _, header := range opts.Headers {
+		if http.CanonicalHeaderKey(header) == "Date" {
+			dateSigned = true
+		}
+	}
+	if !dateSigned {
+		msgs = append(msgs, "set-date-header requires Date in -headers")
+	}
+	return msgs
+}
+
+func validateDynamicSignedHeaders(opts *HmacProxyOpts,
+	msgs []string) []string {
+	if opts.DynamicSignedHeadersFrom == "" {
+		if len(opts.AllowedSignedHeaders) != 0 {
+			msgs = append(msgs, "allowed-signed-headers requires "+
+				"-dynamic-signed-headers-from")
+		}
+		return msgs
+	}
+	if len(opts.AllowedSignedHeaders) == 0 {
+		msgs = append(msgs, "dynamic-signed-headers-from requires "+
+			"-allowed-signed-headers")
+	}
+	if opts.WebhookPreset != "" {
+		msgs = append(msgs, "dynamic-signed-headers-from cannot be "+
+			"combined with -webhook-preset")
+	}
+	if opts.Auth {
+		return msgs
+	}
+	// Signing proxies list the -headers in requests that list none, so
+	// each must be allowed.
+	allowed := make(map[string]bool)
+	for _, header := range opts.AllowedSignedHeaders {
+		allowed[http.CanonicalHeaderKey(header)] = true
+	}
+	for _, header := range opts.Headers {
+		if !allowed[http.CanonicalHeaderKey(header)] {
+			msgs = append(msgs, "headers must be listed in "+
+				"-allowed-signed-headers: "+header)
+		}
+	}
+	return msgs
+}
+
+// validateRequiredHeaders ensures that each of -required-headers is signed,
+// and that requests missing one would otherwise be rejected.
+func validateRequiredHeaders(opts *HmacProxyOpts, msgs []string) []string {
+	if len(opts.RequiredHeaders) == 0 {
+		return msgs
+	}
+	if !opts.Auth {
+		msgs = append(msgs, "required-headers requires -auth")
+	}
+	if opts.AuthFailure == AuthFailurePassthrough ||
+		len(opts.PublicPaths) != 0 {
+		msgs = append(msgs, "required-headers cannot be combined "+
+			"with -auth-failure=passthrough or -public-paths")
+	}
+	signed := make(map[string]bool)
+	for _, list := range [][]string{opts.Headers,
+		opts.AllowedSignedHeaders} {
+		for _, header := range list {
+			signed[http.CanonicalHeaderKey(header)] = true
+		}
+	}
+	for _, header := range opts.RequiredHeaders {
+		if !signed[http.CanonicalHeaderKey(header)] {
+			msgs = append(msgs, "required-headers contains an "+
+				"unsigned header: "+header)
+		}
+	}
+	return msgs
+}
+
+// validateSignatureSources ensures that each of -signature-source is valid
+// and listed once, and that it applies to authenticated requests.
+func validateSignatureSources(opts *HmacProxyOpts, msgs []string) []string {
+	if len(opts.SignatureSources) == 0 {
+		return msgs
+	}
+	if !opts.Auth {
+		msgs = append(msgs, "signature-source requires -auth")
+	}
+	if opts.WebhookPreset != "" || opts.BatchMode != "" {
+		msgs = append(msgs, "signature-source cannot be combined "+
+			"with -webhook-preset or -batch-mode")
+	}
+	listed := make(map[signatureSource]bool)
+	for _, entry := range opts.SignatureSources {
+		source, err := parseSignatureSource(entry)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		} else if listed[source] {
+			msgs = append(msgs, "signature-source lists "+entry+
+				" more than once")
+		}
+		listed[source] = true
+	}
+	return msgs
+}
+
+// validateDigestAuto ensures that a proxy using -digest=auto can learn or
+// advertise the digests it supports.
+func validateDigestAuto(opts *HmacProxyOpts, msgs []string) []string {
+	minSupported := false
+	for _, name := range autoDigests {
+		minSupported = minSupported || name == opts.MinDigest
+	}
+	if !minSupported {
+		msgs = append(msgs, "min-digest must be one of: "+
+			strings.Join(autoDigests, ", "))
+	}
+	if opts.Auth && !opts.ExposeCapabilities {
+		msgs = append(msgs, "digest=auto requires -expose-capabilities "+
+			"with -auth")
+	} else if !opts.Auth && opts.Upstream.Raw == "" &&
+		opts.HostsConfig == "" {
+		msgs = append(msgs, "digest=auto requires -upstream")
+	}
+	return msgs
+}
+
+// validateSigAlgs ensures that the -allowed-sig-algs are supported and
+// that the sigAlgHeader is signed.
+func validateSigAlgs(opts *HmacProxyOpts, msgs []string) []string {
+	if len(opts.AllowedSigAlgs) == 0 {
+		return msgs
+	}
+	if opts.Digest.Name == digestAuto {
+		msgs = append(msgs, "allowed-sig-algs cannot be combined with "+
+			"-digest=auto")
+	}
+	if opts.WebhookPreset != "" {
+		msgs = append(msgs, "allowed-sig-algs cannot be combined with "+
+			"-webhook-preset")
+	}
+	for _, name := range opts.AllowedSigAlgs {
+		if _, err := hmacauth.DigestNameToCryptoHash(name); err != nil {
+			msgs = append(msgs, "unsupported allowed-sig-algs "+
+				"digest: "+name)
+		}
+	}
+	for _, header := range opts.Headers {
+		if http.CanonicalHeaderKey(header) == sigAlgHeader {
+			return msgs
+		}
+	}
+	opts.Headers = append(opts.Headers, sigAlgHeader)
+	return msgs
+}
+
 func validateAuthParams(opts *HmacProxyOpts, msgs []string) []string {
 	var err error
-	opts.Digest.ID, err = hmacauth.DigestNameToCryptoHash(opts.Digest.Name)
-	if err != nil {
+	if opts.Digest.Name == digestAuto {
+		msgs = validateDigestAuto(opts, msgs)
+	} else if opts.Digest.ID, err = hmacauth.DigestNameToCryptoHash(
+		opts.Digest.Name); err != nil {
 		msgs = append(msgs, "unsupported digest: "+opts.Digest.Name)
 	}
-	if opts.Secret == "" {
+	msgs = validateSigAlgs(opts, msgs)
+	if opts.Secret == "" && opts.HostsConfig == "" &&
+		opts.SecretLookup == nil {
 		msgs = append(msgs, "no secret specified")
 	}
-	if opts.SignHeader == "" {
+	if opts.SignHeader == "" && opts.BatchMode == "" {
 		msgs = append(msgs, "no signature header specified")
 	}
+	for i, method := range opts.SignMethods {
+		opts.SignMethods[i] = strings.ToUpper(method)
+		if method == "" {
+			msgs = append(msgs, "sign-methods contains an empty "+
+				"method")
+		}
+	}
+	if len(opts.SignExemptPrefixes) != 0 && opts.Auth {
+		msgs = append(msgs, "sign-exempt-prefix cannot be combined "+
+			"with -auth")
+	}
+	for _, prefix := range opts.SignExemptPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			msgs = append(msgs, "sign-exempt-prefix must begin "+
+				"with '/': "+prefix)
+		}
+	}
+	switch opts.BodyNewline {
+	case BodyNewlinePreserve, BodyNewlineLF, BodyNewlineCRLF:
+	default:
+		msgs = append(msgs, "invalid body-newline: "+opts.BodyNewline)
+	}
+	if opts.MinBodySignBytes < 0 {
+		msgs = append(msgs, "min-body-sign-bytes must not be negative")
+	}
+	switch opts.QueryDupPolicy {
+	case QueryDupPolicyPreserve, QueryDupPolicySort:
+	default:
+		msgs = append(msgs, "invalid query-dup-policy: "+
+			opts.QueryDupPolicy)
+	}
+	return msgs
+}
+
+// HmacProxyTime defines a time.Time that can be used with flag.FlagSet.Var()
+// to parse an RFC 3339 time from the command line.
+type HmacProxyTime struct {
+	time.Time
+}
+
+// String returns the time in RFC 3339 format, or "" if it is unset.
+func (hpt *HmacProxyTime) String() string {
+	if hpt.IsZero() {
+		return ""
+	}
+	return hpt.Format(time.RFC3339)
+}
+
+// Set parses an RFC 3339 time from the input string.
+func (hpt *HmacProxyTime) Set(s string) (err error) {
+	hpt.Time, err = time.Parse(time.RFC3339, s)
+	return
+}
+
+func validateDeprecation(opts *HmacProxyOpts, msgs []string) []string {
+	for _, version := range opts.DeprecateSigVersions {
+		if _, ok := canonicalizationStrategies[version]; !ok {
+			msgs = append(msgs, "unknown deprecate-sig-version: "+
+				version)
+		}
+	}
+	if !opts.SigVersionSunset.IsZero() &&
+		len(opts.DeprecateSigVersions) == 0 {
+		msgs = append(msgs, "sig-version-sunset requires "+
+			"-deprecate-sig-version")
+	}
+	return msgs
+}
+
+func validateRotation(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.PreviousSecret == "" {
+		if opts.RotationGrace != 0 || !opts.RotatedAt.IsZero() {
+			msgs = append(msgs, "rotation-grace and rotated-at "+
+				"require -previous-secret")
+		}
+		return msgs
+	}
+	if !opts.Auth {
+		msgs = append(msgs, "previous-secret requires -auth")
+	}
+	if opts.PreviousSecret == opts.Secret {
+		msgs = append(msgs, "previous-secret must differ from -secret")
+	}
+	if opts.RotationGrace <= 0 {
+		msgs = append(msgs, "previous-secret requires a "+
+			"-rotation-grace greater than zero")
+	}
+	if opts.RotatedAt.IsZero() {
+		opts.RotatedAt.Time = time.Now()
+	}
+	return msgs
+}
+
+func validateSecretsFile(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.SecretsFile == "" {
+		if opts.KeyIDHeader != "" {
+			msgs = append(msgs, "key-id-header requires "+
+				"-secrets-file")
+		}
+		return msgs
+	}
+	if opts.Secret != "" || opts.PreviousSecret != "" ||
+		opts.HostsConfig != "" || opts.DirAuthConfig != "" ||
+		opts.BatchMode != "" {
+		msgs = append(msgs, "secrets-file cannot be combined with "+
+			"-secret, -previous-secret, -hosts-config, "+
+			"-dir-auth-config, or -batch-mode")
+	}
+	keyIDSigned := false
+	for _, header := range opts.Headers {
+		if http.CanonicalHeaderKey(header) ==
+			http.CanonicalHeaderKey(opts.KeyIDHeader) {
+			keyIDSigned = true
+		}
+	}
+	if opts.KeyIDHeader == "" {
+		msgs = append(msgs, "secrets-file requires -key-id-header")
+	} else if !keyIDSigned {
+		msgs = append(msgs, "key-id-header must be in -headers: "+
+			opts.KeyIDHeader)
+	}
+	secrets, err := loadSecretsFile(opts.SecretsFile)
+	if err != nil {
+		return append(msgs, "secrets-file failed to load: "+
+			err.Error())
+	} else if len(secrets) == 0 {
+		return append(msgs, "secrets-file lists no keys")
+	}
+	opts.SecretLookup = newKeyIDLookup(opts.KeyIDHeader, secrets)
+	return msgs
+}
+
+func validateKeyRotationInterval(opts *HmacProxyOpts,
+	msgs []string) []string {
+	if opts.KeyRotationInterval == 0 {
+		return msgs
+	}
+	if opts.KeyRotationInterval < time.Second ||
+		opts.KeyRotationInterval%time.Second != 0 {
+		msgs = append(msgs, "key-rotation-interval must be a whole "+
+			"number of seconds greater than zero")
+	}
+	if opts.WebhookPreset != "" {
+		msgs = append(msgs, "webhook-preset cannot be combined with "+
+			"-key-rotation-interval")
+	}
 	return msgs
 }
 
@@ -177,9 +1226,52 @@ type HmacProxyURL struct {
 
 func validateUpstream(opts *HmacProxyOpts, msgs []string) []string {
 	if opts.Upstream.Raw == "" {
+		if opts.UpstreamProxyProtocol != "" && opts.HostsConfig == "" {
+			msgs = append(msgs, "upstream-proxy-protocol requires "+
+				"-upstream")
+		}
+		if opts.UpstreamClientCert != "" && opts.HostsConfig == "" {
+			msgs = append(msgs, "upstream-client-cert requires "+
+				"-upstream")
+		}
 		return msgs
 	}
 
+	if opts.UpstreamIdleTimeout < 0 {
+		msgs = append(msgs, "upstream-idle-timeout must not be negative")
+	}
+	if opts.FollowUpstreamRedirects < 0 {
+		msgs = append(msgs, "follow-upstream-redirects must not be "+
+			"negative")
+	}
+	if opts.UpstreamProxyProtocol != "" &&
+		opts.UpstreamProxyProtocol != "v1" &&
+		opts.UpstreamProxyProtocol != "v2" {
+		msgs = append(msgs, "invalid upstream-proxy-protocol: "+
+			opts.UpstreamProxyProtocol)
+	}
+	if (opts.UpstreamClientCert == "") != (opts.UpstreamClientKey == "") {
+		msgs = append(msgs, "upstream-client-cert and "+
+			"upstream-client-key must both be specified, or "+
+			"neither must be")
+	} else if opts.UpstreamClientCert != "" {
+		if _, err := tls.LoadX509KeyPair(opts.UpstreamClientCert,
+			opts.UpstreamClientKey); err != nil {
+			msgs = append(msgs, "failed to load "+
+				"upstream-client-cert: "+err.Error())
+		}
+	}
+	if opts.ExpectContinue != ExpectContinueRespond &&
+		opts.ExpectContinue != ExpectContinueForward {
+		msgs = append(msgs, "invalid expect-continue: "+
+			opts.ExpectContinue)
+	}
+	if opts.EmitVia && (opts.ViaPseudonym == "" ||
+		strings.ContainsAny(opts.ViaPseudonym, " \t,")) {
+		msgs = append(msgs, "invalid via-pseudonym: "+
+			strconv.Quote(opts.ViaPseudonym))
+	}
+
 	var err error
 	if opts.Upstream.URL, err = url.Parse(opts.Upstream.Raw); err != nil {
 		msgs = append(msgs, "upstream URL failed to parse"+err.Error())
@@ -199,6 +1291,111 @@ func validateUpstream(opts *HmacProxyOpts, msgs []string) []string {
 	return msgs
 }
 
+// validateHosts loads the -hosts-config file into opts.Hosts, creating a copy
+// of opts for each host with the upstream, secret, and headers for that host.
+func validateHosts(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.HostsConfig == "" {
+		return msgs
+	}
+	if opts.Auth || opts.Upstream.Raw != "" || opts.Secret != "" ||
+		opts.WebhookPreset != "" {
+		msgs = append(msgs, "hosts-config cannot be combined with "+
+			"-auth, -upstream, -secret, or -webhook-preset")
+	}
+	hosts, err := loadHostsConfig(opts.HostsConfig)
+	if err != nil {
+		return append(msgs, "hosts-config failed to load: "+
+			err.Error())
+	} else if len(hosts) == 0 {
+		return append(msgs, "hosts-config lists no hosts")
+	}
+
+	opts.Hosts = make(map[string]*HmacProxyOpts)
+	for host, config := range hosts {
+		hostOpts := *opts
+		hostOpts.Hosts = nil
+		hostOpts.Upstream = HmacProxyURL{Raw: config.Upstream}
+		hostOpts.Secret = config.Secret
+		if len(config.Headers) != 0 {
+			hostOpts.Headers = config.Headers
+		}
+
+		var hostMsgs []string
+		if config.Upstream == "" {
+			hostMsgs = append(hostMsgs, "no upstream specified")
+		}
+		if config.Secret == "" {
+			hostMsgs = append(hostMsgs, "no secret specified")
+		}
+		hostMsgs = validateUpstream(&hostOpts, hostMsgs)
+		for _, msg := range hostMsgs {
+			msgs = append(msgs, "hosts-config "+host+": "+msg)
+		}
+		opts.Hosts[strings.ToLower(host)] = &hostOpts
+	}
+	return msgs
+}
+
+// validateDirAuth loads the -dir-auth-config file into opts.DirAuths,
+// creating a copy of opts for each directory with the secret, digest, and
+// headers for that directory.
+func validateDirAuth(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.DirAuthConfig == "" {
+		return msgs
+	}
+	if opts.Mode != HandlerAuthForFiles {
+		msgs = append(msgs, "dir-auth-config requires -auth and "+
+			"-file-root")
+	}
+	if opts.WebhookPreset != "" {
+		msgs = append(msgs, "dir-auth-config cannot be combined with "+
+			"-webhook-preset")
+	}
+	dirs, err := loadDirAuthConfig(opts.DirAuthConfig)
+	if err != nil {
+		return append(msgs, "dir-auth-config failed to load: "+
+			err.Error())
+	} else if len(dirs) == 0 {
+		return append(msgs, "dir-auth-config lists no directories")
+	}
+
+	opts.DirAuths = make(map[string]*HmacProxyOpts)
+	for dir, config := range dirs {
+		dirOpts := *opts
+		dirOpts.DirAuths = nil
+		dirOpts.Secret = config.Secret
+		// The top-level previous secret must not unlock the
+		// directory in place of its own secret.
+		dirOpts.PreviousSecret = ""
+		dirOpts.RotationGrace = 0
+		dirOpts.RotatedAt = HmacProxyTime{}
+		if len(config.Headers) != 0 {
+			dirOpts.Headers = config.Headers
+		}
+
+		var dirMsgs []string
+		if !strings.HasPrefix(dir, "/") || !strings.HasSuffix(dir, "/") {
+			dirMsgs = append(dirMsgs, "must begin and end with \"/\"")
+		}
+		if config.Secret == "" {
+			dirMsgs = append(dirMsgs, "no secret specified")
+		}
+		if config.Digest != "" {
+			dirOpts.Digest = HmacProxyDigest{Name: config.Digest}
+			if dirOpts.Digest.ID, err = hmacauth.DigestNameToCryptoHash(
+				config.Digest); err != nil {
+				dirMsgs = append(dirMsgs, "unsupported digest: "+
+					config.Digest)
+			}
+		}
+		for _, msg := range dirMsgs {
+			msgs = append(msgs, "dir-auth-config "+dir+": "+msg)
+		}
+		opts.DirAuths[dir] = &dirOpts
+	}
+	return msgs
+}
+
 func checkExistenceAndPermission(path, optionName, dirOrFile string,
 	msgs []string) []string {
 	if dirOrFile != "dir" && dirOrFile != "file" {
@@ -219,8 +1416,20 @@ func checkExistenceAndPermission(path, optionName, dirOrFile string,
 
 func validateFileRoot(opts *HmacProxyOpts, msgs []string) []string {
 	if opts.FileRoot == "" {
+		if len(opts.PublicPaths) != 0 {
+			msgs = append(msgs, "public-paths requires -file-root")
+		}
+		if opts.AllowArchive {
+			msgs = append(msgs, "allow-archive requires -file-root")
+		}
 		return msgs
 	}
+	for _, path := range opts.PublicPaths {
+		if !strings.HasPrefix(path, "/") {
+			msgs = append(msgs, "public path must begin with "+
+				"\"/\": "+path)
+		}
+	}
 	return checkExistenceAndPermission(
 		opts.FileRoot, "file-root", "dir", msgs)
 }
@@ -228,6 +1437,28 @@ func validateFileRoot(opts *HmacProxyOpts, msgs []string) []string {
 func validateSsl(opts *HmacProxyOpts, msgs []string) []string {
 	certSpecified := opts.SslCert != ""
 	keySpecified := opts.SslKey != ""
+	if opts.TLSSessionMaxAge < 0 {
+		msgs = append(msgs, "tls-session-max-age must not be negative")
+	} else if opts.TLSSessionMaxAge != 0 && !certSpecified {
+		msgs = append(msgs, "tls-session-max-age requires -ssl-cert")
+	}
+	if len(opts.TLSALPN) != 0 && !certSpecified {
+		msgs = append(msgs, "tls-alpn requires -ssl-cert")
+	}
+	if opts.RedirectHTTPPort < 0 {
+		msgs = append(msgs, "redirect-http-port must not be negative")
+	} else if opts.RedirectHTTPPort != 0 {
+		if !certSpecified {
+			msgs = append(msgs, "redirect-http-port requires "+
+				"-ssl-cert")
+		}
+		for _, port := range opts.Ports {
+			if port == opts.RedirectHTTPPort {
+				msgs = append(msgs, "redirect-http-port must "+
+					"differ from -port")
+			}
+		}
+	}
 	if !(certSpecified || keySpecified) {
 		return msgs
 	} else if !(certSpecified && keySpecified) {
@@ -245,3 +1476,260 @@ func validateSsl(opts *HmacProxyOpts, msgs []string) []string {
 	}
 	return msgs
 }
+
+func validateAdminConfig(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.AdminConfigPath == "" {
+		if len(opts.AdminAllowedIPs) != 0 {
+			msgs = append(msgs, "admin-allowed-ips requires "+
+				"-admin-config-path")
+		}
+		return msgs
+	}
+	if !strings.HasPrefix(opts.AdminConfigPath, "/") {
+		msgs = append(msgs, "admin-config-path must begin with "+
+			"\"/\": "+opts.AdminConfigPath)
+	}
+	if len(opts.AdminAllowedIPs) == 0 {
+		msgs = append(msgs, "admin-config-path requires "+
+			"-admin-allowed-ips")
+	} else if _, err := parseNetworks(opts.AdminAllowedIPs); err != nil {
+		msgs = append(msgs, "invalid admin-allowed-ips: "+err.Error())
+	}
+	if opts.WebhookPreset != "" {
+		msgs = append(msgs, "webhook-preset cannot be combined with "+
+			"-admin-config-path")
+	}
+	return msgs
+}
+
+func validateDebugCanonical(opts *HmacProxyOpts, msgs []string) []string {
+	if !opts.EnableDebugCanonical {
+		if len(opts.DebugAllowedIPs) != 0 {
+			msgs = append(msgs, "debug-allowed-ips requires "+
+				"-enable-debug-canonical")
+		}
+		return msgs
+	}
+	if len(opts.DebugAllowedIPs) == 0 {
+		msgs = append(msgs, "enable-debug-canonical requires "+
+			"-debug-allowed-ips")
+	} else if _, err := parseNetworks(opts.DebugAllowedIPs); err != nil {
+		msgs = append(msgs, "invalid debug-allowed-ips: "+err.Error())
+	}
+	if opts.WebhookPreset != "" || opts.HostsConfig != "" ||
+		opts.BatchMode != "" {
+		msgs = append(msgs, "enable-debug-canonical cannot be "+
+			"combined with -webhook-preset, -hosts-config, or "+
+			"-batch-mode")
+	}
+	return msgs
+}
+
+func validateHealth(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.HealthPath != "" && !strings.HasPrefix(opts.HealthPath, "/") {
+		msgs = append(msgs, "health-path must begin with \"/\": "+
+			opts.HealthPath)
+	}
+	if opts.DrainFile != "" && opts.HealthPath == "" {
+		msgs = append(msgs, "drain-file requires -health-path")
+	}
+	if opts.HealthDetail && opts.HealthPath == "" {
+		msgs = append(msgs, "health-detail requires -health-path")
+	}
+	if opts.HealthSecret != "" && opts.HealthPath == "" {
+		msgs = append(msgs, "health-secret requires -health-path")
+	}
+	if !opts.HealthIncludesUpstream {
+		return msgs
+	}
+	if opts.HealthPath == "" {
+		msgs = append(msgs, "health-includes-upstream requires "+
+			"-health-path")
+	}
+	if opts.Upstream.Raw == "" {
+		msgs = append(msgs, "health-includes-upstream requires "+
+			"-upstream")
+	}
+	return msgs
+}
+
+func validateAuthTimeout(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.AuthTimeout < 0 {
+		msgs = append(msgs, "auth-timeout must not be negative")
+	} else if opts.AuthTimeout != 0 && opts.Mode != HandlerAuthOnly {
+		msgs = append(msgs, "auth-timeout only applies to -auth "+
+			"without -upstream or -file-root")
+	}
+	if http.StatusText(opts.AuthTimeoutStatus) == "" {
+		msgs = append(msgs, "invalid auth-timeout-status: "+
+			strconv.Itoa(opts.AuthTimeoutStatus))
+	}
+	return msgs
+}
+
+func validateTransform(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.TransformCmd == "" {
+		return msgs
+	}
+	if opts.Upstream.Raw == "" {
+		msgs = append(msgs, "transform-cmd requires -upstream")
+	}
+	if opts.TransformTimeout <= 0 {
+		msgs = append(msgs, "transform-timeout must be greater "+
+			"than zero")
+	}
+	return checkExistenceAndPermission(
+		opts.TransformCmd, "transform-cmd", "file", msgs)
+}
+
+func validateAuthFailure(opts *HmacProxyOpts, msgs []string) []string {
+	switch opts.AuthFailure {
+	case AuthFailureBlock:
+	case AuthFailurePassthrough:
+		if opts.Mode != HandlerAuthAndProxy {
+			msgs = append(msgs, "auth-failure=passthrough "+
+				"requires -auth and -upstream")
+		}
+	default:
+		msgs = append(msgs, "invalid auth-failure: "+opts.AuthFailure)
+	}
+	if opts.WWWAuthenticate != "" && !opts.Auth {
+		msgs = append(msgs, "www-authenticate requires -auth")
+	}
+	if opts.AuthFailureDelay < 0 {
+		msgs = append(msgs, "auth-failure-delay must not be negative")
+	} else if opts.AuthFailureDelay != 0 && !opts.Auth {
+		msgs = append(msgs, "auth-failure-delay requires -auth")
+	}
+	return msgs
+}
+
+func validateLogFormat(opts *HmacProxyOpts, msgs []string) []string {
+	if _, ok := logFormatters[opts.LogFormat]; !ok && opts.LogFormat != "" {
+		msgs = append(msgs, "unknown log-format: "+opts.LogFormat)
+	}
+	if opts.ErrorFormat != ErrorFormatText &&
+		opts.ErrorFormat != ErrorFormatProblem {
+		msgs = append(msgs, "invalid error-format: "+opts.ErrorFormat)
+	}
+	if opts.LogBuffer < 0 {
+		msgs = append(msgs, "log-buffer must not be negative")
+	} else if opts.LogBuffer != 0 && opts.LogFormat == "" {
+		msgs = append(msgs, "log-buffer requires -log-format")
+	}
+	if _, ok := eventSocketNetworks[opts.EventSocketType]; !ok {
+		msgs = append(msgs, "invalid event-socket-type: "+
+			opts.EventSocketType)
+	}
+	if opts.EventBuffer <= 0 {
+		msgs = append(msgs, "event-buffer must be greater than zero")
+	}
+	return msgs
+}
+
+func validateNonce(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.NoncePath == "" {
+		return msgs
+	}
+	if !strings.HasPrefix(opts.NoncePath, "/") {
+		msgs = append(msgs, "nonce-path must begin with \"/\": "+
+			opts.NoncePath)
+	}
+	if opts.Mode == HandlerSignAndProxy || opts.WebhookPreset != "" {
+		msgs = append(msgs, "nonce-path requires -auth and cannot be "+
+			"combined with -webhook-preset")
+	}
+	signed := false
+	for _, header := range opts.Headers {
+		if strings.EqualFold(header, opts.NonceHeader) {
+			signed = true
+		}
+	}
+	if !signed {
+		msgs = append(msgs, "nonce-header must be one of -headers: "+
+			opts.NonceHeader)
+	}
+	if opts.NonceTTL <= 0 {
+		msgs = append(msgs, "nonce-ttl must be greater than zero")
+	}
+	return msgs
+}
+
+func validateAudit(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.AuditWebhookURL == "" {
+		if opts.AuditSuccesses {
+			msgs = append(msgs, "audit-successes requires "+
+				"-audit-webhook-url")
+		}
+		return msgs
+	}
+	if !opts.Auth {
+		msgs = append(msgs, "audit-webhook-url requires -auth")
+	}
+	if u, err := url.Parse(opts.AuditWebhookURL); err != nil ||
+		!(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+		msgs = append(msgs, "invalid audit-webhook-url: "+
+			opts.AuditWebhookURL)
+	}
+	return msgs
+}
+
+func validateDelegateAuth(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.DelegateAuthURL == "" {
+		if len(opts.DelegateAuthHeaders) != 0 {
+			msgs = append(msgs, "delegate-auth-headers requires "+
+				"-delegate-auth-url")
+		}
+		return msgs
+	}
+	if !opts.Auth {
+		msgs = append(msgs, "delegate-auth-url requires -auth")
+	}
+	if u, err := url.Parse(opts.DelegateAuthURL); err != nil ||
+		!(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+		msgs = append(msgs, "invalid delegate-auth-url: "+
+			opts.DelegateAuthURL)
+	}
+	return msgs
+}
+
+func validateMaxHeaders(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.MaxHeaders <= 0 {
+		msgs = append(msgs, "max-headers must be greater than zero")
+	}
+	if opts.MaxHeaderValueBytes < 0 {
+		msgs = append(msgs, "max-header-value-bytes must not be "+
+			"negative")
+	}
+	for _, host := range opts.AllowedHosts {
+		if host == "" {
+			msgs = append(msgs, "allowed-hosts contains an empty host")
+		}
+	}
+	return msgs
+}
+
+// validateAllowConnect ensures that CONNECT requests are only allowed in
+// auth-only mode, since the proxy can't open the tunnels they request.
+func validateAllowConnect(opts *HmacProxyOpts, msgs []string) []string {
+	if opts.AllowConnect && opts.Mode != HandlerAuthOnly {
+		msgs = append(msgs, "allow-connect requires -auth without "+
+			"-upstream or -file-root")
+	}
+	return msgs
+}
+
+func validateDeadLetter(opts *HmacProxyOpts, msgs []string) []string {
+	if http.StatusText(opts.DeadLetterStatus) == "" {
+		msgs = append(msgs, "invalid dead-letter-status: "+
+			strconv.Itoa(opts.DeadLetterStatus))
+	}
+	if opts.DeadLetterDir == "" {
+		return msgs
+	}
+	if opts.Upstream.Raw == "" && opts.HostsConfig == "" {
+		msgs = append(msgs, "dead-letter-dir requires -upstream")
+	}
+	return checkExistenceAndPermission(
+		opts.DeadLetterDir, "dead-letter-dir", "dir", msgs)
+}
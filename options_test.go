@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"crypto"
+	"encoding/json"
 	"flag"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -37,7 +41,7 @@ var _ = Describe("HmacProxyOpts", func() {
 			Expect(err).NotTo(HaveOccurred())
 			err = opts.Validate()
 			Expect(err).NotTo(HaveOccurred())
-			Expect(opts.Port).To(Equal(8080))
+			Expect(opts.Ports).To(Equal(HmacProxyPorts{8080}))
 			Expect(opts.Secret).To(Equal("foobar"))
 			Expect(opts.SignHeader).To(Equal("Test-Signature"))
 			Expect(opts.Upstream.Raw).To(Equal(
@@ -108,6 +112,56 @@ var _ = Describe("HmacProxyOpts", func() {
 			Expect(opts.Mode).To(Equal(HandlerAuthOnly))
 		})
 
+		It("should sign default headers when -headers is omitted",
+			func() {
+				err := flags.Parse([]string{
+					"-port=8080",
+					"-secret=foobar",
+					"-sign-header=Test-Signature",
+					"-auth",
+				})
+				Expect(err).NotTo(HaveOccurred())
+				err = opts.Validate()
+				Expect(err).NotTo(HaveOccurred())
+				Expect([]string(opts.Headers)).To(Equal(
+					[]string{"Content-Type", "Date"}))
+			})
+
+		It("should sign no headers with -no-default-headers", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-no-default-headers",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.Headers).To(BeEmpty())
+		})
+
+		It("should explain how the mode was chosen", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-file-root=.",
+				"-auth",
+				"-explain",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.ExplainMode()).To(Equal(
+				"-auth is set\n" +
+					"-upstream is not set\n" +
+					"-file-root is set\n" +
+					"with -auth and -file-root, requests are " +
+					"authenticated and served from -file-root\n" +
+					"mode: auth-for-files\n"))
+		})
+
 		It("should accept SSL options", func() {
 			// Use filename as a file that's guaranteed to exist.
 			cwd, _ := os.Getwd()
@@ -127,6 +181,33 @@ var _ = Describe("HmacProxyOpts", func() {
 			Expect(opts.SslKey).To(Equal(filename))
 			Expect(opts.Mode).To(Equal(HandlerAuthOnly))
 		})
+
+		It("should configure a webhook preset", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-auth",
+				"-webhook-preset=github",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.SignHeader).To(Equal("X-Hub-Signature-256"))
+			Expect(opts.Digest.ID).To(Equal(crypto.SHA256))
+		})
+
+		It("should accept multiple ports", func() {
+			err := flags.Parse([]string{
+				"-port=8080,9090",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.Ports).To(Equal(HmacProxyPorts{8080, 9090}))
+		})
 	})
 
 	Context("with an invalid configuration", func() {
@@ -144,6 +225,78 @@ var _ = Describe("HmacProxyOpts", func() {
 			})))
 		})
 
+		It("should report errors as a JSON array", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-errors-json",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(opts.ErrorsJSON).To(BeTrue())
+			output, err := json.Marshal(err)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(output)).To(Equal(`[` +
+				`"neither -upstream, -file-root, nor -auth ` +
+				`specified",` +
+				`"no signature header specified"]`))
+		})
+
+		It("should report webhook preset errors", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-headers=Content-Type",
+				"-auth",
+				"-webhook-preset=github",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"webhook-preset github requires " +
+					"-sign-header=X-Hub-Signature-256",
+				"webhook-preset cannot be combined with " +
+					"-headers, -signature-prefix-algo, " +
+					"or -body-newline",
+			})))
+		})
+
+		It("should reject a non-positive max-headers", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-max-headers=0",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"max-headers must be greater than zero",
+			})))
+		})
+
+		It("should report auth failure policy errors", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-auth-failure=passthrough",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"auth-failure=passthrough requires -auth " +
+					"and -upstream",
+			})))
+		})
+
 		It("should report all file root errors", func() {
 			err := flags.Parse([]string{
 				"-port=8080",
@@ -162,6 +315,22 @@ var _ = Describe("HmacProxyOpts", func() {
 			})))
 		})
 
+		It("should report public path errors", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-public-paths=robots.txt",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"public-paths requires -file-root",
+			})))
+		})
+
 		It("should report port and hash digest errors", func() {
 			err := flags.Parse([]string{
 				"-port=-1",
@@ -180,6 +349,65 @@ var _ = Describe("HmacProxyOpts", func() {
 			})))
 		})
 
+		It("should report invalid and duplicate ports", func() {
+			err := flags.Parse([]string{
+				"-port=8080,0,8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"port specified more than once: 8080",
+				"port must be specified and greater than zero",
+			})))
+		})
+
+		It("should reject a non-numeric port", func() {
+			flags.SetOutput(ioutil.Discard)
+			err := flags.Parse([]string{"-port=8080,http"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(
+				"invalid port: http"))
+		})
+
+		It("should report a negative connection limit", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-max-connections=-1",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"max-connections must not be negative",
+			})))
+		})
+
+		It("should report auth timeout errors", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=https://localhost:8080/",
+				"-auth-timeout=1s",
+				"-auth-timeout-status=99",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"auth-timeout only applies to -auth without " +
+					"-upstream or -file-root",
+				"invalid auth-timeout-status: 99",
+			})))
+		})
+
 		It("should report incomplete upstream spec errors", func() {
 			err := flags.Parse([]string{
 				"-port=8080",
@@ -264,6 +492,110 @@ var _ = Describe("HmacProxyOpts", func() {
 			})))
 		})
 
+		It("should report health check errors", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-health-path=healthz",
+				"-health-includes-upstream",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"health-path must begin with \"/\": healthz",
+				"health-includes-upstream requires -upstream",
+			})))
+		})
+
+		It("should report admin configuration errors", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-admin-config-path=admin",
+				"-admin-allowed-ips=10.0.0.0/8,localhost",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"admin-config-path must begin with \"/\": admin",
+				"invalid admin-allowed-ips: invalid CIDR " +
+					"address: localhost",
+			})))
+		})
+
+		It("should report tls-session-max-age without ssl-cert", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-tls-session-max-age=1h",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"tls-session-max-age requires -ssl-cert",
+			})))
+		})
+
+		It("should report dynamic-signed-headers-from without "+
+			"an allowlist", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-dynamic-signed-headers-from=Signed-Headers",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"dynamic-signed-headers-from requires " +
+					"-allowed-signed-headers",
+			})))
+		})
+
+		It("should report tls-alpn without ssl-cert", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-tls-alpn=http/1.1",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"tls-alpn requires -ssl-cert",
+			})))
+		})
+
+		It("should report an invalid redirect-http-port", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+				"-redirect-http-port=8080",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = opts.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"redirect-http-port requires -ssl-cert",
+				"redirect-http-port must differ from -port",
+			})))
+		})
+
 		It("should report missing ssl-cert and ssl-key errors", func() {
 			err := flags.Parse([]string{
 				"-port=8080",
@@ -282,4 +614,40 @@ var _ = Describe("HmacProxyOpts", func() {
 			})))
 		})
 	})
+
+	Context("with a weak digest", func() {
+		startupOutput := func(argv []string) string {
+			err := flags.Parse(append(argv,
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-auth",
+			))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.Validate()).To(Succeed())
+			var output bytes.Buffer
+			opts.WarnIfWeakDigest(log.New(&output, "", 0))
+			return output.String()
+		}
+
+		It("should warn about md5", func() {
+			Expect(startupOutput([]string{"-digest=md5"})).To(Equal(
+				"WARNING: the md5 digest is weak; use sha256 " +
+					"or stronger if possible, or pass " +
+					"-i-know-md5-is-weak to silence this " +
+					"warning\n"))
+		})
+
+		It("should not warn about sha256", func() {
+			Expect(startupOutput([]string{"-digest=sha256"})).To(
+				BeEmpty())
+		})
+
+		It("should not warn when told not to", func() {
+			Expect(startupOutput([]string{
+				"-digest=md5",
+				"-i-know-md5-is-weak",
+			})).To(BeEmpty())
+		})
+	})
 })
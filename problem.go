@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// problemKey is the context key under which problemHandler marks requests
+// whose errors are reported as RFC 7807 problem details.
+type problemKey struct{}
+
+// problem is an RFC 7807 problem details object.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// problemHandler has writeError report errors in response to every request
+// as problem details, for -error-format=problem.
+type problemHandler struct {
+	handler http.Handler
+}
+
+func (h problemHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, r.WithContext(
+		context.WithValue(r.Context(), problemKey{}, true)))
+}
+
+// writeError responds to r with status and message, as http.Error does, or
+// as an application/problem+json body if r passed through problemHandler.
+func writeError(w http.ResponseWriter, r *http.Request, message string,
+	status int) {
+	if problems, _ := r.Context().Value(problemKey{}).(bool); !problems {
+		http.Error(w, message, status)
+		return
+	}
+	body, err := json.Marshal(problem{"about:blank",
+		http.StatusText(status), status, message})
+	if err != nil {
+		panic("failed to encode problem: " + err.Error())
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// proxyProtocolV2Signature begins every PROXY protocol version 2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// clientAddrKey is the context key under which proxyProtocolHandler stores
+// the address of the client.
+type clientAddrKey struct{}
+
+// proxyProtocolHandler records the client address of each request, so that
+// the dialer returned by newProxyProtocolDialer can send it to the upstream
+// server.
+type proxyProtocolHandler struct {
+	handler http.Handler
+}
+
+func (h proxyProtocolHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		r = r.WithContext(context.WithValue(r.Context(),
+			clientAddrKey{}, addr))
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// dialFunc is the type of http.Transport.DialContext.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newProxyProtocolDialer returns a dialFunc that sends a PROXY protocol header
+// of the given version over each connection opened by dial, carrying the
+// client and proxy addresses of the request that opened it.
+func newProxyProtocolDialer(version string, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (
+		net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		source, _ := ctx.Value(clientAddrKey{}).(*net.TCPAddr)
+		local, _ := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+		destination, _ := local.(*net.TCPAddr)
+		header := proxyProtocolHeader(version, source, destination)
+		if _, err = conn.Write(header); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// proxyProtocolHeader returns the PROXY protocol header of the given version
+// for a connection from source to destination. It describes the connection as
+// unknown if either address is nil, or if their families differ.
+func proxyProtocolHeader(version string,
+	source, destination *net.TCPAddr) []byte {
+	var sourceIP, destinationIP net.IP
+	if source != nil && destination != nil {
+		sourceIP, destinationIP = source.IP.To4(), destination.IP.To4()
+		if sourceIP == nil || destinationIP == nil {
+			sourceIP, destinationIP = source.IP.To16(),
+				destination.IP.To16()
+		}
+	}
+	known := sourceIP != nil && destinationIP != nil
+
+	if version == "v1" {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if len(sourceIP) == net.IPv6len {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family,
+			sourceIP, destinationIP, source.Port, destination.Port))
+	}
+
+	var header bytes.Buffer
+	_, _ = header.Write(proxyProtocolV2Signature)
+	if !known {
+		// Version 2, LOCAL command, unspecified family, no addresses.
+		_, _ = header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return header.Bytes()
+	}
+	family := byte(0x11)
+	if len(sourceIP) == net.IPv6len {
+		family = 0x21
+	}
+	// Version 2, PROXY command, TCP over IPv4 or IPv6.
+	_, _ = header.Write([]byte{0x21, family})
+	_ = binary.Write(&header, binary.BigEndian,
+		uint16(2*len(sourceIP)+4))
+	_, _ = header.Write(sourceIP)
+	_, _ = header.Write(destinationIP)
+	_ = binary.Write(&header, binary.BigEndian, uint16(source.Port))
+	_ = binary.Write(&header, binary.BigEndian,
+		uint16(destination.Port))
+	return header.Bytes()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+// proxyProtocolListener reads a PROXY protocol version 1 header from each
+// connection it accepts, sending it to headers.
+type proxyProtocolListener struct {
+	net.Listener
+	headers chan string
+}
+
+// bufferedConn is a net.Conn whose reads begin with any bytes buffered by
+// reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	l.headers <- header
+	return bufferedConn{conn, reader}, nil
+}
+
+var _ = Describe("HmacProxy upstream PROXY protocol", func() {
+	It("should send the client address to the upstream", func() {
+		headers := make(chan string, 2)
+		upstream := httptest.NewUnstartedServer(proxiedServer{})
+		upstream.Listener = proxyProtocolListener{upstream.Listener,
+			headers}
+		upstream.Start()
+		defer upstream.Close()
+
+		flags := flag.NewFlagSet("HmacProxy upstream PROXY protocol",
+			flag.ContinueOnError)
+		handler, _ := newHandler(flags,
+			RegisterCommandLineOptions(flags), []string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-upstream=" + upstream.URL,
+				"-upstream-proxy-protocol=v1",
+			})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		for i := 0; i != 2; i++ {
+			conn, err := net.Dial("tcp",
+				server.Listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			request, err := http.NewRequest("GET", server.URL+"/",
+				nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(request.Write(conn)).To(Succeed())
+			response, err := http.ReadResponse(
+				bufio.NewReader(conn), request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			client := conn.LocalAddr().(*net.TCPAddr)
+			proxy := conn.RemoteAddr().(*net.TCPAddr)
+			Expect(<-headers).To(Equal("PROXY TCP4 127.0.0.1 " +
+				"127.0.0.1 " + strconv.Itoa(client.Port) + " " +
+				strconv.Itoa(proxy.Port) + "\r\n"))
+		}
+	})
+
+	It("should encode version 2 headers", func() {
+		header := proxyProtocolHeader("v2",
+			&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443})
+		Expect(header).To(Equal(append(
+			[]byte("\r\n\r\n\x00\r\nQUIT\n"),
+			0x21, 0x11, 0x00, 0x0c,
+			192, 0, 2, 1,
+			192, 0, 2, 2,
+			0xdc, 0x04,
+			0x01, 0xbb)))
+	})
+
+	It("should describe unknown addresses", func() {
+		Expect(string(proxyProtocolHeader("v1", nil, nil))).To(
+			Equal("PROXY UNKNOWN\r\n"))
+		Expect(proxyProtocolHeader("v2", nil, nil)).To(Equal(append(
+			[]byte("\r\n\r\n\x00\r\nQUIT\n"),
+			0x20, 0x00, 0x00, 0x00)))
+	})
+})
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// asyncSink receives the writes queued by an asyncWriter, from a single
+// goroutine.
+type asyncSink interface {
+	// write handles one queued write, returning false if it had to be
+	// dropped.
+	write(p []byte) bool
+
+	// flush is called periodically, and once more when the asyncWriter
+	// is closed, with the number of writes dropped since the last call.
+	flush(dropped int)
+
+	// close releases the sink's resources after the final flush.
+	close()
+}
+
+// asyncWriter queues writes in a bounded channel and passes them to its sink
+// from a single goroutine, so that a slow sink doesn't hold up requests.
+// Writes made while the queue is full are dropped and counted rather than
+// blocking.
+type asyncWriter struct {
+	queue    chan []byte
+	sink     asyncSink
+	interval time.Duration
+	done     chan struct{}
+	mu       sync.Mutex
+	closed   bool
+	dropped  int
+}
+
+// newAsyncWriter returns an asyncWriter queueing up to size writes for sink,
+// flushing it every interval.
+func newAsyncWriter(sink asyncSink, size int,
+	interval time.Duration) *asyncWriter {
+	w := &asyncWriter{
+		queue:    make(chan []byte, size),
+		sink:     sink,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	queued := append([]byte(nil), p...)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	select {
+	case w.queue <- queued:
+	default:
+		w.dropped++
+	}
+	return len(p), nil
+}
+
+// Close passes every queued write to the sink, flushes and closes it, then
+// stops the writer.
+func (w *asyncWriter) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+	return nil
+}
+
+func (w *asyncWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case p, ok := <-w.queue:
+			if !ok {
+				w.flush()
+				w.sink.close()
+				return
+			}
+			if !w.sink.write(p) {
+				w.mu.Lock()
+				w.dropped++
+				w.mu.Unlock()
+			}
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+func (w *asyncWriter) flush() {
+	w.mu.Lock()
+	dropped := w.dropped
+	w.dropped = 0
+	w.mu.Unlock()
+	w.sink.flush(dropped)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"github.com/18F/hmacauth"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// redirectTransport follows up to max redirects from the upstream server
+// itself, returning the final response rather than the redirect. Only
+// redirects to the same scheme and host as the original request are
+// followed, and each URL is requested at most once, so that a redirect loop
+// or a redirect to another host is passed back to the client instead.
+// Followed requests are re-signed by signer, if any.
+type redirectTransport struct {
+	http.RoundTripper
+	max    int
+	signer hmacauth.HmacAuth
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (
+	*http.Response, error) {
+	var body []byte
+	if r.ContentLength != 0 {
+		body = readRequestBody(r)
+	}
+	visited := map[string]bool{r.URL.String(): true}
+	response, err := t.RoundTripper.RoundTrip(r)
+	for redirects := 0; err == nil && redirects < t.max; redirects++ {
+		next := t.redirectRequest(r, response, body)
+		if next == nil || visited[next.URL.String()] {
+			break
+		}
+		visited[next.URL.String()] = true
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		_ = response.Body.Close()
+		r = next
+		response, err = t.RoundTripper.RoundTrip(r)
+	}
+	return response, err
+}
+
+// redirectRequest returns the request redirected to by response, the
+// response to r, or nil if response is not a redirect that may be followed.
+func (t redirectTransport) redirectRequest(r *http.Request,
+	response *http.Response, body []byte) *http.Request {
+	switch response.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusSeeOther, http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect:
+	default:
+		return nil
+	}
+	location, err := response.Location()
+	if err != nil || location.Scheme != r.URL.Scheme ||
+		location.Host != r.URL.Host {
+		return nil
+	}
+
+	next := copyRequest(r)
+	next.URL = location
+	switch response.StatusCode {
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		next.Body = ioutil.NopCloser(bytes.NewReader(body))
+	default:
+		if r.Method != "HEAD" {
+			next.Method = "GET"
+		}
+		body = nil
+		next.Body = nil
+		next.Header.Del("Content-Type")
+	}
+	next.ContentLength = int64(len(body))
+	if t.signer != nil && t.signer.SignatureFromHeader(r) != "" {
+		t.signer.SignRequest(next)
+	}
+	return next
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/18F/hmacauth"
+	"net/http"
+	"time"
+)
+
+// rotatingAuth signs requests using the current secret, and authenticates
+// requests signed with either the current or the previous secret until the
+// rotation grace period expires.
+type rotatingAuth struct {
+	hmacauth.HmacAuth
+	previous hmacauth.HmacAuth
+	expires  time.Time
+	now      func() time.Time
+}
+
+// withPreviousSecret returns auth, which uses opts.Secret, extended to accept
+// signatures made with opts.PreviousSecret until opts.RotationGrace after
+// opts.RotatedAt. newAuth creates the hmacauth.HmacAuth for a given secret.
+func withPreviousSecret(opts *HmacProxyOpts, auth hmacauth.HmacAuth,
+	newAuth func(opts *HmacProxyOpts) hmacauth.HmacAuth) hmacauth.HmacAuth {
+	if opts.PreviousSecret == "" {
+		return auth
+	}
+	previousOpts := *opts
+	previousOpts.Secret = opts.PreviousSecret
+	return rotatingAuth{auth, newAuth(&previousOpts),
+		opts.RotatedAt.Add(opts.RotationGrace), time.Now}
+}
+
+func (a rotatingAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	result, headerSignature, computedSignature =
+		a.HmacAuth.AuthenticateRequest(r)
+	if result == hmacauth.ResultMismatch && a.now().Before(a.expires) {
+		if previous, _, _ := a.previous.AuthenticateRequest(
+			r); previous == hmacauth.ResultMatch {
+			result = previous
+		}
+	}
+	return
+}
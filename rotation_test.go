@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("HmacProxy secret rotation", func() {
+	var (
+		opts  *HmacProxyOpts
+		flags *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet(
+			"HmacProxy secret rotation", flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+	})
+
+	// authenticate sends a request signed with secret to a proxy
+	// configured by argv and returns the response status.
+	authenticate := func(argv []string, secret string) int {
+		handler, _ := newHandler(flags, opts, append([]string{
+			"-secret=newsecret",
+			"-sign-header=Test-Signature",
+			"-no-default-headers",
+			"-auth",
+		}, argv...))
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		request, err := http.NewRequest("GET", server.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		hmacauth.NewHmacAuth(crypto.SHA1, []byte(secret),
+			"Test-Signature", nil).SignRequest(request)
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		return response.StatusCode
+	}
+
+	It("should accept the previous secret during the grace period",
+		func() {
+			Expect(authenticate([]string{
+				"-previous-secret=oldsecret",
+				"-rotation-grace=1h",
+			}, "oldsecret")).To(Equal(http.StatusAccepted))
+		})
+
+	It("should reject the previous secret after the grace period",
+		func() {
+			rotatedAt := time.Now().Add(-2 * time.Hour)
+			Expect(authenticate([]string{
+				"-previous-secret=oldsecret",
+				"-rotation-grace=1h",
+				"-rotated-at=" + rotatedAt.Format(time.RFC3339),
+			}, "oldsecret")).To(Equal(http.StatusUnauthorized))
+		})
+
+	It("should always accept the current secret", func() {
+		rotatedAt := time.Now().Add(-2 * time.Hour)
+		Expect(authenticate([]string{
+			"-previous-secret=oldsecret",
+			"-rotation-grace=1h",
+			"-rotated-at=" + rotatedAt.Format(time.RFC3339),
+		}, "newsecret")).To(Equal(http.StatusAccepted))
+	})
+
+	It("should reject other secrets", func() {
+		Expect(authenticate([]string{
+			"-previous-secret=oldsecret",
+			"-rotation-grace=1h",
+		}, "badsecret")).To(Equal(http.StatusUnauthorized))
+	})
+})
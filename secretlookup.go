@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/18F/hmacauth"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// secretCacheSize bounds the number of hmacauth.HmacAuth objects
+// secretLookupAuth keeps for the secrets it has looked up.
+const secretCacheSize = 1000
+
+// loadSecretsFile parses the -secrets-file at path, a JSON object mapping each
+// key ID to its secret.
+func loadSecretsFile(path string) (secrets map[string]string, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err == nil {
+		err = json.Unmarshal(data, &secrets)
+	}
+	return
+}
+
+// newKeyIDLookup returns a SecretLookup function that returns the secret in
+// secrets for the key ID in each request's header.
+func newKeyIDLookup(header string,
+	secrets map[string]string) func(r *http.Request) ([]byte, error) {
+	return func(r *http.Request) ([]byte, error) {
+		keyID := r.Header.Get(header)
+		if keyID == "" {
+			return nil, errors.New("no " + header + " header")
+		}
+		secret, ok := secrets[keyID]
+		if !ok {
+			return nil, errors.New("unknown key ID: " + keyID)
+		}
+		return []byte(secret), nil
+	}
+}
+
+// secretLookupAuth signs and authenticates each request using the secret
+// returned for it by opts.SecretLookup, so that each tenant of a multi-tenant
+// gateway may use its own secret without listing every secret up front.
+type secretLookupAuth struct {
+	opts    HmacProxyOpts
+	newAuth func(opts *HmacProxyOpts) hmacauth.HmacAuth
+	mu      *sync.Mutex
+	auths   map[string]hmacauth.HmacAuth
+}
+
+// newSecretLookupAuth returns an hmacauth.HmacAuth that uses newAuth with the
+// secret opts.SecretLookup returns for each request.
+func newSecretLookupAuth(opts *HmacProxyOpts,
+	newAuth func(opts *HmacProxyOpts) hmacauth.HmacAuth) hmacauth.HmacAuth {
+	return secretLookupAuth{*opts, newAuth, &sync.Mutex{},
+		make(map[string]hmacauth.HmacAuth)}
+}
+
+// requestAuth returns the hmacauth.HmacAuth for the secret looked up for r,
+// or nil if the lookup fails.
+func (a secretLookupAuth) requestAuth(r *http.Request) hmacauth.HmacAuth {
+	secret, err := a.opts.SecretLookup(r)
+	if err != nil {
+		log.Printf("failed to look up secret for %s: %s",
+			r.URL.Path, err)
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	auth, ok := a.auths[string(secret)]
+	if !ok {
+		if len(a.auths) == secretCacheSize {
+			for cached := range a.auths {
+				delete(a.auths, cached)
+			}
+		}
+		opts := a.opts
+		opts.Secret = string(secret)
+		auth = a.newAuth(&opts)
+		a.auths[string(secret)] = auth
+	}
+	return auth
+}
+
+// Sign returns the empty string if the secret lookup fails.
+func (a secretLookupAuth) Sign(r *http.Request) string {
+	if auth := a.requestAuth(r); auth != nil {
+		return auth.Sign(r)
+	}
+	return ""
+}
+
+// SignRequest has signingHandler reject r if the secret lookup fails.
+func (a secretLookupAuth) SignRequest(r *http.Request) {
+	if signature := a.Sign(r); signature != "" {
+		r.Header.Set(a.opts.SignHeader, signature)
+	} else {
+		failSigning(r, "no secret for request", http.StatusBadRequest)
+	}
+}
+
+func (a secretLookupAuth) StringToSign(r *http.Request) string {
+	return a.newAuth(&a.opts).StringToSign(r)
+}
+
+func (a secretLookupAuth) SignatureFromHeader(r *http.Request) string {
+	return r.Header.Get(a.opts.SignHeader)
+}
+
+// AuthenticateRequest reports a mismatch if the secret lookup fails.
+func (a secretLookupAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	headerSignature = a.SignatureFromHeader(r)
+	if headerSignature == "" {
+		return hmacauth.ResultNoSignature, "", ""
+	}
+	auth := a.requestAuth(r)
+	if auth == nil {
+		return hmacauth.ResultMismatch, headerSignature, ""
+	}
+	return auth.AuthenticateRequest(r)
+}
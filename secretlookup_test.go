@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("HmacProxy secret lookup", func() {
+	var (
+		dir    string
+		server *httptest.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "hmacproxy-test")
+		Expect(err).NotTo(HaveOccurred())
+		secrets := filepath.Join(dir, "secrets.json")
+		Expect(ioutil.WriteFile(secrets,
+			[]byte(`{"a": "secret-a", "b": "secret-b"}`),
+			0644)).To(Succeed())
+
+		flags := flag.NewFlagSet("HmacProxy secret lookup",
+			flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, []string{
+			"-sign-header=Test-Signature",
+			"-headers=X-Tenant",
+			"-secrets-file=" + secrets,
+			"-key-id-header=X-Tenant",
+			"-auth",
+		})
+		server = httptest.NewServer(handler)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	// authenticate sends a request for tenant signed with secret,
+	// returning the response status.
+	authenticate := func(tenant, secret string) int {
+		request, err := http.NewRequest("GET", server.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("X-Tenant", tenant)
+		hmacauth.NewHmacAuth(crypto.SHA1, []byte(secret),
+			"Test-Signature", []string{"X-Tenant"}).SignRequest(request)
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		return response.StatusCode
+	}
+
+	It("should authenticate each tenant with its own secret", func() {
+		Expect(authenticate("a", "secret-a")).To(
+			Equal(http.StatusAccepted))
+		Expect(authenticate("b", "secret-b")).To(
+			Equal(http.StatusAccepted))
+		Expect(authenticate("a", "secret-a")).To(
+			Equal(http.StatusAccepted))
+	})
+
+	It("should reject another tenant's secret", func() {
+		Expect(authenticate("a", "secret-b")).To(
+			Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject unknown tenants", func() {
+		Expect(authenticate("c", "secret-a")).To(
+			Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject requests without a key ID", func() {
+		Expect(authenticate("", "secret-a")).To(
+			Equal(http.StatusUnauthorized))
+	})
+
+	It("should refuse to sign requests for unknown tenants", func() {
+		flags := flag.NewFlagSet("HmacProxy secret lookup (local)",
+			flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, []string{
+			"-sign-header=Test-Signature",
+			"-headers=X-Tenant",
+			"-secrets-file=" + filepath.Join(dir, "secrets.json"),
+			"-key-id-header=X-Tenant",
+			"-upstream=" + server.URL,
+		})
+		local := httptest.NewServer(handler)
+		defer local.Close()
+
+		send := func(tenant string) int {
+			request, err := http.NewRequest(
+				"GET", local.URL+"/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("X-Tenant", tenant)
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return response.StatusCode
+		}
+		Expect(send("a")).To(Equal(http.StatusAccepted))
+		Expect(send("c")).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should reject -dir-auth-config", func() {
+		flags := flag.NewFlagSet("HmacProxy secret lookup (dirs)",
+			flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		dirs := filepath.Join(dir, "dirs.json")
+		Expect(ioutil.WriteFile(dirs,
+			[]byte(`{"/admin/": {"secret": "admin-secret"}}`),
+			0644)).To(Succeed())
+		Expect(flags.Parse([]string{
+			"-port=8080",
+			"-sign-header=Test-Signature",
+			"-headers=X-Tenant",
+			"-secrets-file=" + filepath.Join(dir, "secrets.json"),
+			"-key-id-header=X-Tenant",
+			"-auth",
+			"-file-root=" + dir,
+			"-dir-auth-config=" + dirs,
+		})).To(Succeed())
+		Expect(opts.Validate()).To(MatchError(optionErrors([]string{
+			"secrets-file cannot be combined with -secret, " +
+				"-previous-secret, -hosts-config, " +
+				"-dir-auth-config, or -batch-mode",
+		})))
+	})
+})
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+// newListeners returns a net.Listener for each of the ports in opts.
+func newListeners(opts *HmacProxyOpts) (
+	listeners []net.Listener, err error) {
+	for _, port := range opts.Ports {
+		var listener net.Listener
+		address := ":" + strconv.Itoa(port)
+		if listener, err = newListener(opts, address); err != nil {
+			for _, listener := range listeners {
+				_ = listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return
+}
+
+// serve starts a http.Server for each of the listeners, all sharing the same
+// handler, and returns the first error from any of them.
+func serve(opts *HmacProxyOpts, handler http.Handler,
+	listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- newServer(opts, handler).Serve(listener)
+		}(listener)
+	}
+	return <-errs
+}
+
+// newServer returns a http.Server for handler that enforces the
+// server-level limits specified in opts.
+func newServer(opts *HmacProxyOpts, handler http.Handler) *http.Server {
+	server := &http.Server{Handler: handler}
+	if opts.ReadHeaderTimeout > 0 {
+		server.ReadHeaderTimeout = opts.ReadHeaderTimeout
+		server.ConnState = newHeaderTimeoutLogger(
+			opts.ReadHeaderTimeout).connState
+	}
+	return server
+}
+
+// headerTimeoutLogger logs each new connection that doesn't send complete
+// headers for its first request within the -read-header-timeout, such as
+// those sending their headers slowly to tie up the server.
+type headerTimeoutLogger struct {
+	timeout time.Duration
+	mu      sync.Mutex
+	opened  map[net.Conn]time.Time
+}
+
+func newHeaderTimeoutLogger(timeout time.Duration) *headerTimeoutLogger {
+	return &headerTimeoutLogger{
+		timeout: timeout, opened: make(map[net.Conn]time.Time)}
+}
+
+// connState is a http.Server ConnState hook. A new connection becomes
+// active once the server has tried to read its first request, whether or not
+// it succeeded, and closes without becoming active if the client sent
+// nothing. Either taking at least the timeout means that the client didn't
+// send its headers in time.
+func (l *headerTimeoutLogger) connState(conn net.Conn,
+	state http.ConnState) {
+	l.mu.Lock()
+	opened, ok := l.opened[conn]
+	if state == http.StateNew {
+		l.opened[conn] = time.Now()
+	} else {
+		delete(l.opened, conn)
+	}
+	l.mu.Unlock()
+
+	if ok && (state == http.StateActive || state == http.StateClosed) &&
+		time.Since(opened) >= l.timeout {
+		log.Printf("closed connection from %s: request headers not "+
+			"received within %s", conn.RemoteAddr(), l.timeout)
+	}
+}
+
+// newListener returns a net.Listener for address that enforces the
+// connection-level limits specified in opts, and that terminates TLS if
+// opts.SslCert is specified.
+func newListener(opts *HmacProxyOpts, address string) (
+	listener net.Listener, err error) {
+	if listener, err = net.Listen("tcp", address); err != nil {
+		return
+	}
+	if opts.MaxConnsPerIP > 0 {
+		listener = newPerIPLimitListener(listener, opts.MaxConnsPerIP)
+	}
+	if opts.MaxConnections > 0 {
+		listener = newLimitListener(listener, opts.MaxConnections)
+	}
+	if opts.SslCert != "" {
+		var tlsListener net.Listener
+		if tlsListener, err = newTLSListener(opts, listener); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		listener = tlsListener
+	}
+	return
+}
+
+// limitListener holds new connections in the listen backlog until the
+// number of open connections accepted through it falls below its limit.
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(listener net.Listener, n int) net.Listener {
+	return &limitListener{
+		Listener: listener,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitListenerConn{Conn: conn, release: l.release}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+func (l *limitListener) release() {
+	<-l.sem
+}
+
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
+
+// perIPLimitListener closes new connections from any IP address that
+// already has its limit of open connections accepted through the listener,
+// so that no one client can use up the -max-connections.
+type perIPLimitListener struct {
+	net.Listener
+	max  int
+	mu   sync.Mutex
+	open map[string]int
+}
+
+func newPerIPLimitListener(listener net.Listener, n int) net.Listener {
+	return &perIPLimitListener{
+		Listener: listener, max: n, open: make(map[string]int)}
+}
+
+func (l *perIPLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			ip = conn.RemoteAddr().String()
+		}
+		if l.acquire(ip) {
+			return &limitListenerConn{Conn: conn,
+				release: func() { l.release(ip) }}, nil
+		}
+		_ = conn.Close()
+	}
+}
+
+func (l *perIPLimitListener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open[ip] >= l.max {
+		return false
+	}
+	l.open[ip]++
+	return true
+}
+
+func (l *perIPLimitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open[ip]--; l.open[ip] == 0 {
+		delete(l.open, ip)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var _ = Describe("HmacProxy listener", func() {
+	var (
+		opts  *HmacProxyOpts
+		flags *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet(
+			"HmacProxy listener", flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+	})
+
+	listen := func(argv []string) net.Listener {
+		handler, _ := newHandler(flags, opts, argv)
+		listener, err := newListener(opts, "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		go func() {
+			_ = (&http.Server{Handler: handler}).Serve(listener)
+		}()
+		return listener
+	}
+
+	sendRequest := func(conn net.Conn) *bufio.Reader {
+		_, err := conn.Write([]byte("GET /healthz HTTP/1.1\r\n" +
+			"Host: localhost\r\n\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		return bufio.NewReader(conn)
+	}
+
+	// readStatus returns the status code of the response read from conn, or
+	// an error if none arrives before the timeout.
+	readStatus := func(conn net.Conn, reader *bufio.Reader,
+		timeout time.Duration) (int, error) {
+		Expect(conn.SetReadDeadline(
+			time.Now().Add(timeout))).To(Succeed())
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			return 0, err
+		}
+		defer response.Body.Close()
+		return response.StatusCode, nil
+	}
+
+	It("should hold connections beyond -max-connections", func() {
+		listener := listen([]string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-health-path=/healthz",
+			"-max-connections=1",
+		})
+		defer listener.Close()
+		address := listener.Addr().String()
+
+		first, err := net.Dial("tcp", address)
+		Expect(err).NotTo(HaveOccurred())
+		status, err := readStatus(first, sendRequest(first), time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status).To(Equal(http.StatusOK))
+
+		second, err := net.Dial("tcp", address)
+		Expect(err).NotTo(HaveOccurred())
+		defer second.Close()
+		reader := sendRequest(second)
+		_, err = readStatus(second, reader, 100*time.Millisecond)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(net.Error).Timeout()).To(BeTrue())
+
+		Expect(first.Close()).To(Succeed())
+		status, err = readStatus(second, reader, time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status).To(Equal(http.StatusOK))
+	})
+
+	It("should close connections beyond -max-conns-per-ip", func() {
+		listener := listen([]string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-health-path=/healthz",
+			"-max-conns-per-ip=2",
+		})
+		defer listener.Close()
+		address := listener.Addr().String()
+
+		var conns []net.Conn
+		for i := 0; i != 3; i++ {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns[:2] {
+			status, err := readStatus(
+				conn, sendRequest(conn), time.Second)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(http.StatusOK))
+		}
+		Expect(conns[2].SetReadDeadline(
+			time.Now().Add(time.Second))).To(Succeed())
+		_, err := conns[2].Read(make([]byte, 1))
+		Expect(err).To(HaveOccurred())
+		netErr, isNetErr := err.(net.Error)
+		Expect(isNetErr && netErr.Timeout()).To(BeFalse())
+
+		Expect(conns[0].Close()).To(Succeed())
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			_, err = readStatus(conn, sendRequest(conn),
+				100*time.Millisecond)
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should serve the same handler on every port", func() {
+		var ports []string
+		for i := 0; i != 2; i++ {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			_, port, err := net.SplitHostPort(
+				listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			ports = append(ports, port)
+			Expect(listener.Close()).To(Succeed())
+		}
+
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-health-path=/healthz",
+		})
+		Expect(opts.Ports.Set(strings.Join(ports, ","))).To(Succeed())
+		listeners, err := newListeners(opts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(listeners).To(HaveLen(2))
+		for _, listener := range listeners {
+			defer listener.Close()
+		}
+		go func() {
+			_ = serve(opts, handler, listeners)
+		}()
+
+		for _, port := range ports {
+			response, err := http.Get(
+				"http://127.0.0.1:" + port + "/healthz")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			body, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(string(body)).To(Equal("ok"))
+		}
+	})
+	It("should drop connections that send headers slowly", func() {
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-health-path=/healthz",
+			"-read-header-timeout=200ms",
+		})
+		listener, err := newListener(opts, "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			_ = newServer(opts, handler).Serve(listener)
+		}()
+		logs := gbytes.NewBuffer()
+		log.SetOutput(logs)
+		defer log.SetOutput(os.Stderr)
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		start := time.Now()
+		for _, line := range []string{
+			"GET /healthz HTTP/1.1\r\n", "Host: localhost\r\n"} {
+			if _, err = conn.Write([]byte(line)); err != nil {
+				break
+			}
+			time.Sleep(150 * time.Millisecond)
+		}
+		Expect(conn.SetReadDeadline(
+			time.Now().Add(time.Second))).To(Succeed())
+		_, err = ioutil.ReadAll(conn)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Eventually(logs).Should(gbytes.Say(
+			"closed connection from 127.0.0.1:[0-9]+: request " +
+				"headers not received within 200ms"))
+	})
+})
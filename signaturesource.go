@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"github.com/18F/hmacauth"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// authorizationScheme prefixes signatures sent in the Authorization header
+// when -signature-source lists authorization.
+const authorizationScheme = "HMAC "
+
+// signatureSource is a place in a request where -signature-source looks for
+// its signature: the -sign-header, the Authorization header, or a named
+// cookie or query parameter.
+type signatureSource struct {
+	kind string
+	name string
+}
+
+// parseSignatureSource parses a -signature-source entry: header,
+// authorization, cookie:NAME, or query:NAME.
+func parseSignatureSource(source string) (signatureSource, error) {
+	kind, name := source, ""
+	if i := strings.Index(source, ":"); i != -1 {
+		kind, name = source[:i], source[i+1:]
+	}
+	switch kind {
+	case "header", "authorization":
+		if name == "" && kind == source {
+			return signatureSource{kind, name}, nil
+		}
+	case "cookie", "query":
+		if name != "" {
+			return signatureSource{kind, name}, nil
+		}
+	}
+	return signatureSource{}, errors.New(
+		"invalid signature-source: " + source)
+}
+
+// signature returns the signature r carries in s, if any, using header as
+// the -sign-header.
+func (s signatureSource) signature(r *http.Request, header string) string {
+	switch s.kind {
+	case "header":
+		return r.Header.Get(header)
+	case "authorization":
+		value := r.Header.Get("Authorization")
+		if strings.HasPrefix(value, authorizationScheme) {
+			return strings.TrimPrefix(value, authorizationScheme)
+		}
+	case "cookie":
+		if cookie, err := r.Cookie(s.name); err == nil {
+			if value, err := url.QueryUnescape(
+				cookie.Value); err == nil {
+				return value
+			}
+		}
+	case "query":
+		return r.URL.Query().Get(s.name)
+	}
+	return ""
+}
+
+// signatureSourceAuth authenticates requests using the signature from the
+// first of its sources that carries one. Requests carrying different
+// signatures in different sources are rejected, so that one source can't
+// be used to smuggle a signature past another.
+type signatureSourceAuth struct {
+	hmacauth.HmacAuth
+	header  string
+	sources []signatureSource
+}
+
+// wrapSignatureSource applies the -signature-source option specified in opts
+// to auth.
+func wrapSignatureSource(opts *HmacProxyOpts,
+	auth hmacauth.HmacAuth) hmacauth.HmacAuth {
+	if len(opts.SignatureSources) == 0 {
+		return auth
+	}
+	var sources []signatureSource
+	for _, entry := range opts.SignatureSources {
+		source, err := parseSignatureSource(entry)
+		if err != nil {
+			panic(err.Error())
+		}
+		sources = append(sources, source)
+	}
+	return signatureSourceAuth{auth, opts.SignHeader, sources}
+}
+
+// AuthenticateRequest authenticates a copy of r whose -sign-header holds the
+// signature found, and from whose URL any query parameters used as sources
+// are removed, since the signature can't cover itself.
+func (a signatureSourceAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	c := copyRequest(r)
+	c.Header.Del(a.header)
+	rawQuery := r.URL.RawQuery
+	for _, source := range a.sources {
+		signature := source.signature(r, a.header)
+		if source.kind == "query" {
+			rawQuery = withoutQueryParam(rawQuery, source.name)
+		}
+		if signature == "" {
+			continue
+		} else if headerSignature == "" {
+			headerSignature = signature
+		} else if signature != headerSignature {
+			result = hmacauth.ResultInvalidFormat
+			return
+		}
+	}
+	if headerSignature == "" {
+		result = hmacauth.ResultNoSignature
+		return
+	}
+	c.Header.Set(a.header, headerSignature)
+	if rawQuery != r.URL.RawQuery {
+		u := *r.URL
+		u.RawQuery = rawQuery
+		c.URL = &u
+	}
+	result, headerSignature, computedSignature =
+		a.HmacAuth.AuthenticateRequest(c)
+	r.Body = c.Body
+	return
+}
+
+// withoutQueryParam removes each value of the parameter name from rawQuery,
+// leaving the other parameters as they were sent.
+func withoutQueryParam(rawQuery, name string) string {
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		key := param
+		if i := strings.Index(param, "="); i != -1 {
+			key = param[:i]
+		}
+		if unescaped, err := url.QueryUnescape(
+			key); err != nil || unescaped != name {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
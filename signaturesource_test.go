@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+)
+
+var _ = Describe("HmacProxy signature sources", func() {
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		flags := flag.NewFlagSet("HmacProxy signature sources",
+			flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-no-default-headers",
+			"-auth",
+			"-signature-source=header,cookie:hmac,query:sig",
+		})
+		server = httptest.NewServer(handler)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// sign returns the signature of a GET request for path.
+	sign := func(path string) string {
+		request, err := http.NewRequest("GET", server.URL+path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		return hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+			"Test-Signature", nil).Sign(request)
+	}
+
+	// send sends request, returning the response status.
+	send := func(request *http.Request) int {
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		return response.StatusCode
+	}
+
+	It("should fall back to a cookie", func() {
+		request, err := http.NewRequest("GET", server.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.AddCookie(&http.Cookie{Name: "hmac",
+			Value: url.QueryEscape(sign("/"))})
+		Expect(send(request)).To(Equal(http.StatusAccepted))
+	})
+
+	It("should fall back to a query parameter it doesn't sign", func() {
+		request, err := http.NewRequest("GET", server.URL+"/?a=b&sig="+
+			url.QueryEscape(sign("/?a=b"))+"&c=d", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(send(request)).To(Equal(http.StatusUnauthorized))
+
+		request, err = http.NewRequest("GET", server.URL+"/?a=b&sig="+
+			url.QueryEscape(sign("/?a=b&c=d"))+"&c=d", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(send(request)).To(Equal(http.StatusAccepted))
+	})
+
+	It("should reject conflicting signatures", func() {
+		request, err := http.NewRequest("GET", server.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("Test-Signature", sign("/"))
+		request.AddCookie(&http.Cookie{Name: "hmac",
+			Value: url.QueryEscape(sign("/other"))})
+		Expect(send(request)).To(Equal(http.StatusUnauthorized))
+
+		request.Header.Del("Cookie")
+		request.AddCookie(&http.Cookie{Name: "hmac",
+			Value: url.QueryEscape(sign("/"))})
+		Expect(send(request)).To(Equal(http.StatusAccepted))
+	})
+
+	It("should ignore sources that aren't listed", func() {
+		request, err := http.NewRequest("GET", server.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("Authorization", "HMAC "+sign("/"))
+		Expect(send(request)).To(Equal(http.StatusUnauthorized))
+	})
+})
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/18F/hmacauth"
+	"net/http"
+	"strings"
+)
+
+// dynamicHeadersAuth signs and authenticates each request using the headers
+// listed in the request's -dynamic-signed-headers-from header, rather than a
+// fixed -headers list. Every listed header must appear in
+// -allowed-signed-headers. The listing header is always signed itself, so
+// that removing headers from the list invalidates the signature.
+type dynamicHeadersAuth struct {
+	opts    HmacProxyOpts
+	newAuth func(opts *HmacProxyOpts) hmacauth.HmacAuth
+	from    string
+	allowed map[string]bool
+}
+
+// newDynamicHeadersAuth returns a dynamicHeadersAuth that creates the
+// hmacauth.HmacAuth for each request using newAuth, or the result of newAuth
+// itself if opts doesn't specify -dynamic-signed-headers-from.
+func newDynamicHeadersAuth(opts *HmacProxyOpts,
+	newAuth func(opts *HmacProxyOpts) hmacauth.HmacAuth) hmacauth.HmacAuth {
+	if opts.DynamicSignedHeadersFrom == "" {
+		return newAuth(opts)
+	}
+	allowed := make(map[string]bool)
+	for _, header := range opts.AllowedSignedHeaders {
+		allowed[http.CanonicalHeaderKey(header)] = true
+	}
+	return dynamicHeadersAuth{*opts, newAuth,
+		http.CanonicalHeaderKey(opts.DynamicSignedHeadersFrom), allowed}
+}
+
+// requestAuth returns the hmacauth.HmacAuth for the headers listed by r, or
+// false if r lists a header that isn't allowed.
+func (a dynamicHeadersAuth) requestAuth(r *http.Request) (
+	hmacauth.HmacAuth, bool) {
+	headers := []string{a.from}
+	for _, header := range strings.Split(r.Header.Get(a.from), ",") {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+		if header == "" {
+			continue
+		} else if !a.allowed[header] {
+			return nil, false
+		}
+		headers = append(headers, header)
+	}
+	opts := a.opts
+	opts.Headers = headers
+	return a.newAuth(&opts), true
+}
+
+// withHeaderList lists the -headers in r's -dynamic-signed-headers-from
+// header if the client didn't list any, and returns the auth for r.
+func (a dynamicHeadersAuth) withHeaderList(r *http.Request) (
+	hmacauth.HmacAuth, bool) {
+	if _, ok := r.Header[a.from]; !ok {
+		r.Header.Set(a.from, strings.Join(a.opts.Headers, ","))
+	}
+	return a.requestAuth(r)
+}
+
+func (a dynamicHeadersAuth) Sign(r *http.Request) string {
+	if auth, ok := a.withHeaderList(r); ok {
+		return auth.Sign(r)
+	}
+	return ""
+}
+
+// SignRequest has signingHandler reject r if it lists a header that isn't
+// allowed.
+func (a dynamicHeadersAuth) SignRequest(r *http.Request) {
+	if signature := a.Sign(r); signature != "" {
+		r.Header.Set(a.opts.SignHeader, signature)
+	} else {
+		failSigning(r, "signed headers not allowed: "+
+			r.Header.Get(a.from), http.StatusBadRequest)
+	}
+}
+
+func (a dynamicHeadersAuth) StringToSign(r *http.Request) string {
+	if auth, ok := a.requestAuth(r); ok {
+		return auth.StringToSign(r)
+	}
+	return ""
+}
+
+func (a dynamicHeadersAuth) SignatureFromHeader(r *http.Request) string {
+	return r.Header.Get(a.opts.SignHeader)
+}
+
+func (a dynamicHeadersAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	auth, ok := a.requestAuth(r)
+	if !ok {
+		headerSignature = a.SignatureFromHeader(r)
+		result = hmacauth.ResultInvalidFormat
+		if headerSignature == "" {
+			result = hmacauth.ResultNoSignature
+		}
+		return
+	}
+	return auth.AuthenticateRequest(r)
+}
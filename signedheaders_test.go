@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("HmacProxy dynamic signed headers", func() {
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		flags := flag.NewFlagSet(
+			"HmacProxy dynamic signed headers", flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-dynamic-signed-headers-from=Signed-Headers",
+			"-allowed-signed-headers=X-Foo,X-Bar,Content-Type",
+		})
+		server = httptest.NewServer(handler)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// send signs a request covering headers, after setting its
+	// Signed-Headers header to signedHeaders, then applies modify to the
+	// request before sending it.
+	send := func(signedHeaders string, headers []string,
+		modify func(r *http.Request)) int {
+		request, err := http.NewRequest("GET", server.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("X-Foo", "foo")
+		request.Header.Set("X-Bar", "bar")
+		request.Header.Set("Signed-Headers", signedHeaders)
+		hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+			"Test-Signature", headers).SignRequest(request)
+		if modify != nil {
+			modify(request)
+		}
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		return response.StatusCode
+	}
+
+	It("should authenticate the headers the client lists", func() {
+		Expect(send("x-foo", []string{"Signed-Headers", "X-Foo"},
+			nil)).To(Equal(http.StatusAccepted))
+	})
+
+	It("should reject a modified listed header", func() {
+		Expect(send("X-Foo", []string{"Signed-Headers", "X-Foo"},
+			func(r *http.Request) {
+				r.Header.Set("X-Foo", "changed")
+			})).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should ignore unlisted headers", func() {
+		Expect(send("X-Foo", []string{"Signed-Headers", "X-Foo"},
+			func(r *http.Request) {
+				r.Header.Set("X-Bar", "changed")
+			})).To(Equal(http.StatusAccepted))
+	})
+
+	It("should reject a request whose list was shortened", func() {
+		Expect(send("X-Foo, X-Bar",
+			[]string{"Signed-Headers", "X-Foo", "X-Bar"},
+			func(r *http.Request) {
+				r.Header.Set("Signed-Headers", "X-Foo")
+			})).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject headers missing from the allowlist", func() {
+		Expect(send("X-Foo,Authorization",
+			[]string{"Signed-Headers", "X-Foo", "Authorization"},
+			nil)).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should authenticate requests signed by the proxy", func() {
+		flags := flag.NewFlagSet("HmacProxy dynamic signed headers "+
+			"(local)", flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-headers=X-Foo",
+			"-upstream=" + server.URL,
+			"-dynamic-signed-headers-from=Signed-Headers",
+			"-allowed-signed-headers=X-Foo",
+		})
+		local := httptest.NewServer(handler)
+		defer local.Close()
+
+		request, err := http.NewRequest("GET", local.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("X-Foo", "foo")
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusAccepted))
+	})
+
+	Context("when signing", func() {
+		var (
+			opts  *HmacProxyOpts
+			flags *flag.FlagSet
+		)
+
+		BeforeEach(func() {
+			flags = flag.NewFlagSet("HmacProxy dynamic signed "+
+				"headers (local)", flag.ContinueOnError)
+			opts = RegisterCommandLineOptions(flags)
+		})
+
+		It("should require -headers to be allowed", func() {
+			err := flags.Parse([]string{
+				"-port=8080",
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-headers=X-Foo,X-Baz",
+				"-upstream=" + server.URL,
+				"-dynamic-signed-headers-from=Signed-Headers",
+				"-allowed-signed-headers=X-Foo",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts.Validate()).To(MatchError(optionErrors(
+				[]string{"headers must be listed in " +
+					"-allowed-signed-headers: X-Baz"})))
+		})
+
+		It("should reject requests listing headers that aren't "+
+			"allowed", func() {
+			handler, _ := newHandler(flags, opts, []string{
+				"-secret=foobar",
+				"-sign-header=Test-Signature",
+				"-headers=X-Foo",
+				"-upstream=" + server.URL,
+				"-dynamic-signed-headers-from=Signed-Headers",
+				"-allowed-signed-headers=X-Foo",
+			})
+			local := httptest.NewServer(handler)
+			defer local.Close()
+
+			request, err := http.NewRequest(
+				"GET", local.URL+"/", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Signed-Headers", "X-Foo,Cookie")
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(
+				Equal(http.StatusBadRequest))
+		})
+	})
+})
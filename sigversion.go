@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/18F/hmacauth"
+	"net/http"
+	"time"
+)
+
+// sigVersionHeader is the request header that selects which version of the
+// signing scheme was used to produce, or should be used to produce, the
+// request signature.
+const sigVersionHeader = "X-Sig-Version"
+
+// defaultSigVersion is the version of the signing scheme applied to requests
+// that do not contain a sigVersionHeader.
+const defaultSigVersion = "v1"
+
+// canonicalizationStrategies maps each supported sigVersionHeader value to a
+// function that creates the hmacauth.HmacAuth implementing that version of
+// the signing scheme. New schemes may be added here without breaking clients
+// that use older versions.
+var canonicalizationStrategies = map[string]func(
+	opts *HmacProxyOpts) hmacauth.HmacAuth{
+	"v1": func(opts *HmacProxyOpts) hmacauth.HmacAuth {
+		return hmacauth.NewHmacAuth(opts.Digest.ID,
+			[]byte(opts.Secret), opts.SignHeader, opts.Headers)
+	},
+}
+
+type sigVersionHandler struct {
+	versions map[string]http.Handler
+}
+
+func (h sigVersionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	version := r.Header.Get(sigVersionHeader)
+	if version == "" {
+		version = defaultSigVersion
+	}
+	if handler, ok := h.versions[version]; ok {
+		handler.ServeHTTP(w, r)
+	} else {
+		writeError(w, r, "unsupported "+sigVersionHeader+": "+version,
+			http.StatusBadRequest)
+	}
+}
+
+// deprecationHandler marks each response to a request using a deprecated
+// version of the signing scheme with a Deprecation header and, if a sunset
+// time is set, a Sunset header, so that clients learn to upgrade.
+type deprecationHandler struct {
+	sunset  time.Time
+	handler http.Handler
+}
+
+func (h deprecationHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	w.Header().Set("Deprecation", "true")
+	if !h.sunset.IsZero() {
+		w.Header().Set("Sunset", h.sunset.UTC().Format(http.TimeFormat))
+	}
+	h.handler.ServeHTTP(w, r)
+}
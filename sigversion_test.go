@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("HmacProxy signature versions", func() {
+	var (
+		auth   hmacauth.HmacAuth
+		server *httptest.Server
+	)
+
+	BeforeEach(func() {
+		flags := flag.NewFlagSet(
+			"HmacProxy signature versions", flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-no-default-headers",
+			"-auth",
+		})
+		server = httptest.NewServer(handler)
+		auth = hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+			"Test-Signature", nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	sendSigned := func(version string) (int, string) {
+		request, err := http.NewRequest("GET", server.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		if version != "" {
+			request.Header.Set("X-Sig-Version", version)
+		}
+		auth.SignRequest(request)
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return response.StatusCode, string(body)
+	}
+
+	It("should validate a v1 request", func() {
+		status, _ := sendSigned("v1")
+		Expect(status).To(Equal(http.StatusAccepted))
+	})
+
+	It("should treat a request without a version as v1", func() {
+		status, _ := sendSigned("")
+		Expect(status).To(Equal(http.StatusAccepted))
+	})
+
+	It("should reject an unknown version", func() {
+		status, body := sendSigned("v9")
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(body).To(Equal("unsupported X-Sig-Version: v9\n"))
+	})
+})
+
+var _ = Describe("HmacProxy deprecated signature versions", func() {
+	BeforeEach(func() {
+		canonicalizationStrategies["v2"] =
+			canonicalizationStrategies["v1"]
+	})
+
+	AfterEach(func() {
+		delete(canonicalizationStrategies, "v2")
+	})
+
+	// headers sends a request using version to a proxy configured by
+	// argv, returning its Deprecation and Sunset response headers.
+	headers := func(version string, argv ...string) (string, string) {
+		flags := flag.NewFlagSet(
+			"HmacProxy deprecated signature versions",
+			flag.ContinueOnError)
+		opts := RegisterCommandLineOptions(flags)
+		handler, _ := newHandler(flags, opts, append([]string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-no-default-headers",
+			"-auth",
+		}, argv...))
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		request, err := http.NewRequest("GET", server.URL+"/", nil)
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set("X-Sig-Version", version)
+		hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+			"Test-Signature", nil).SignRequest(request)
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusAccepted))
+		return response.Header.Get("Deprecation"),
+			response.Header.Get("Sunset")
+	}
+
+	It("should mark responses to deprecated versions", func() {
+		deprecation, sunset := headers("v1",
+			"-deprecate-sig-version=v1",
+			"-sig-version-sunset=2027-01-01T00:00:00Z")
+		Expect(deprecation).To(Equal("true"))
+		Expect(sunset).To(Equal("Fri, 01 Jan 2027 00:00:00 GMT"))
+	})
+
+	It("should not mark responses to other versions", func() {
+		deprecation, sunset := headers("v2",
+			"-deprecate-sig-version=v1",
+			"-sig-version-sunset=2027-01-01T00:00:00Z")
+		Expect(deprecation).To(BeEmpty())
+		Expect(sunset).To(BeEmpty())
+	})
+
+	It("should omit Sunset without -sig-version-sunset", func() {
+		deprecation, sunset := headers("v1",
+			"-deprecate-sig-version=v1")
+		Expect(deprecation).To(Equal("true"))
+		Expect(sunset).To(BeEmpty())
+	})
+})
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// newTLSListener returns a net.Listener that terminates TLS for the
+// connections accepted by listener, using the certificate and TLS settings
+// specified in opts.
+func newTLSListener(opts *HmacProxyOpts, listener net.Listener) (
+	net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(opts.SslCert, opts.SslKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if len(opts.TLSALPN) != 0 {
+		config.NextProtos = opts.TLSALPN
+	}
+
+	if opts.TLSSessionMaxAge > 0 {
+		stop := make(chan struct{})
+		err = rotateSessionTicketKeys(config, opts.TLSSessionMaxAge, stop)
+		if err != nil {
+			return nil, err
+		}
+		listener = &stopListener{Listener: listener, stop: stop}
+	}
+	return tls.NewListener(listener, config), nil
+}
+
+// rotateSessionTicketKeys replaces the session ticket key of config every
+// maxAge until stop is closed. Only the newest key is kept, so clients cannot
+// resume sessions established more than maxAge ago.
+func rotateSessionTicketKeys(config *tls.Config, maxAge time.Duration,
+	stop <-chan struct{}) error {
+	if err := setNewSessionTicketKey(config); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(maxAge)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := setNewSessionTicketKey(config); err != nil {
+					log.Printf("failed to rotate TLS session "+
+						"ticket key: %s", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func setNewSessionTicketKey(config *tls.Config) error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	config.SetSessionTicketKeys([][32]byte{key})
+	return nil
+}
+
+// stopListener closes its stop channel when closed, to end any goroutines
+// that maintain state for the listener.
+type stopListener struct {
+	net.Listener
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *stopListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.stop) })
+	return err
+}
+
+// httpsRedirectHandler permanently redirects each request to the same URL
+// using HTTPS on port.
+type httpsRedirectHandler struct {
+	port int
+}
+
+func (h httpsRedirectHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if h.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(h.port))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(),
+		http.StatusMovedPermanently)
+}
+
+// clientCertificate holds the certificate presented to the -upstream server,
+// reloading it from certFile and keyFile when either changes, so that a
+// rotated certificate is used from the next connection on without a restart.
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	files    []os.FileInfo
+	cert     atomic.Value
+}
+
+// newClientCertificate returns a clientCertificate holding the certificate
+// loaded from certFile and keyFile.
+func newClientCertificate(certFile, keyFile string) (
+	*clientCertificate, error) {
+	c := &clientCertificate{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// changed reports whether any of files differs from c.files, having been
+// replaced or modified.
+func (c *clientCertificate) changed(files []os.FileInfo) bool {
+	if len(c.files) != len(files) {
+		return true
+	}
+	for i, file := range files {
+		if !os.SameFile(c.files[i], file) ||
+			!c.files[i].ModTime().Equal(file.ModTime()) ||
+			c.files[i].Size() != file.Size() {
+			return true
+		}
+	}
+	return false
+}
+
+// reload loads the certificate again if either of its files has changed
+// since it was last loaded.
+func (c *clientCertificate) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var files []os.FileInfo
+	for _, path := range []string{c.certFile, c.keyFile} {
+		file, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	if !c.changed(files) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert.Store(&cert)
+	c.files = files
+	return nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate. If the
+// certificate fails to reload, perhaps because only one of its files has been
+// replaced so far, the previous certificate is used until it succeeds.
+func (c *clientCertificate) GetClientCertificate(
+	*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if err := c.reload(); err != nil {
+		log.Printf("failed to reload upstream-client-cert: %s", err)
+	}
+	return c.cert.Load().(*tls.Certificate), nil
+}
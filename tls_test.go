@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key into dir, returning the paths of both files.
+func writeTestCertificate(dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"hmacproxy"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)).To(Succeed())
+	return
+}
+
+var _ = Describe("HmacProxy TLS listener", func() {
+	var (
+		opts              *HmacProxyOpts
+		flags             *flag.FlagSet
+		dir               string
+		certFile, keyFile string
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet(
+			"HmacProxy TLS listener", flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+
+		var err error
+		dir, err = ioutil.TempDir("", "hmacproxy-test")
+		Expect(err).NotTo(HaveOccurred())
+		certFile, keyFile = writeTestCertificate(dir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	listen := func(argv []string) net.Listener {
+		handler, _ := newHandler(flags, opts, append(argv,
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-auth",
+			"-health-path=/healthz",
+			"-ssl-cert="+certFile,
+			"-ssl-key="+keyFile,
+		))
+		listener, err := newListener(opts, "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		go func() {
+			_ = (&http.Server{Handler: handler}).Serve(listener)
+		}()
+		return listener
+	}
+
+	It("should expire resumable sessions after the max age", func() {
+		listener := listen([]string{"-tls-session-max-age=500ms"})
+		defer listener.Close()
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				ClientSessionCache: tls.NewLRUClientSessionCache(1),
+			},
+			DisableKeepAlives: true,
+		}}
+		didResume := func() bool {
+			response, err := client.Get(
+				"https://" + listener.Addr().String() + "/healthz")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			Expect(readBody(response)).To(Equal("ok"))
+			return response.TLS.DidResume
+		}
+
+		Expect(didResume()).To(BeFalse())
+		Expect(didResume()).To(BeTrue())
+		time.Sleep(700 * time.Millisecond)
+		Expect(didResume()).To(BeFalse())
+		Expect(didResume()).To(BeTrue())
+	})
+
+	negotiate := func(listener net.Listener) string {
+		conn, err := tls.Dial("tcp", listener.Addr().String(),
+			&tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{"h2", "http/1.1"},
+			})
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		return conn.ConnectionState().NegotiatedProtocol
+	}
+
+	It("should offer h2 and http/1.1 by default", func() {
+		listener := listen(nil)
+		defer listener.Close()
+		Expect(negotiate(listener)).To(Equal("h2"))
+	})
+
+	It("should offer only the protocols set by -tls-alpn", func() {
+		listener := listen([]string{"-tls-alpn=http/1.1"})
+		defer listener.Close()
+		Expect(negotiate(listener)).To(Equal("http/1.1"))
+	})
+
+	It("should redirect plaintext requests to the TLS port", func() {
+		listener := listen(nil)
+		defer listener.Close()
+		_, port, err := net.SplitHostPort(listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		tlsPort, err := strconv.Atoi(port)
+		Expect(err).NotTo(HaveOccurred())
+		redirects := httptest.NewServer(httpsRedirectHandler{tlsPort})
+		defer redirects.Close()
+
+		client := &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		response, err := client.Get(redirects.URL + "/healthz?a=b")
+		Expect(err).NotTo(HaveOccurred())
+		response.Body.Close()
+		Expect(response.StatusCode).To(
+			Equal(http.StatusMovedPermanently))
+		location := response.Header.Get("Location")
+		Expect(location).To(Equal(
+			"https://127.0.0.1:" + port + "/healthz?a=b"))
+
+		client = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		response, err = client.Get(location)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(response)).To(Equal("ok"))
+	})
+})
+
+var _ = Describe("HmacProxy upstream client certificate", func() {
+	var (
+		opts     *HmacProxyOpts
+		flags    *flag.FlagSet
+		dir      string
+		upstream *httptest.Server
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet(
+			"HmacProxy upstream client certificate",
+			flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+
+		var err error
+		dir, err = ioutil.TempDir("", "hmacproxy-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		// The upstream server responds with the certificate presented
+		// by the client.
+		upstream = httptest.NewUnstartedServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write(r.TLS.PeerCertificates[0].Raw)
+			}))
+		upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		upstream.StartTLS()
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+		os.RemoveAll(dir)
+	})
+
+	// certificate returns the DER encoding of the certificate in certFile.
+	certificate := func(certFile, keyFile string) string {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		Expect(err).NotTo(HaveOccurred())
+		return string(cert.Certificate[0])
+	}
+
+	It("should use a rotated certificate for new connections", func() {
+		certFile, keyFile := writeTestCertificate(dir)
+		original := certificate(certFile, keyFile)
+		newDir := filepath.Join(dir, "new")
+		Expect(os.Mkdir(newDir, 0700)).To(Succeed())
+		newCertFile, newKeyFile := writeTestCertificate(newDir)
+		rotated := certificate(newCertFile, newKeyFile)
+		Expect(rotated).NotTo(Equal(original))
+
+		_, _ = newHandler(flags, opts, []string{
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-upstream=" + upstream.URL,
+			"-upstream-client-cert=" + certFile,
+			"-upstream-client-key=" + keyFile,
+		})
+		trusted := upstream.Client().Transport.(*http.Transport)
+		transport := newUpstreamTransport(opts)
+		transport.TLSClientConfig.RootCAs =
+			trusted.TLSClientConfig.RootCAs
+		transport.DisableKeepAlives = true
+		client := &http.Client{Transport: transport}
+		presented := func() string {
+			response, err := client.Get(upstream.URL + "/")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+			return readBody(response)
+		}
+
+		Expect(presented()).To(Equal(original))
+		Expect(os.Rename(newCertFile, certFile)).To(Succeed())
+		Expect(os.Rename(newKeyFile, keyFile)).To(Succeed())
+		Expect(presented()).To(Equal(rotated))
+	})
+})
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// maxTransformOutput limits how much output is read from -transform-cmd.
+const maxTransformOutput = 64 * 1024
+
+// transformInput is the request metadata written as JSON to the standard
+// input of -transform-cmd.
+type transformInput struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Host       string      `json:"host"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+}
+
+type transformHandler struct {
+	command string
+	timeout time.Duration
+	handler http.Handler
+}
+
+// newTransformHandler returns a http.Handler that runs opts.TransformCmd to
+// rewrite the headers of each request before passing it to handler. If
+// opts.TransformCmd is empty, it returns handler unchanged.
+//
+// The program receives the request's metadata as a JSON object on its
+// standard input, and writes one "Name: value" line to its standard output
+// for each header to set. A line with an empty value removes the header.
+func newTransformHandler(opts *HmacProxyOpts,
+	handler http.Handler) http.Handler {
+	if opts.TransformCmd == "" {
+		return handler
+	}
+	return transformHandler{opts.TransformCmd, opts.TransformTimeout,
+		handler}
+}
+
+func (h transformHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	headers, err := h.run(r)
+	if err != nil {
+		log.Printf("transform-cmd %s failed: %s", h.command, err)
+		writeError(w, r, "request transform failed",
+			http.StatusInternalServerError)
+		return
+	}
+	for name, value := range headers {
+		if value == "" {
+			r.Header.Del(name)
+		} else {
+			r.Header.Set(name, value)
+		}
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// run executes the transform program for r and returns the headers it
+// produced.
+func (h transformHandler) run(r *http.Request) (map[string]string, error) {
+	input, err := json.Marshal(transformInput{
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Header:     r.Header,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+	// Rather than exec.CommandContext, which kills the program but then
+	// waits for its output to close, wait for the program only until the
+	// deadline, since programs it starts in the background may hold its
+	// output open long after.
+	var output transformOutput
+	cmd := exec.Command(h.command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = cmd.Process.Kill()
+		return nil, errors.New("timed out after " + h.timeout.String())
+	}
+	if err != nil {
+		return nil, err
+	} else if output.overflowed {
+		return nil, errors.New("too much output")
+	}
+	return parseTransformOutput(output.Bytes())
+}
+
+// transformOutput keeps the first maxTransformOutput bytes written to it,
+// discarding the rest.
+type transformOutput struct {
+	bytes.Buffer
+	overflowed bool
+}
+
+func (o *transformOutput) Write(p []byte) (int, error) {
+	if room := maxTransformOutput - o.Len(); len(p) > room {
+		o.overflowed = true
+		_, _ = o.Buffer.Write(p[:room])
+	} else {
+		_, _ = o.Buffer.Write(p)
+	}
+	return len(p), nil
+}
+
+func parseTransformOutput(output []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, errors.New("invalid output line: " + line)
+		}
+		name := http.CanonicalHeaderKey(strings.TrimSpace(line[:i]))
+		headers[name] = strings.TrimSpace(line[i+1:])
+	}
+	return headers, scanner.Err()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"github.com/18F/hmacauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// signedHeaderServer reports whether a request's signature matches, followed
+// by the value of the X-Transformed header.
+type signedHeaderServer struct {
+	auth hmacauth.HmacAuth
+}
+
+func (s signedHeaderServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result, _, _ := s.auth.AuthenticateRequest(r)
+	_, _ = w.Write([]byte(result.String() + " " +
+		r.Header.Get("X-Transformed")))
+}
+
+var _ = Describe("HmacProxy request transforms", func() {
+	var (
+		opts     *HmacProxyOpts
+		flags    *flag.FlagSet
+		upstream *httptest.Server
+		dir      string
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet(
+			"HmacProxy request transforms", flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+		upstream = httptest.NewServer(signedHeaderServer{
+			hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+				"Test-Signature", []string{"X-Transformed"})})
+
+		var err error
+		dir, err = ioutil.TempDir("", "hmacproxy-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+		os.RemoveAll(dir)
+	})
+
+	script := func(body string) string {
+		path := filepath.Join(dir, "transform.sh")
+		err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755)
+		Expect(err).NotTo(HaveOccurred())
+		return path
+	}
+
+	get := func(argv []string) (int, string) {
+		handler, _ := newHandler(flags, opts, append(argv,
+			"-secret=foobar",
+			"-sign-header=Test-Signature",
+			"-headers=X-Transformed",
+			"-upstream="+upstream.URL,
+		))
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		response, err := http.Get(server.URL + "/")
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return response.StatusCode, string(body)
+	}
+
+	It("should sign headers added by the transform", func() {
+		transform := script("grep -q '\"method\":\"GET\"' || exit 1\n" +
+			"echo 'X-Transformed: yes'\n")
+		status, body := get([]string{"-transform-cmd=" + transform})
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("ResultMatch yes"))
+	})
+
+	It("should fail when the transform times out", func() {
+		status, body := get([]string{
+			"-transform-cmd=" + script("exec sleep 5\n"),
+			"-transform-timeout=50ms",
+		})
+		Expect(status).To(Equal(http.StatusInternalServerError))
+		Expect(body).To(Equal("request transform failed\n"))
+	})
+
+	It("should time out when the transform's children hold its output "+
+		"open", func() {
+		start := time.Now()
+		status, _ := get([]string{
+			"-transform-cmd=" + script("sleep 5 &\nsleep 5\n"),
+			"-transform-timeout=50ms",
+		})
+		Expect(status).To(Equal(http.StatusInternalServerError))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("should fail when the transform output is invalid", func() {
+		status, _ := get([]string{"-transform-cmd=" + script(
+			"echo 'not a header'\n")})
+		Expect(status).To(Equal(http.StatusInternalServerError))
+	})
+})
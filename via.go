@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// viaEntry returns the entry a proxy adds to the Via header (RFC 7230,
+// section 5.7.1) of a message it received using the given HTTP version.
+func viaEntry(major, minor int, pseudonym string) string {
+	version := strconv.Itoa(major)
+	if major < 2 {
+		version += "." + strconv.Itoa(minor)
+	}
+	return version + " " + pseudonym
+}
+
+// appendVia adds entry to the end of the chain of proxies listed in the Via
+// header, combining any existing Via fields into one.
+func appendVia(header http.Header, entry string) {
+	if chain := header["Via"]; len(chain) != 0 {
+		entry = strings.Join(chain, ", ") + ", " + entry
+	}
+	header.Set("Via", entry)
+}
+
+// addVia updates proxy to add an entry to the Via header of each request it
+// forwards and each response it returns.
+func addVia(proxy *httputil.ReverseProxy, pseudonym string) {
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		appendVia(r.Header, viaEntry(r.ProtoMajor, r.ProtoMinor,
+			pseudonym))
+	}
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(response *http.Response) error {
+		appendVia(response.Header, viaEntry(response.ProtoMajor,
+			response.ProtoMinor, pseudonym))
+		if modifyResponse == nil {
+			return nil
+		}
+		return modifyResponse(response)
+	}
+}
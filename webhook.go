@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/18F/hmacauth"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookPreset describes how a webhook provider signs its requests.
+type webhookPreset struct {
+	signHeader string
+	newAuth    func(key []byte) hmacauth.HmacAuth
+}
+
+// webhookPresets maps each -webhook-preset value to the signing scheme of
+// the corresponding provider.
+var webhookPresets = map[string]webhookPreset{
+	"github": {"X-Hub-Signature-256", func(key []byte) hmacauth.HmacAuth {
+		return githubWebhookAuth{key}
+	}},
+	"stripe": {"Stripe-Signature", func(key []byte) hmacauth.HmacAuth {
+		return stripeWebhookAuth{key, time.Now}
+	}},
+}
+
+// stripeTolerance is how far the timestamp of a Stripe signature may differ
+// from the current time, matching Stripe's own client libraries.
+const stripeTolerance = 5 * time.Minute
+
+// newWebhookAuth returns the hmacauth.HmacAuth implementing the signing
+// scheme of opts.WebhookPreset.
+func newWebhookAuth(opts *HmacProxyOpts) hmacauth.HmacAuth {
+	return webhookPresets[opts.WebhookPreset].newAuth([]byte(opts.Secret))
+}
+
+// readRequestBody returns the body of r, replacing r.Body so that it may
+// still be forwarded.
+func readRequestBody(r *http.Request) []byte {
+	if r.Body == nil {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	_ = r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body
+}
+
+func hexHmacSha256(key []byte, data ...[]byte) string {
+	h := hmac.New(sha256.New, key)
+	for _, d := range data {
+		_, _ = h.Write(d)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// githubWebhookAuth implements GitHub's webhook signatures, which consist of
+// "sha256=" followed by the hex HMAC-SHA256 of the request body in the
+// X-Hub-Signature-256 header.
+type githubWebhookAuth struct {
+	key []byte
+}
+
+func (a githubWebhookAuth) Sign(r *http.Request) string {
+	return "sha256=" + hexHmacSha256(a.key, readRequestBody(r))
+}
+
+func (a githubWebhookAuth) SignRequest(r *http.Request) {
+	r.Header.Set(webhookPresets["github"].signHeader, a.Sign(r))
+}
+
+func (a githubWebhookAuth) StringToSign(r *http.Request) string {
+	return string(readRequestBody(r))
+}
+
+func (a githubWebhookAuth) SignatureFromHeader(r *http.Request) string {
+	return r.Header.Get(webhookPresets["github"].signHeader)
+}
+
+func (a githubWebhookAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	headerSignature = a.SignatureFromHeader(r)
+	if headerSignature == "" {
+		result = hmacauth.ResultNoSignature
+		return
+	} else if !strings.HasPrefix(headerSignature, "sha256=") {
+		result = hmacauth.ResultInvalidFormat
+		return
+	}
+	computedSignature = a.Sign(r)
+	if hmac.Equal([]byte(headerSignature), []byte(computedSignature)) {
+		result = hmacauth.ResultMatch
+	} else {
+		result = hmacauth.ResultMismatch
+	}
+	return
+}
+
+// stripeWebhookAuth implements Stripe's webhook signatures, which consist of
+// "t=<timestamp>,v1=<signature>" in the Stripe-Signature header, where the
+// signature is the hex HMAC-SHA256 of the timestamp, a period, and the
+// request body. The header may contain more than one v1 signature.
+type stripeWebhookAuth struct {
+	key []byte
+	now func() time.Time
+}
+
+func (a stripeWebhookAuth) signature(timestamp string, body []byte) string {
+	return hexHmacSha256(a.key, []byte(timestamp+"."), body)
+}
+
+func (a stripeWebhookAuth) Sign(r *http.Request) string {
+	timestamp := strconv.FormatInt(a.now().Unix(), 10)
+	return "t=" + timestamp + ",v1=" +
+		a.signature(timestamp, readRequestBody(r))
+}
+
+func (a stripeWebhookAuth) SignRequest(r *http.Request) {
+	r.Header.Set(webhookPresets["stripe"].signHeader, a.Sign(r))
+}
+
+func (a stripeWebhookAuth) StringToSign(r *http.Request) string {
+	return string(readRequestBody(r))
+}
+
+func (a stripeWebhookAuth) SignatureFromHeader(r *http.Request) string {
+	return r.Header.Get(webhookPresets["stripe"].signHeader)
+}
+
+func (a stripeWebhookAuth) AuthenticateRequest(r *http.Request) (
+	result hmacauth.AuthenticationResult, headerSignature,
+	computedSignature string) {
+	headerSignature = a.SignatureFromHeader(r)
+	if headerSignature == "" {
+		result = hmacauth.ResultNoSignature
+		return
+	}
+
+	var timestamp string
+	var signatures []string
+	for _, item := range strings.Split(headerSignature, ",") {
+		if strings.HasPrefix(item, "t=") {
+			timestamp = item[len("t="):]
+		} else if strings.HasPrefix(item, "v1=") {
+			signatures = append(signatures, item[len("v1="):])
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		result = hmacauth.ResultInvalidFormat
+		return
+	}
+
+	computedSignature = a.signature(timestamp, readRequestBody(r))
+	result = hmacauth.ResultMismatch
+	age := a.now().Sub(time.Unix(seconds, 0))
+	if age > stripeTolerance || age < -stripeTolerance {
+		return
+	}
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(computedSignature)) {
+			result = hmacauth.ResultMatch
+		}
+	}
+	return
+}
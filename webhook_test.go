@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ = Describe("HmacProxy webhook presets", func() {
+	var (
+		opts  *HmacProxyOpts
+		flags *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet(
+			"HmacProxy webhook presets", flag.ContinueOnError)
+		opts = RegisterCommandLineOptions(flags)
+	})
+
+	authServer := func(argv []string) *httptest.Server {
+		handler, _ := newHandler(flags, opts, argv)
+		return httptest.NewServer(handler)
+	}
+
+	post := func(url, header, signature, body string) int {
+		request, err := http.NewRequest(
+			"POST", url, strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		request.Header.Set(header, signature)
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		return response.StatusCode
+	}
+
+	Context("with -webhook-preset=github", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			// The secret, payload, and signature come from GitHub's
+			// webhook validation documentation.
+			server = authServer([]string{
+				"-secret=It's a Secret to Everybody",
+				"-auth",
+				"-webhook-preset=github",
+			})
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should accept a valid signature", func() {
+			Expect(post(server.URL, "X-Hub-Signature-256",
+				"sha256=757107ea0eb2509fc211221cce984b8a"+
+					"37570b6d7586c22c46f4379c8b043e17",
+				"Hello, World!")).To(Equal(http.StatusAccepted))
+		})
+
+		It("should reject a modified payload", func() {
+			Expect(post(server.URL, "X-Hub-Signature-256",
+				"sha256=757107ea0eb2509fc211221cce984b8a"+
+					"37570b6d7586c22c46f4379c8b043e17",
+				"Goodbye, World!")).To(
+				Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("with -webhook-preset=stripe", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = authServer([]string{
+				"-secret=whsec_foobar",
+				"-auth",
+				"-webhook-preset=stripe",
+			})
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		stripeSignature := func(t time.Time, body string) string {
+			timestamp := strconv.FormatInt(t.Unix(), 10)
+			h := hmac.New(sha256.New, []byte("whsec_foobar"))
+			_, _ = h.Write([]byte(timestamp + "." + body))
+			return "t=" + timestamp + ",v1=" +
+				hex.EncodeToString(h.Sum(nil))
+		}
+
+		It("should accept a valid signature", func() {
+			body := `{"id":"evt_test","type":"charge.succeeded"}`
+			Expect(post(server.URL, "Stripe-Signature",
+				stripeSignature(time.Now(), body), body)).To(
+				Equal(http.StatusAccepted))
+		})
+
+		It("should accept any one of several signatures", func() {
+			body := `{"id":"evt_test","type":"charge.succeeded"}`
+			signature := stripeSignature(time.Now(), body)
+			signature = strings.Replace(signature, ",v1=",
+				",v1=0123456789abcdef,v1=", 1)
+			Expect(post(server.URL, "Stripe-Signature",
+				signature, body)).To(Equal(http.StatusAccepted))
+		})
+
+		It("should reject a stale signature", func() {
+			body := `{"id":"evt_test","type":"charge.succeeded"}`
+			Expect(post(server.URL, "Stripe-Signature",
+				stripeSignature(time.Now().Add(-time.Hour), body),
+				body)).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	It("should sign requests using the preset", func() {
+		upstream := authServer([]string{
+			"-secret=foobar",
+			"-auth",
+			"-webhook-preset=stripe",
+		})
+		defer upstream.Close()
+
+		localFlags := flag.NewFlagSet(
+			"HmacProxy webhook presets (local)", flag.ContinueOnError)
+		localOpts := RegisterCommandLineOptions(localFlags)
+		handler, _ := newHandler(localFlags, localOpts, []string{
+			"-secret=foobar",
+			"-upstream=" + upstream.URL,
+			"-webhook-preset=stripe",
+		})
+		local := httptest.NewServer(handler)
+		defer local.Close()
+
+		response, err := http.Post(local.URL, "application/json",
+			strings.NewReader(`{"id":"evt_test"}`))
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusAccepted))
+	})
+})